@@ -17,6 +17,7 @@ package client
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -31,6 +32,7 @@ var (
 	ErrNoEndpoints           = errors.New("client: no endpoints available")
 	ErrTooManyRedirects      = errors.New("client: too many redirects")
 	errTooManyRedirectChecks = errors.New("client: too many redirect checks")
+	errStreamingUnsupported  = errors.New("client: streaming responses not supported")
 )
 
 var DefaultRequestTimeout = 5 * time.Second
@@ -133,6 +135,13 @@ type httpClient interface {
 	Do(context.Context, httpAction) (*http.Response, []byte, error)
 }
 
+// httpStreamClient is implemented by the httpClients which can return a
+// response before its body has been read, as needed to tail a stream. The
+// body of the response must be closed by the caller.
+type httpStreamClient interface {
+	DoStream(context.Context, httpAction) (*http.Response, error)
+}
+
 func newHTTPClientFactory(tr CancelableTransport, cr CheckRedirectFunc) httpClientFactory {
 	return func(ep url.URL) httpClient {
 		return &redirectFollowingHTTPClient{
@@ -213,6 +222,44 @@ func (c *httpClusterClient) Do(ctx context.Context, act httpAction) (*http.Respo
 	return resp, body, err
 }
 
+// DoStream is like Do, but returns the response without reading its body.
+// As in Do, the endpoints are tried in turn until one of them answers
+// without a server error.
+func (c *httpClusterClient) DoStream(ctx context.Context, act httpAction) (*http.Response, error) {
+	c.RLock()
+	eps := make([]url.URL, len(c.endpoints))
+	copy(eps, c.endpoints)
+	c.RUnlock()
+
+	if len(eps) == 0 {
+		return nil, ErrNoEndpoints
+	}
+
+	var resp *http.Response
+	var err error
+
+	for i, ep := range eps {
+		hc, ok := c.clientFactory(ep).(httpStreamClient)
+		if !ok {
+			return nil, errStreamingUnsupported
+		}
+		resp, err = hc.DoStream(ctx, act)
+		if err != nil {
+			if err == context.DeadlineExceeded || err == context.Canceled {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode/100 == 5 && i < len(eps)-1 {
+			resp.Body.Close()
+			continue
+		}
+		break
+	}
+
+	return resp, err
+}
+
 func (c *httpClusterClient) Endpoints() []string {
 	c.RLock()
 	defer c.RUnlock()
@@ -293,6 +340,58 @@ func (c *simpleHTTPClient) Do(ctx context.Context, act httpAction) (*http.Respon
 	return resp, body, err
 }
 
+// DoStream is like Do, but returns the response without reading its body.
+// The request is cancelled with ctx until the body is closed.
+func (c *simpleHTTPClient) DoStream(ctx context.Context, act httpAction) (*http.Response, error) {
+	req := act.HTTPRequest(c.endpoint)
+
+	rtchan := make(chan roundTripResponse, 1)
+	go func() {
+		resp, err := c.transport.RoundTrip(req)
+		rtchan <- roundTripResponse{resp: resp, err: err}
+		close(rtchan)
+	}()
+
+	select {
+	case rtresp := <-rtchan:
+		if rtresp.err != nil {
+			return nil, rtresp.err
+		}
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.transport.CancelRequest(req)
+			case <-done:
+			}
+		}()
+		resp := rtresp.resp
+		resp.Body = &streamBody{ReadCloser: resp.Body, done: done}
+		return resp, nil
+	case <-ctx.Done():
+		// cancel and wait for request to actually exit before continuing
+		c.transport.CancelRequest(req)
+		rtresp := <-rtchan
+		if rtresp.resp != nil {
+			rtresp.resp.Body.Close()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// streamBody is the body of a response returned by DoStream. Closing it
+// stops watching the context of the request.
+type streamBody struct {
+	io.ReadCloser
+	done chan struct{}
+	once sync.Once
+}
+
+func (b *streamBody) Close() error {
+	b.once.Do(func() { close(b.done) })
+	return b.ReadCloser.Close()
+}
+
 type redirectFollowingHTTPClient struct {
 	client        httpClient
 	checkRedirect CheckRedirectFunc
@@ -331,6 +430,45 @@ func (r *redirectFollowingHTTPClient) Do(ctx context.Context, act httpAction) (*
 	return nil, nil, errTooManyRedirectChecks
 }
 
+// DoStream is like Do, but returns the response without reading its body.
+func (r *redirectFollowingHTTPClient) DoStream(ctx context.Context, act httpAction) (*http.Response, error) {
+	sc, ok := r.client.(httpStreamClient)
+	if !ok {
+		return nil, errStreamingUnsupported
+	}
+	next := act
+	for i := 0; i < 100; i++ {
+		if i > 0 {
+			if err := r.checkRedirect(i); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := sc.DoStream(ctx, next)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode/100 == 3 {
+			resp.Body.Close()
+			hdr := resp.Header.Get("Location")
+			if hdr == "" {
+				return nil, fmt.Errorf("Location header not set")
+			}
+			loc, err := url.Parse(hdr)
+			if err != nil {
+				return nil, fmt.Errorf("Location header not valid URL: %s", hdr)
+			}
+			next = &redirectedHTTPAction{
+				action:   act,
+				location: *loc,
+			}
+			continue
+		}
+		return resp, nil
+	}
+
+	return nil, errTooManyRedirectChecks
+}
+
 type redirectedHTTPAction struct {
 	action   httpAction
 	location url.URL
@@ -41,12 +41,15 @@ const (
 	ErrorCodeIndexNaN          = 203
 	ErrorCodeInvalidField      = 209
 	ErrorCodeInvalidForm       = 210
+	ErrorCodeEntryTooLarge     = 211
 
 	ErrorCodeRaftInternal = 300
 	ErrorCodeLeaderElect  = 301
 
 	ErrorCodeWatcherCleared    = 400
 	ErrorCodeEventIndexCleared = 401
+	ErrorCodeOffsetCompacted   = 405
+	ErrorCodeQuotaExceeded     = 406
 )
 
 type Error struct {
@@ -0,0 +1,527 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+var (
+	defaultV2StreamsPrefix = "/v2/streams"
+
+	errNoStreamNode   = errors.New("client: no node in streams response")
+	errStreamChecksum = errors.New("client: stream entry does not match its checksum")
+	crc32cTable       = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// NewStreamsAPI builds a StreamsAPI that interacts with etcd's streams
+// API over HTTP.
+func NewStreamsAPI(c Client) StreamsAPI {
+	return NewStreamsAPIWithPrefix(c, defaultV2StreamsPrefix)
+}
+
+// NewStreamsAPIWithPrefix acts like NewStreamsAPI, but allows the caller
+// to provide a custom base URL path. This should only be used in
+// very rare cases.
+func NewStreamsAPIWithPrefix(c Client, p string) StreamsAPI {
+	return &httpStreamsAPI{
+		client: c,
+		prefix: p,
+	}
+}
+
+type StreamsAPI interface {
+	// Append appends the value to the stream identified by the given id,
+	// creating the stream if it does not exist, and returns the offset
+	// of the new entry.
+	Append(ctx context.Context, id string, value []byte) (int64, error)
+
+	// Get retrieves the entry at the given offset, with its value as
+	// stored, the offset of the next entry and the checksum of the value.
+	Get(ctx context.Context, id string, offset int64) (*StreamEntry, error)
+
+	// Info retrieves the current tail of the stream.
+	Info(ctx context.Context, id string) (*StreamInfo, error)
+
+	// List enumerates the streams of the cluster.
+	List(ctx context.Context) ([]*StreamInfo, error)
+
+	// Hashes retrieves the hashes of the streams held by the member serving
+	// the request, as of the given raft index, or of the latest index the
+	// member applied if index is 0. Members which hold the same entries
+	// return the same hashes for the same index.
+	Hashes(ctx context.Context, index uint64) (*StreamHashes, error)
+
+	// Tailer builds a new Tailer emitting the entries of the stream
+	// identified by the given id, as they are appended. The Tailer may be
+	// configured at creation time through a TailerOptions object.
+	Tailer(id string, opts *TailerOptions) Tailer
+}
+
+type TailerOptions struct {
+	// From is the offset of the first entry the Tailer should emit.
+	// Setting From to 0 (default) emits every entry of the stream.
+	From int64
+}
+
+type Tailer interface {
+	// Next blocks until an entry is available in the stream, then returns
+	// it. Next is designed to be called repeatedly, each time blocking
+	// until a subsequent entry is available.
+	//
+	// If the connection to etcd is lost, Next reconnects and resumes after
+	// the last entry it returned. If the provided context is cancelled, Next
+	// will return a non-nil error, and the next call reconnects. Any other
+	// failures encountered while waiting for the next entry (connection
+	// issues, deserialization failures, etc) will also result in a non-nil
+	// error.
+	Next(context.Context) (*StreamEntry, error)
+
+	// Close releases the connection held by the Tailer.
+	Close()
+}
+
+type StreamInfo struct {
+	// Id is the identifier of the stream.
+	Id string
+
+	// Tail is the offset at which the next entry will be appended.
+	Tail int64
+
+	// Start is the offset of the first entry retained by the stream, and
+	// Entries the number of entries retained. They are only set by List.
+	Start   int64
+	Entries int64
+}
+
+type StreamHashes struct {
+	// Index is the raft index the hashes were taken at.
+	Index uint64 `json:"index"`
+
+	// Streams holds the hash of every stream existing at Index, sorted by
+	// id.
+	Streams []StreamHash `json:"streams"`
+}
+
+type StreamHash struct {
+	// Id is the identifier of the stream.
+	Id string `json:"id"`
+
+	// Start and Tail bound the entries retained by the stream at the index
+	// of the hash, and Hash is the CRC-32C of those entries as stored.
+	Start int64  `json:"start"`
+	Tail  int64  `json:"tail"`
+	Hash  uint32 `json:"hash"`
+}
+
+type StreamEntry struct {
+	// Offset is the position of the entry in its stream.
+	Offset int64
+
+	// Value is the data stored in the entry.
+	Value []byte
+
+	// Next is the offset of the following entry, and Checksum the CRC-32C
+	// of Value. They are only set by Get.
+	Next     int64
+	Checksum uint32
+}
+
+type httpStreamsAPI struct {
+	client httpClient
+	prefix string
+}
+
+func (s *httpStreamsAPI) Append(ctx context.Context, id string, value []byte) (int64, error) {
+	act := &streamAppendAction{
+		Prefix: s.prefix,
+		Id:     id,
+		Value:  value,
+	}
+
+	resp, body, err := s.client.Do(ctx, act)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := unmarshalHTTPResponse(resp.StatusCode, resp.Header, body)
+	if err != nil {
+		return 0, err
+	}
+	if res.Node == nil {
+		return 0, errNoStreamNode
+	}
+	return strconv.ParseInt(path.Base(res.Node.Key), 16, 64)
+}
+
+func (s *httpStreamsAPI) Get(ctx context.Context, id string, offset int64) (*StreamEntry, error) {
+	act := &streamGetAction{
+		Prefix: s.prefix,
+		Id:     id,
+		Elem:   strconv.FormatInt(offset, 16),
+		Raw:    true,
+	}
+
+	resp, body, err := s.client.Do(ctx, act)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, unmarshalFailedKeysResponse(body)
+	}
+	return unmarshalRawStreamEntry(resp.Header, body)
+}
+
+// unmarshalRawStreamEntry builds the entry of a raw read from the value in
+// the body of the response and the X-Stream-* headers describing it.
+func unmarshalRawStreamEntry(header http.Header, body []byte) (*StreamEntry, error) {
+	offset, err := strconv.ParseInt(header.Get("X-Stream-Offset"), 16, 64)
+	if err != nil {
+		return nil, err
+	}
+	next, err := strconv.ParseInt(header.Get("X-Stream-Next-Offset"), 16, 64)
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := strconv.ParseUint(header.Get("X-Stream-Crc32c"), 16, 32)
+	if err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(body, crc32cTable) != uint32(checksum) {
+		return nil, errStreamChecksum
+	}
+	return &StreamEntry{Offset: offset, Value: body, Next: next, Checksum: uint32(checksum)}, nil
+}
+
+func (s *httpStreamsAPI) Info(ctx context.Context, id string) (*StreamInfo, error) {
+	act := &streamGetAction{
+		Prefix: s.prefix,
+		Id:     id,
+		Elem:   "info",
+	}
+
+	resp, body, err := s.client.Do(ctx, act)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := unmarshalHTTPResponse(resp.StatusCode, resp.Header, body)
+	if err != nil {
+		return nil, err
+	}
+	if res.Node == nil {
+		return nil, errNoStreamNode
+	}
+	tail, err := strconv.ParseInt(res.Node.Value, 16, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamInfo{Id: id, Tail: tail}, nil
+}
+
+func (s *httpStreamsAPI) List(ctx context.Context) ([]*StreamInfo, error) {
+	act := &streamGetAction{Prefix: s.prefix}
+
+	resp, body, err := s.client.Do(ctx, act)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, unmarshalFailedKeysResponse(body)
+	}
+
+	var sCollection struct {
+		Streams []struct {
+			Id      string `json:"id"`
+			Start   int64  `json:"start"`
+			Size    int64  `json:"size"`
+			Entries int64  `json:"entries"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(body, &sCollection); err != nil {
+		return nil, err
+	}
+
+	infos := make([]*StreamInfo, len(sCollection.Streams))
+	for i, st := range sCollection.Streams {
+		infos[i] = &StreamInfo{
+			Id:      st.Id,
+			Tail:    st.Start + st.Size,
+			Start:   st.Start,
+			Entries: st.Entries,
+		}
+	}
+	return infos, nil
+}
+
+func (s *httpStreamsAPI) Hashes(ctx context.Context, index uint64) (*StreamHashes, error) {
+	act := &streamHashAction{Prefix: s.prefix, Index: index}
+
+	resp, body, err := s.client.Do(ctx, act)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, unmarshalFailedKeysResponse(body)
+	}
+
+	var hs StreamHashes
+	if err := json.Unmarshal(body, &hs); err != nil {
+		return nil, err
+	}
+	return &hs, nil
+}
+
+func (s *httpStreamsAPI) Tailer(id string, opts *TailerOptions) Tailer {
+	act := streamTailAction{
+		Prefix: s.prefix,
+		Id:     id,
+	}
+
+	if opts != nil {
+		act.Offset = opts.From
+	}
+
+	t := &httpTailer{nextTail: act}
+	t.client, _ = s.client.(httpStreamClient)
+	return t
+}
+
+// httpTailer tails a stream over a chunked HTTP response, which is held
+// open across calls to Next.
+type httpTailer struct {
+	client   httpStreamClient
+	nextTail streamTailAction
+
+	// delivered reports whether the entry at nextTail.Offset has been
+	// returned by Next, so that it is skipped once reconnected.
+	delivered bool
+
+	resp   *http.Response
+	dec    *json.Decoder
+	cancel context.CancelFunc
+	// fresh is set until an entry is read from a new connection, so that
+	// a connection failing straight away is not retried in a loop.
+	fresh bool
+}
+
+type tailResult struct {
+	entry *StreamEntry
+	err   error
+}
+
+func (t *httpTailer) Next(ctx context.Context) (*StreamEntry, error) {
+	if t.client == nil {
+		return nil, errStreamingUnsupported
+	}
+	for {
+		if t.resp == nil {
+			if err := t.connect(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		ent, err := t.read(ctx)
+		if err != nil {
+			fresh := t.fresh
+			t.Close()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if fresh {
+				return nil, err
+			}
+			continue
+		}
+		t.fresh = false
+
+		if t.delivered && ent.Offset == t.nextTail.Offset {
+			continue
+		}
+		t.nextTail.Offset = ent.Offset
+		t.delivered = true
+		return ent, nil
+	}
+}
+
+// connect starts a tail at the last delivered entry. The connection
+// outlives ctx, which only bounds how long connecting may take.
+func (t *httpTailer) connect(ctx context.Context) error {
+	cctx, cancel := context.WithCancel(context.Background())
+	connected := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-connected:
+		}
+	}()
+
+	resp, err := t.client.DoStream(cctx, &t.nextTail)
+	close(connected)
+	if err != nil {
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		cancel()
+		if err != nil {
+			return err
+		}
+		return unmarshalFailedKeysResponse(body)
+	}
+
+	t.resp = resp
+	t.dec = json.NewDecoder(resp.Body)
+	t.cancel = cancel
+	t.fresh = true
+	return nil
+}
+
+// read reads the next entry of the tail. If ctx is done first, the
+// connection is closed.
+func (t *httpTailer) read(ctx context.Context) (*StreamEntry, error) {
+	dec := t.dec
+	rchan := make(chan tailResult, 1)
+	go func() {
+		var e struct {
+			Offset string `json:"offset"`
+			Value  string `json:"value"`
+		}
+		if err := dec.Decode(&e); err != nil {
+			rchan <- tailResult{err: err}
+			return
+		}
+		offset, err := strconv.ParseInt(e.Offset, 16, 64)
+		if err != nil {
+			rchan <- tailResult{err: err}
+			return
+		}
+		rchan <- tailResult{entry: &StreamEntry{Offset: offset, Value: []byte(e.Value)}}
+	}()
+
+	select {
+	case r := <-rchan:
+		return r.entry, r.err
+	case <-ctx.Done():
+		// close the connection and wait for the read to give up
+		t.Close()
+		<-rchan
+		return nil, ctx.Err()
+	}
+}
+
+func (t *httpTailer) Close() {
+	if t.resp == nil {
+		return
+	}
+	t.cancel()
+	t.resp.Body.Close()
+	t.resp = nil
+	t.dec = nil
+}
+
+// v2StreamsURL forms a URL representing the location of a stream, or of
+// the given element of a stream such as the offset of an entry.
+func v2StreamsURL(ep url.URL, prefix, id string, elem ...string) *url.URL {
+	ep.Path = path.Join(append([]string{ep.Path, prefix, id}, elem...)...)
+	return &ep
+}
+
+type streamAppendAction struct {
+	Prefix string
+	Id     string
+	Value  []byte
+}
+
+func (a *streamAppendAction) HTTPRequest(ep url.URL) *http.Request {
+	u := v2StreamsURL(ep, a.Prefix, a.Id)
+
+	req, _ := http.NewRequest("POST", u.String(), bytes.NewReader(a.Value))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return req
+}
+
+type streamGetAction struct {
+	Prefix string
+	Id     string
+	Elem   string
+	// Raw requests the value of an entry as stored rather than as JSON.
+	Raw bool
+}
+
+func (a *streamGetAction) HTTPRequest(ep url.URL) *http.Request {
+	u := v2StreamsURL(ep, a.Prefix, a.Id, a.Elem)
+
+	req, _ := http.NewRequest("GET", u.String(), nil)
+	if a.Raw {
+		req.Header.Set("Accept", "application/octet-stream")
+	}
+	return req
+}
+
+type streamHashAction struct {
+	Prefix string
+	Index  uint64
+}
+
+func (a *streamHashAction) HTTPRequest(ep url.URL) *http.Request {
+	u := v2StreamsURL(ep, a.Prefix, "")
+
+	params := u.Query()
+	params.Set("hash", "true")
+	if a.Index != 0 {
+		params.Set("index", strconv.FormatUint(a.Index, 10))
+	}
+	u.RawQuery = params.Encode()
+
+	req, _ := http.NewRequest("GET", u.String(), nil)
+	return req
+}
+
+type streamTailAction struct {
+	Prefix string
+	Id     string
+	Offset int64
+}
+
+func (a *streamTailAction) HTTPRequest(ep url.URL) *http.Request {
+	u := v2StreamsURL(ep, a.Prefix, a.Id, strconv.FormatInt(a.Offset, 16))
+
+	params := u.Query()
+	params.Set("wait", "true")
+	u.RawQuery = params.Encode()
+
+	req, _ := http.NewRequest("GET", u.String(), nil)
+	return req
+}
@@ -0,0 +1,394 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestStreamsURLHelper(t *testing.T) {
+	tests := []struct {
+		endpoint url.URL
+		prefix   string
+		id       string
+		elem     []string
+		want     url.URL
+	}{
+		{
+			endpoint: url.URL{Scheme: "http", Host: "example.com", Path: "/v2/streams"},
+			id:       "foo",
+			want:     url.URL{Scheme: "http", Host: "example.com", Path: "/v2/streams/foo"},
+		},
+		{
+			endpoint: url.URL{Scheme: "https", Host: "example.com"},
+			prefix:   "/v2/streams",
+			id:       "foo",
+			elem:     []string{"1a"},
+			want:     url.URL{Scheme: "https", Host: "example.com", Path: "/v2/streams/foo/1a"},
+		},
+	}
+
+	for i, tt := range tests {
+		got := v2StreamsURL(tt.endpoint, tt.prefix, tt.id, tt.elem...)
+		if tt.want != *got {
+			t.Errorf("#%d: want=%#v, got=%#v", i, tt.want, *got)
+		}
+	}
+}
+
+func TestStreamsActions(t *testing.T) {
+	ep := url.URL{Scheme: "http", Host: "example.com"}
+	tests := []struct {
+		act httpAction
+
+		wmethod string
+		wurl    string
+		wbody   string
+		waccept string
+	}{
+		{
+			&streamAppendAction{Prefix: "/v2/streams", Id: "foo", Value: []byte("bar")},
+			"POST", "http://example.com/v2/streams/foo", "bar", "",
+		},
+		{
+			&streamGetAction{Prefix: "/v2/streams", Id: "foo", Elem: "1a"},
+			"GET", "http://example.com/v2/streams/foo/1a", "", "",
+		},
+		{
+			&streamGetAction{Prefix: "/v2/streams", Id: "foo", Elem: "1a", Raw: true},
+			"GET", "http://example.com/v2/streams/foo/1a", "", "application/octet-stream",
+		},
+		{
+			&streamTailAction{Prefix: "/v2/streams", Id: "foo", Offset: 26},
+			"GET", "http://example.com/v2/streams/foo/1a?wait=true", "", "",
+		},
+		{
+			&streamHashAction{Prefix: "/v2/streams"},
+			"GET", "http://example.com/v2/streams?hash=true", "", "",
+		},
+		{
+			&streamHashAction{Prefix: "/v2/streams", Index: 12},
+			"GET", "http://example.com/v2/streams?hash=true&index=12", "", "",
+		},
+	}
+
+	for i, tt := range tests {
+		req := tt.act.HTTPRequest(ep)
+		if req.Method != tt.wmethod {
+			t.Errorf("#%d: method = %s, want %s", i, req.Method, tt.wmethod)
+		}
+		if g := req.URL.String(); g != tt.wurl {
+			t.Errorf("#%d: url = %s, want %s", i, g, tt.wurl)
+		}
+		var body []byte
+		if req.Body != nil {
+			body, _ = ioutil.ReadAll(req.Body)
+		}
+		if string(body) != tt.wbody {
+			t.Errorf("#%d: body = %q, want %q", i, body, tt.wbody)
+		}
+		if g := req.Header.Get("Accept"); g != tt.waccept {
+			t.Errorf("#%d: accept = %q, want %q", i, g, tt.waccept)
+		}
+	}
+}
+
+func TestHTTPStreamsAPIAppend(t *testing.T) {
+	client := &actionAssertingHTTPClient{
+		t:    t,
+		act:  &streamAppendAction{Prefix: "/v2/streams", Id: "foo", Value: []byte("bar")},
+		resp: http.Response{StatusCode: http.StatusCreated},
+		body: []byte(`{"action":"create","node":{"key":"/foo/1a"}}`),
+	}
+	sAPI := &httpStreamsAPI{client: client, prefix: "/v2/streams"}
+
+	offset, err := sAPI.Append(context.Background(), "foo", []byte("bar"))
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	if offset != 26 {
+		t.Errorf("offset = %d, want %d", offset, 26)
+	}
+}
+
+func TestHTTPStreamsAPIGet(t *testing.T) {
+	// the value is not valid UTF-8, and is returned as stored
+	value := []byte{0xff, 0x00, 'b'}
+	checksum := crc32.Checksum(value, crc32.MakeTable(crc32.Castagnoli))
+	header := http.Header{}
+	header.Set("X-Stream-Offset", "1a")
+	header.Set("X-Stream-Next-Offset", "29")
+	header.Set("X-Stream-Crc32c", fmt.Sprintf("%08x", checksum))
+	client := &actionAssertingHTTPClient{
+		t:    t,
+		act:  &streamGetAction{Prefix: "/v2/streams", Id: "foo", Elem: "1a", Raw: true},
+		resp: http.Response{StatusCode: http.StatusOK, Header: header},
+		body: value,
+	}
+	sAPI := &httpStreamsAPI{client: client, prefix: "/v2/streams"}
+
+	ent, err := sAPI.Get(context.Background(), "foo", 26)
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	went := &StreamEntry{Offset: 26, Value: value, Next: 41, Checksum: checksum}
+	if !reflect.DeepEqual(ent, went) {
+		t.Errorf("entry = %#v, want %#v", ent, went)
+	}
+
+	// a value which does not match its checksum is rejected
+	client.body = []byte{0xff, 0x00, 'c'}
+	if _, err = sAPI.Get(context.Background(), "foo", 26); err != errStreamChecksum {
+		t.Errorf("err = %v, want %v", err, errStreamChecksum)
+	}
+}
+
+func TestHTTPStreamsAPIInfo(t *testing.T) {
+	client := &actionAssertingHTTPClient{
+		t:    t,
+		act:  &streamGetAction{Prefix: "/v2/streams", Id: "foo", Elem: "info"},
+		resp: http.Response{StatusCode: http.StatusOK},
+		body: []byte(`{"action":"get","node":{"key":"/fooinfo","value":"2b"}}`),
+	}
+	sAPI := &httpStreamsAPI{client: client, prefix: "/v2/streams"}
+
+	info, err := sAPI.Info(context.Background(), "foo")
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	if w := (&StreamInfo{Id: "foo", Tail: 43}); !reflect.DeepEqual(info, w) {
+		t.Errorf("info = %#v, want %#v", info, w)
+	}
+}
+
+func TestHTTPStreamsAPIList(t *testing.T) {
+	client := &actionAssertingHTTPClient{
+		t:    t,
+		act:  &streamGetAction{Prefix: "/v2/streams"},
+		resp: http.Response{StatusCode: http.StatusOK},
+		body: []byte(`{"streams":[{"id":"foo","start":9,"size":34,"entries":3,"createdIndex":4},{"id":"bar","start":0,"size":0,"entries":0,"createdIndex":7}]}`),
+	}
+	sAPI := &httpStreamsAPI{client: client, prefix: "/v2/streams"}
+
+	infos, err := sAPI.List(context.Background())
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	winfos := []*StreamInfo{
+		{Id: "foo", Tail: 43, Start: 9, Entries: 3},
+		{Id: "bar"},
+	}
+	if !reflect.DeepEqual(infos, winfos) {
+		t.Errorf("infos = %#v, want %#v", infos, winfos)
+	}
+}
+
+func TestHTTPStreamsAPIHashes(t *testing.T) {
+	client := &actionAssertingHTTPClient{
+		t:    t,
+		act:  &streamHashAction{Prefix: "/v2/streams", Index: 12},
+		resp: http.Response{StatusCode: http.StatusOK},
+		body: []byte(`{"index":12,"streams":[{"id":"foo","start":9,"tail":43,"hash":3735928559}]}`),
+	}
+	sAPI := &httpStreamsAPI{client: client, prefix: "/v2/streams"}
+
+	hs, err := sAPI.Hashes(context.Background(), 12)
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	whs := &StreamHashes{
+		Index:   12,
+		Streams: []StreamHash{{Id: "foo", Start: 9, Tail: 43, Hash: 0xdeadbeef}},
+	}
+	if !reflect.DeepEqual(hs, whs) {
+		t.Errorf("hashes = %#v, want %#v", hs, whs)
+	}
+}
+
+func TestHTTPStreamsAPIGetFail(t *testing.T) {
+	client := &staticHTTPClient{
+		resp: http.Response{StatusCode: http.StatusNotFound},
+		body: []byte(`{"errorCode":405,"message":"The entry at the requested offset is outdated and compacted","cause":"/foo/0","index":3}`),
+	}
+	sAPI := &httpStreamsAPI{client: client, prefix: "/v2/streams"}
+
+	_, err := sAPI.Get(context.Background(), "foo", 0)
+	if e, ok := err.(Error); !ok || e.Code != ErrorCodeOffsetCompacted {
+		t.Errorf("err = %v, want error code %d", err, ErrorCodeOffsetCompacted)
+	}
+}
+
+// streamResponse is a response of a fakeStreamClient. A nil body blocks
+// reads until the body is closed.
+type streamResponse struct {
+	code int
+	body *string
+	err  error
+}
+
+// fakeStreamClient answers DoStream with the given responses in turn,
+// recording the tail actions it is given.
+type fakeStreamClient struct {
+	staticHTTPClient
+	responses []streamResponse
+	acts      []streamTailAction
+}
+
+func (c *fakeStreamClient) DoStream(ctx context.Context, act httpAction) (*http.Response, error) {
+	c.acts = append(c.acts, *act.(*streamTailAction))
+	if len(c.responses) == 0 {
+		return nil, errors.New("no more responses")
+	}
+	r := c.responses[0]
+	c.responses = c.responses[1:]
+	if r.err != nil {
+		return nil, r.err
+	}
+	var body io.ReadCloser
+	if r.body != nil {
+		body = ioutil.NopCloser(strings.NewReader(*r.body))
+	} else {
+		pr, _ := io.Pipe()
+		body = pr
+	}
+	return &http.Response{StatusCode: r.code, Body: body}, nil
+}
+
+func strptr(s string) *string { return &s }
+
+func TestHTTPTailerReconnect(t *testing.T) {
+	client := &fakeStreamClient{
+		responses: []streamResponse{
+			{code: http.StatusOK, body: strptr(`{"offset":"0","value":"a"}` + "\n" + `{"offset":"9","value":"bb"}` + "\n")},
+			// resumes at the last entry returned, which is skipped
+			{code: http.StatusOK, body: strptr(`{"offset":"9","value":"bb"}` + "\n" + `{"offset":"13","value":"c"}` + "\n")},
+			{err: errors.New("unavailable")},
+		},
+	}
+	sAPI := &httpStreamsAPI{client: client, prefix: "/v2/streams"}
+	tailer := sAPI.Tailer("foo", nil)
+
+	wentries := []*StreamEntry{
+		{Offset: 0, Value: []byte("a")},
+		{Offset: 9, Value: []byte("bb")},
+		{Offset: 19, Value: []byte("c")},
+	}
+	for i, w := range wentries {
+		ent, err := tailer.Next(context.Background())
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if !reflect.DeepEqual(ent, w) {
+			t.Errorf("#%d: entry = %#v, want %#v", i, ent, w)
+		}
+	}
+	if _, err := tailer.Next(context.Background()); err == nil {
+		t.Errorf("err = nil, want error")
+	}
+
+	wacts := []streamTailAction{
+		{Prefix: "/v2/streams", Id: "foo", Offset: 0},
+		{Prefix: "/v2/streams", Id: "foo", Offset: 9},
+		{Prefix: "/v2/streams", Id: "foo", Offset: 19},
+	}
+	if !reflect.DeepEqual(client.acts, wacts) {
+		t.Errorf("actions = %#v, want %#v", client.acts, wacts)
+	}
+}
+
+func TestHTTPTailerCancel(t *testing.T) {
+	client := &fakeStreamClient{
+		responses: []streamResponse{
+			{code: http.StatusOK},
+			{code: http.StatusOK, body: strptr(`{"offset":"1a","value":"a"}` + "\n")},
+		},
+	}
+	sAPI := &httpStreamsAPI{client: client, prefix: "/v2/streams"}
+	tailer := sAPI.Tailer("foo", &TailerOptions{From: 26})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tailer.Next(ctx); err != context.Canceled {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+
+	// the next call reconnects
+	ent, err := tailer.Next(context.Background())
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	if ent.Offset != 26 {
+		t.Errorf("offset = %d, want %d", ent.Offset, 26)
+	}
+	if len(client.acts) != 2 {
+		t.Errorf("len(actions) = %d, want %d", len(client.acts), 2)
+	}
+}
+
+func TestHTTPTailerError(t *testing.T) {
+	client := &fakeStreamClient{
+		responses: []streamResponse{
+			{code: http.StatusNotFound, body: strptr(`{"errorCode":100,"message":"Key not found","cause":"/foo","index":3}`)},
+		},
+	}
+	sAPI := &httpStreamsAPI{client: client, prefix: "/v2/streams"}
+	tailer := sAPI.Tailer("foo", nil)
+
+	_, err := tailer.Next(context.Background())
+	if e, ok := err.(Error); !ok || e.Code != ErrorCodeKeyNotFound {
+		t.Errorf("err = %v, want error code %d", err, ErrorCodeKeyNotFound)
+	}
+}
+
+func TestHTTPClusterClientDoStreamFailover(t *testing.T) {
+	responses := []streamResponse{
+		{code: http.StatusInternalServerError, body: strptr("")},
+		{code: http.StatusOK, body: strptr(`{"offset":"0","value":"a"}`)},
+	}
+	var clients []*fakeStreamClient
+	hc := &httpClusterClient{
+		clientFactory: func(url.URL) httpClient {
+			c := &fakeStreamClient{responses: responses[len(clients) : len(clients)+1]}
+			clients = append(clients, c)
+			return c
+		},
+		endpoints: []url.URL{
+			{Scheme: "http", Host: "a"},
+			{Scheme: "http", Host: "b"},
+		},
+	}
+
+	resp, err := hc.DoStream(context.Background(), &streamTailAction{Id: "foo"})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("code = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if len(clients) != 2 {
+		t.Errorf("len(clients) = %d, want %d", len(clients), 2)
+	}
+}
@@ -48,6 +48,7 @@ var errors = map[int]string{
 	ecodeIndexValueMutex:      "Index and value cannot both be specified",
 	EcodeInvalidField:         "Invalid field",
 	EcodeInvalidForm:          "Invalid POST form",
+	EcodeEntryTooLarge:        "The entry exceeds the maximum entry size",
 
 	// raft related errors
 	EcodeRaftInternal: "Raft Internal Error",
@@ -59,6 +60,8 @@ var errors = map[int]string{
 	ecodeStandbyInternal:    "Standby Internal Error",
 	ecodeInvalidActiveSize:  "Invalid active size",
 	ecodeInvalidRemoveDelay: "Standby remove delay",
+	EcodeOffsetCompacted:    "The entry at the requested offset is outdated and compacted",
+	EcodeQuotaExceeded:      "The append exceeds the quota of the streams",
 
 	// client related errors
 	ecodeClientInternal: "Client Internal Error",
@@ -72,6 +75,8 @@ var errorStatus = map[int]int{
 	EcodeNodeExist:    http.StatusPreconditionFailed,
 	EcodeRaftInternal: http.StatusInternalServerError,
 	EcodeLeaderElect:  http.StatusInternalServerError,
+
+	EcodeEntryTooLarge: http.StatusRequestEntityTooLarge,
 }
 
 const (
@@ -97,6 +102,7 @@ const (
 	ecodeIndexValueMutex      = 208
 	EcodeInvalidField         = 209
 	EcodeInvalidForm          = 210
+	EcodeEntryTooLarge        = 211
 
 	EcodeRaftInternal = 300
 	EcodeLeaderElect  = 301
@@ -106,6 +112,8 @@ const (
 	ecodeStandbyInternal    = 402
 	ecodeInvalidActiveSize  = 403
 	ecodeInvalidRemoveDelay = 404
+	EcodeOffsetCompacted    = 405
+	EcodeQuotaExceeded      = 406
 
 	ecodeClientInternal = 500
 )
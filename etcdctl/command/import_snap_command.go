@@ -12,6 +12,7 @@ import (
 	"github.com/coreos/etcd/Godeps/_workspace/src/github.com/codegangsta/cli"
 	"github.com/coreos/etcd/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
 	"github.com/coreos/etcd/store"
+	"github.com/coreos/etcd/store/streams"
 )
 
 type set struct {
@@ -44,7 +45,9 @@ func handleImportSnap(c *cli.Context) {
 		os.Exit(1)
 	}
 
-	st := store.New()
+	// the snapshot carries the contents of the streams, which are held in
+	// memory rather than written out as files
+	st := store.NewWithStreams("", store.StreamsConfig{Backend: streams.NewMemoryBackend(0)})
 	err = st.Recovery(d)
 	if err != nil {
 		fmt.Printf("cannot recover the snapshot file: %v\n", err)
@@ -0,0 +1,542 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/coreos/etcd/store/streams"
+)
+
+func NewStreamCommand() cli.Command {
+	return cli.Command{
+		Name:  "stream",
+		Usage: "stream append, get, info, tail, ls, verify, check and dump subcommands",
+		Subcommands: []cli.Command{
+			cli.Command{
+				Name:   "append",
+				Usage:  "append a value, read from the arguments or stdin, to a stream",
+				Action: actionStreamAppend,
+			},
+			cli.Command{
+				Name:   "get",
+				Usage:  "retrieve the entry of a stream at the given hexadecimal offset",
+				Action: actionStreamGet,
+			},
+			cli.Command{
+				Name:   "info",
+				Usage:  "retrieve the tail of a stream",
+				Action: actionStreamInfo,
+			},
+			cli.Command{
+				Name:  "tail",
+				Usage: "print the entries of a stream as they are appended",
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "from", Value: "0", Usage: "hexadecimal offset of the first entry to print"},
+					cli.IntFlag{Name: "count", Value: 0, Usage: "exit after printing the given number of entries (0 means forever)"},
+				},
+				Action: actionStreamTail,
+			},
+			cli.Command{
+				Name:   "ls",
+				Usage:  "enumerate the streams of the cluster",
+				Action: actionStreamList,
+			},
+			cli.Command{
+				Name:  "verify",
+				Usage: "compare the hashes of the streams of every member of the cluster as of the same raft index",
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "index", Value: "", Usage: "raft index to compare the streams at (defaults to the latest index applied by every member)"},
+				},
+				Action: actionStreamVerify,
+			},
+			cli.Command{
+				Name:  "check",
+				Usage: "verify the entries of the streams, or of the given streams, in the data directory of a stopped member",
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "data-dir", Value: "", Usage: "path to the data directory of the member"},
+					cli.BoolFlag{Name: "repair", Usage: "truncate corrupt streams to their last valid entry, keeping a copy of the dropped records"},
+					cli.IntFlag{Name: "max-entry-bytes", Value: 1024 * 1024, Usage: "size of the largest entry of a stream, as configured on the member, beyond which a record is corrupt (0 is unlimited)"},
+				},
+				Action: actionStreamCheck,
+			},
+			cli.Command{
+				Name:  "dump",
+				Usage: "print the entries of a stream in the data directory of a stopped member",
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "data-dir", Value: "", Usage: "path to the data directory of the member"},
+					cli.StringFlag{Name: "from", Value: "0", Usage: "hexadecimal offset of the first entry to print"},
+					cli.IntFlag{Name: "max-entry-bytes", Value: 1024 * 1024, Usage: "size of the largest entry of a stream, as configured on the member, beyond which a record is corrupt (0 is unlimited)"},
+				},
+				Action: actionStreamDump,
+			},
+		},
+	}
+}
+
+func mustNewStreamsAPI(c *cli.Context) client.StreamsAPI {
+	return client.NewStreamsAPI(mustNewClient(c))
+}
+
+// streamEntryOutput is the JSON output of a single stream entry. Offsets
+// are hexadecimal, as in the streams HTTP API.
+type streamEntryOutput struct {
+	Offset string  `json:"offset"`
+	Value  *string `json:"value,omitempty"`
+}
+
+// streamInfoOutput is the JSON output of the information of a stream.
+type streamInfoOutput struct {
+	Id      string `json:"id"`
+	Tail    string `json:"tail"`
+	Start   string `json:"start,omitempty"`
+	Entries int64  `json:"entries,omitempty"`
+}
+
+func actionStreamAppend(c *cli.Context) {
+	args := c.Args()
+	if len(args) == 0 {
+		handleError(MalformedEtcdctlArguments, errors.New("Stream id required"))
+	}
+	value, err := argOrStdin(args, os.Stdin, 1)
+	if err != nil {
+		handleError(MalformedEtcdctlArguments, errors.New("Value required"))
+	}
+
+	sAPI := mustNewStreamsAPI(c)
+	ctx, cancel := context.WithTimeout(context.Background(), client.DefaultRequestTimeout)
+	offset, err := sAPI.Append(ctx, args[0], []byte(value))
+	cancel()
+	if err != nil {
+		handleError(ErrorFromEtcd, err)
+	}
+
+	printStreamOutput(c, strconv.FormatInt(offset, 16), streamEntryOutput{Offset: strconv.FormatInt(offset, 16)})
+}
+
+func actionStreamGet(c *cli.Context) {
+	args := c.Args()
+	if len(args) != 2 {
+		handleError(MalformedEtcdctlArguments, errors.New("Provide a stream id and a hexadecimal offset"))
+	}
+	offset, err := strconv.ParseInt(args[1], 16, 64)
+	if err != nil {
+		handleError(MalformedEtcdctlArguments, fmt.Errorf("Invalid offset %q", args[1]))
+	}
+
+	sAPI := mustNewStreamsAPI(c)
+	ctx, cancel := context.WithTimeout(context.Background(), client.DefaultRequestTimeout)
+	ent, err := sAPI.Get(ctx, args[0], offset)
+	cancel()
+	if err != nil {
+		handleError(ErrorFromEtcd, err)
+	}
+
+	printStreamEntry(c, ent)
+}
+
+func actionStreamInfo(c *cli.Context) {
+	args := c.Args()
+	if len(args) != 1 {
+		handleError(MalformedEtcdctlArguments, errors.New("Stream id required"))
+	}
+
+	sAPI := mustNewStreamsAPI(c)
+	ctx, cancel := context.WithTimeout(context.Background(), client.DefaultRequestTimeout)
+	info, err := sAPI.Info(ctx, args[0])
+	cancel()
+	if err != nil {
+		handleError(ErrorFromEtcd, err)
+	}
+
+	tail := strconv.FormatInt(info.Tail, 16)
+	printStreamOutput(c, tail, streamInfoOutput{Id: info.Id, Tail: tail})
+}
+
+func actionStreamTail(c *cli.Context) {
+	args := c.Args()
+	if len(args) != 1 {
+		handleError(MalformedEtcdctlArguments, errors.New("Stream id required"))
+	}
+	from, err := strconv.ParseInt(c.String("from"), 16, 64)
+	if err != nil || from < 0 {
+		handleError(MalformedEtcdctlArguments, fmt.Errorf("Invalid offset %q", c.String("from")))
+	}
+	count := c.Int("count")
+
+	sAPI := mustNewStreamsAPI(c)
+	tailer := sAPI.Tailer(args[0], &client.TailerOptions{From: from})
+	defer tailer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt)
+	go func() {
+		<-sigch
+		cancel()
+	}()
+
+	for i := 0; count == 0 || i < count; i++ {
+		ent, err := tailer.Next(ctx)
+		if err == context.Canceled {
+			return
+		}
+		if err != nil {
+			handleError(ErrorFromEtcd, err)
+		}
+		printStreamEntry(c, ent)
+	}
+}
+
+func actionStreamList(c *cli.Context) {
+	if len(c.Args()) != 0 {
+		handleError(MalformedEtcdctlArguments, errors.New("No arguments accepted"))
+	}
+
+	sAPI := mustNewStreamsAPI(c)
+	ctx, cancel := context.WithTimeout(context.Background(), client.DefaultRequestTimeout)
+	infos, err := sAPI.List(ctx)
+	cancel()
+	if err != nil {
+		handleError(ErrorFromEtcd, err)
+	}
+
+	for _, info := range infos {
+		simple := fmt.Sprintf("%s: start=%x tail=%x entries=%d", info.Id, info.Start, info.Tail, info.Entries)
+		printStreamOutput(c, simple, streamInfoOutput{
+			Id:      info.Id,
+			Tail:    strconv.FormatInt(info.Tail, 16),
+			Start:   strconv.FormatInt(info.Start, 16),
+			Entries: info.Entries,
+		})
+	}
+}
+
+// streamVerifyOutput is the JSON output of the comparison of a stream
+// across the members of the cluster.
+type streamVerifyOutput struct {
+	Id       string                   `json:"id"`
+	Index    uint64                   `json:"index"`
+	Diverged bool                     `json:"diverged,omitempty"`
+	Members  []streamMemberHashOutput `json:"members"`
+}
+
+// streamMemberHashOutput is the hash of a stream on a single member, which
+// is missing if the member does not hold the stream.
+type streamMemberHashOutput struct {
+	Member  string `json:"member"`
+	Start   string `json:"start,omitempty"`
+	Tail    string `json:"tail,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+	Missing bool   `json:"missing,omitempty"`
+}
+
+func actionStreamVerify(c *cli.Context) {
+	if len(c.Args()) != 0 {
+		handleError(MalformedEtcdctlArguments, errors.New("No arguments accepted"))
+	}
+	var index uint64
+	if s := c.String("index"); s != "" {
+		var err error
+		if index, err = strconv.ParseUint(s, 10, 64); err != nil || index == 0 {
+			handleError(MalformedEtcdctlArguments, fmt.Errorf("Invalid index %q", s))
+		}
+	}
+
+	mAPI := mustNewMembersAPI(c)
+	ctx, cancel := context.WithTimeout(context.Background(), client.DefaultRequestTimeout)
+	members, err := mAPI.List(ctx)
+	cancel()
+	if err != nil {
+		handleError(ErrorFromEtcd, err)
+	}
+	tr, err := getTransport(c)
+	if err != nil {
+		handleError(MalformedEtcdctlArguments, err)
+	}
+
+	// every member is asked for the hashes of its own copy of the streams
+	names := make([]string, len(members))
+	apis := make([]client.StreamsAPI, len(members))
+	for i, m := range members {
+		names[i] = m.Name
+		if names[i] == "" {
+			names[i] = m.ID
+		}
+		if len(m.ClientURLs) == 0 {
+			handleError(ErrorFromEtcd, fmt.Errorf("Member %s has not published its client URLs", names[i]))
+		}
+		hc, err := client.New(client.Config{Transport: tr, Endpoints: m.ClientURLs})
+		if err != nil {
+			handleError(ErrorFromEtcd, err)
+		}
+		apis[i] = client.NewStreamsAPI(hc)
+	}
+
+	memberHashes := func(i int, index uint64) *client.StreamHashes {
+		ctx, cancel := context.WithTimeout(context.Background(), client.DefaultRequestTimeout)
+		defer cancel()
+		hs, err := apis[i].Hashes(ctx, index)
+		if err != nil {
+			handleError(ErrorFromEtcd, fmt.Errorf("cannot hash the streams of member %s: %v", names[i], err))
+		}
+		return hs
+	}
+
+	// Without an index, the streams are compared at the latest index
+	// every member has applied.
+	if index == 0 {
+		for i := range apis {
+			if hs := memberHashes(i, 0); index == 0 || hs.Index < index {
+				index = hs.Index
+			}
+		}
+	}
+	hashes := make([]*client.StreamHashes, len(apis))
+	for i := range apis {
+		hashes[i] = memberHashes(i, index)
+	}
+
+	diverged := 0
+	for _, out := range compareStreamHashes(index, names, hashes) {
+		simple := out.Id + ":"
+		if out.Diverged {
+			diverged++
+			simple += " diverged"
+			for _, m := range out.Members {
+				if m.Missing {
+					simple += fmt.Sprintf("\n\t%s: missing", m.Member)
+				} else {
+					simple += fmt.Sprintf("\n\t%s: start=%s tail=%s hash=%s", m.Member, m.Start, m.Tail, m.Hash)
+				}
+			}
+		} else {
+			m := out.Members[0]
+			simple += fmt.Sprintf(" start=%s tail=%s hash=%s ok", m.Start, m.Tail, m.Hash)
+		}
+		printStreamOutput(c, simple, out)
+	}
+
+	if diverged > 0 {
+		handleError(ErrorFromEtcd, fmt.Errorf("%d stream(s) diverged at index %d", diverged, index))
+	}
+}
+
+// compareStreamHashes compares the hashes of the streams taken by each of
+// the named members at the same index. A stream diverges unless every
+// member holds it with the same offsets and hash.
+func compareStreamHashes(index uint64, names []string, hashes []*client.StreamHashes) []streamVerifyOutput {
+	byMember := make([]map[string]client.StreamHash, len(hashes))
+	var ids []string
+	seen := make(map[string]bool)
+	for i, hs := range hashes {
+		byMember[i] = make(map[string]client.StreamHash)
+		for _, h := range hs.Streams {
+			byMember[i][h.Id] = h
+			if !seen[h.Id] {
+				seen[h.Id] = true
+				ids = append(ids, h.Id)
+			}
+		}
+	}
+	sort.Strings(ids)
+
+	outs := make([]streamVerifyOutput, 0, len(ids))
+	for _, id := range ids {
+		out := streamVerifyOutput{Id: id, Index: index}
+		var first *client.StreamHash
+		for i, name := range names {
+			h, ok := byMember[i][id]
+			if !ok {
+				out.Diverged = true
+				out.Members = append(out.Members, streamMemberHashOutput{Member: name, Missing: true})
+				continue
+			}
+			if first == nil {
+				first = &h
+			} else if h != *first {
+				out.Diverged = true
+			}
+			out.Members = append(out.Members, streamMemberHashOutput{
+				Member: name,
+				Start:  strconv.FormatInt(h.Start, 16),
+				Tail:   strconv.FormatInt(h.Tail, 16),
+				Hash:   fmt.Sprintf("%08x", h.Hash),
+			})
+		}
+		outs = append(outs, out)
+	}
+	return outs
+}
+
+// streamCheckOutput is the JSON output of the check of a stream.
+type streamCheckOutput struct {
+	Id       string `json:"id"`
+	Start    string `json:"start"`
+	Tail     string `json:"tail"`
+	Entries  int64  `json:"entries"`
+	Error    string `json:"error,omitempty"`
+	Repaired bool   `json:"repaired,omitempty"`
+}
+
+// streamDumpOutput is the JSON output of an entry read from the files of a
+// stream.
+type streamDumpOutput struct {
+	Offset   string `json:"offset"`
+	Next     string `json:"next"`
+	Checksum string `json:"checksum"`
+	Value    string `json:"value"`
+}
+
+// mustStreamsDir returns the streams directory of the member whose data
+// directory is given by the data-dir flag.
+func mustStreamsDir(c *cli.Context) string {
+	dir := c.String("data-dir")
+	if dir == "" {
+		handleError(MalformedEtcdctlArguments, errors.New("Data directory required (use --data-dir)"))
+	}
+	return path.Join(dir, "member", "streams")
+}
+
+// streamIds returns the ids of the streams stored in dir.
+func streamIds(dir string) ([]string, error) {
+	names, err := fileutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".broken") {
+			continue
+		}
+		if fi, err := os.Stat(path.Join(dir, name)); err != nil || !fi.IsDir() {
+			continue
+		}
+		ids = append(ids, name)
+	}
+	return ids, nil
+}
+
+func actionStreamCheck(c *cli.Context) {
+	dir := mustStreamsDir(c)
+	ids := []string(c.Args())
+	if len(ids) == 0 {
+		var err error
+		if ids, err = streamIds(dir); err != nil {
+			handleError(ErrorFromEtcd, err)
+		}
+	}
+
+	corrupt := 0
+	for _, id := range ids {
+		res, err := streams.Check(path.Join(dir, id), int64(c.Int("max-entry-bytes")))
+		if err != nil {
+			handleError(ErrorFromEtcd, fmt.Errorf("cannot check stream %s: %v", id, err))
+		}
+
+		out := streamCheckOutput{
+			Id:      id,
+			Start:   strconv.FormatInt(res.Start, 16),
+			Tail:    strconv.FormatInt(res.Tail, 16),
+			Entries: res.Entries,
+		}
+		simple := fmt.Sprintf("%s: start=%x tail=%x entries=%d", id, res.Start, res.Tail, res.Entries)
+		if res.Corrupt == nil {
+			printStreamOutput(c, simple+" ok", out)
+			continue
+		}
+
+		out.Error = res.Corrupt.Error()
+		simple += " " + out.Error
+		if c.Bool("repair") {
+			if err := streams.Truncate(path.Join(dir, id), res.Corrupt.Offset); err != nil {
+				handleError(ErrorFromEtcd, fmt.Errorf("cannot repair stream %s: %v", id, err))
+			}
+			out.Repaired = true
+			simple += fmt.Sprintf(", truncated to %x", res.Corrupt.Offset)
+		} else {
+			corrupt++
+		}
+		printStreamOutput(c, simple, out)
+	}
+
+	if corrupt > 0 {
+		handleError(ErrorFromEtcd, fmt.Errorf("%d corrupt stream(s), use --repair to truncate them", corrupt))
+	}
+}
+
+func actionStreamDump(c *cli.Context) {
+	dir := mustStreamsDir(c)
+	args := c.Args()
+	if len(args) != 1 {
+		handleError(MalformedEtcdctlArguments, errors.New("Stream id required"))
+	}
+	from, err := strconv.ParseInt(c.String("from"), 16, 64)
+	if err != nil || from < 0 {
+		handleError(MalformedEtcdctlArguments, fmt.Errorf("Invalid offset %q", c.String("from")))
+	}
+	if _, err := os.Stat(path.Join(dir, args[0])); err != nil {
+		handleError(ErrorFromEtcd, err)
+	}
+
+	err = streams.Dump(path.Join(dir, args[0]), from, int64(c.Int("max-entry-bytes")), func(ent *streams.Entry) error {
+		simple := fmt.Sprintf("%x\tnext=%x\tcrc32c=%08x\t%q", ent.Offset, ent.Next, ent.Checksum, ent.Value)
+		printStreamOutput(c, simple, streamDumpOutput{
+			Offset:   strconv.FormatInt(ent.Offset, 16),
+			Next:     strconv.FormatInt(ent.Next, 16),
+			Checksum: fmt.Sprintf("%08x", ent.Checksum),
+			Value:    string(ent.Value),
+		})
+		return nil
+	})
+	if err != nil {
+		handleError(ErrorFromEtcd, err)
+	}
+}
+
+// printStreamEntry prints the value of an entry, or the entry as JSON.
+func printStreamEntry(c *cli.Context, ent *client.StreamEntry) {
+	value := string(ent.Value)
+	printStreamOutput(c, value, streamEntryOutput{Offset: strconv.FormatInt(ent.Offset, 16), Value: &value})
+}
+
+// printStreamOutput prints simple, or v as JSON, depending on the global
+// output format.
+func printStreamOutput(c *cli.Context, simple string, v interface{}) {
+	switch format := c.GlobalString("output"); format {
+	case "simple":
+		fmt.Println(simple)
+	case "json":
+		b, err := json.Marshal(v)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(b))
+	default:
+		fmt.Fprintln(os.Stderr, "Unsupported output format:", format)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/client"
+)
+
+func TestCompareStreamHashes(t *testing.T) {
+	names := []string{"infra0", "infra1"}
+	hashes := []*client.StreamHashes{
+		{Index: 12, Streams: []client.StreamHash{
+			{Id: "bar", Start: 0, Tail: 9, Hash: 0xdeadbeef},
+			{Id: "foo", Start: 0, Tail: 19, Hash: 1},
+		}},
+		{Index: 12, Streams: []client.StreamHash{
+			{Id: "baz", Start: 0, Tail: 0},
+			{Id: "foo", Start: 0, Tail: 19, Hash: 2},
+			{Id: "bar", Start: 0, Tail: 9, Hash: 0xdeadbeef},
+		}},
+	}
+
+	w := []streamVerifyOutput{
+		{Id: "bar", Index: 12, Members: []streamMemberHashOutput{
+			{Member: "infra0", Start: "0", Tail: "9", Hash: "deadbeef"},
+			{Member: "infra1", Start: "0", Tail: "9", Hash: "deadbeef"},
+		}},
+		{Id: "baz", Index: 12, Diverged: true, Members: []streamMemberHashOutput{
+			{Member: "infra0", Missing: true},
+			{Member: "infra1", Start: "0", Tail: "0", Hash: "00000000"},
+		}},
+		{Id: "foo", Index: 12, Diverged: true, Members: []streamMemberHashOutput{
+			{Member: "infra0", Start: "0", Tail: "13", Hash: "00000001"},
+			{Member: "infra1", Start: "0", Tail: "13", Hash: "00000002"},
+		}},
+	}
+	if g := compareStreamHashes(12, names, hashes); !reflect.DeepEqual(g, w) {
+		t.Errorf("outputs = %+v, want %+v", g, w)
+	}
+}
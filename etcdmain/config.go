@@ -21,11 +21,13 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/coreos/etcd/etcdserver"
 	"github.com/coreos/etcd/pkg/cors"
 	"github.com/coreos/etcd/pkg/flags"
 	"github.com/coreos/etcd/pkg/transport"
+	"github.com/coreos/etcd/store/streams"
 	"github.com/coreos/etcd/version"
 )
 
@@ -40,6 +42,10 @@ const (
 	clusterStateFlagNew      = "new"
 	clusterStateFlagExisting = "existing"
 
+	streamsFsyncFlagAppend   = "append"
+	streamsFsyncFlagInterval = "interval"
+	streamsFsyncFlagNone     = "none"
+
 	defaultName = "default"
 )
 
@@ -80,6 +86,15 @@ type config struct {
 	TickMs     uint
 	ElectionMs uint
 
+	// streams
+	streamsBackend         *flags.StringsFlag
+	streamsFsync           *flags.StringsFlag
+	streamsFsyncIntervalMs uint
+	streamsMaxOpen         uint
+	streamsMaxEntryBytes   uint64
+	streamsQuotaBytes      uint64
+	streamsTotalQuotaBytes uint64
+
 	// clustering
 	apurls, acurls      []url.URL
 	clusterState        *flags.StringsFlag
@@ -121,6 +136,15 @@ func NewConfig() *config {
 			proxyFlagReadonly,
 			proxyFlagOn,
 		),
+		streamsBackend: flags.NewStringsFlag(
+			streams.BackendFile,
+			streams.BackendMemory,
+		),
+		streamsFsync: flags.NewStringsFlag(
+			streamsFsyncFlagAppend,
+			streamsFsyncFlagInterval,
+			streamsFsyncFlagNone,
+		),
 	}
 
 	cfg.FlagSet = flag.NewFlagSet("etcd", flag.ContinueOnError)
@@ -161,6 +185,23 @@ func NewConfig() *config {
 		log.Panicf("unexpected error setting up clusterStateFlag: %v", err)
 	}
 
+	// streams
+	fs.Var(cfg.streamsBackend, "streams-backend", fmt.Sprintf("Where streams are stored. Valid values include %s", strings.Join(cfg.streamsBackend.Values, ", ")))
+	if err := cfg.streamsBackend.Set(streams.BackendFile); err != nil {
+		// Should never happen.
+		log.Panicf("unexpected error setting up streams-backend flag: %v", err)
+	}
+	fs.Var(cfg.streamsFsync, "streams-fsync", fmt.Sprintf("When appends to streams are synced to disk. Valid values include %s", strings.Join(cfg.streamsFsync.Values, ", ")))
+	if err := cfg.streamsFsync.Set(streamsFsyncFlagAppend); err != nil {
+		// Should never happen.
+		log.Panicf("unexpected error setting up streams-fsync flag: %v", err)
+	}
+	fs.UintVar(&cfg.streamsFsyncIntervalMs, "streams-fsync-interval", 100, "Time (in milliseconds) within which appends to streams are synced when -streams-fsync is interval.")
+	fs.UintVar(&cfg.streamsMaxOpen, "streams-max-open", 1024, "Maximum number of streams whose files are kept open (0 is unlimited).")
+	fs.Uint64Var(&cfg.streamsMaxEntryBytes, "streams-max-entry-bytes", 1024*1024, "Maximum size in bytes of an entry appended to a stream (0 is unlimited).")
+	fs.Uint64Var(&cfg.streamsQuotaBytes, "streams-quota-bytes", 0, "Maximum number of bytes retained by a single stream, beyond which appends are rejected (0 is unlimited).")
+	fs.Uint64Var(&cfg.streamsTotalQuotaBytes, "streams-total-quota-bytes", 0, "Maximum number of bytes retained by all the streams, beyond which appends are rejected (0 is unlimited).")
+
 	// proxy
 	fs.Var(cfg.proxy, "proxy", fmt.Sprintf("Valid values include %s", strings.Join(cfg.proxy.Values, ", ")))
 	if err := cfg.proxy.Set(proxyFlagOff); err != nil {
@@ -258,6 +299,10 @@ func (cfg *config) Parse(arguments []string) error {
 		return err
 	}
 
+	if cfg.streamsFsyncIntervalMs == 0 {
+		return fmt.Errorf("-streams-fsync-interval should be greater than 0")
+	}
+
 	if 5*cfg.TickMs > cfg.ElectionMs {
 		return fmt.Errorf("-election-timeout[%vms] should be at least as 5 times as -heartbeat-interval[%vms]", cfg.ElectionMs, cfg.TickMs)
 	}
@@ -279,3 +324,16 @@ func (cfg config) isReadonlyProxy() bool       { return cfg.proxy.String() == pr
 func (cfg config) shouldFallbackToProxy() bool { return cfg.fallback.String() == fallbackFlagProxy }
 
 func (cfg config) electionTicks() int { return int(cfg.ElectionMs / cfg.TickMs) }
+
+func (cfg config) streamsSync() streams.SyncPolicy {
+	p := streams.SyncPolicy{Interval: time.Duration(cfg.streamsFsyncIntervalMs) * time.Millisecond}
+	switch cfg.streamsFsync.String() {
+	case streamsFsyncFlagInterval:
+		p.Mode = streams.SyncInterval
+	case streamsFsyncFlagNone:
+		p.Mode = streams.SyncNone
+	default:
+		p.Mode = streams.SyncAppend
+	}
+	return p
+}
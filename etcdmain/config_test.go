@@ -18,6 +18,9 @@ import (
 	"net/url"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/coreos/etcd/store/streams"
 )
 
 func TestConfigParsingMemberFlags(t *testing.T) {
@@ -287,3 +290,87 @@ func TestConfigShouldFallbackToProxy(t *testing.T) {
 		}
 	}
 }
+
+func TestConfigStreamsSync(t *testing.T) {
+	tests := []struct {
+		args []string
+
+		wsync streams.SyncPolicy
+	}{
+		{
+			[]string{},
+			streams.SyncPolicy{Mode: streams.SyncAppend, Interval: 100 * time.Millisecond},
+		},
+		{
+			[]string{"-streams-fsync=interval", "-streams-fsync-interval=20"},
+			streams.SyncPolicy{Mode: streams.SyncInterval, Interval: 20 * time.Millisecond},
+		},
+		{
+			[]string{"-streams-fsync=none"},
+			streams.SyncPolicy{Mode: streams.SyncNone, Interval: 100 * time.Millisecond},
+		},
+	}
+	for i, tt := range tests {
+		cfg := NewConfig()
+		if err := cfg.Parse(tt.args); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if g := cfg.streamsSync(); g != tt.wsync {
+			t.Errorf("#%d: streamsSync = %+v, want %+v", i, g, tt.wsync)
+		}
+	}
+
+	cfg := NewConfig()
+	if err := cfg.Parse([]string{"-streams-fsync-interval=0"}); err == nil {
+		t.Errorf("expected error on a zero -streams-fsync-interval")
+	}
+}
+
+func TestConfigStreamsBackend(t *testing.T) {
+	tests := []struct {
+		args []string
+
+		wbackend string
+	}{
+		{[]string{}, streams.BackendFile},
+		{[]string{"-streams-backend=memory"}, streams.BackendMemory},
+	}
+	for i, tt := range tests {
+		cfg := NewConfig()
+		if err := cfg.Parse(tt.args); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if g := cfg.streamsBackend.String(); g != tt.wbackend {
+			t.Errorf("#%d: streamsBackend = %s, want %s", i, g, tt.wbackend)
+		}
+	}
+}
+
+func TestConfigStreamsLimits(t *testing.T) {
+	tests := []struct {
+		args []string
+
+		wmaxEntry, wquota, wtotalQuota uint64
+	}{
+		{[]string{}, 1024 * 1024, 0, 0},
+		{
+			[]string{"-streams-max-entry-bytes=0", "-streams-quota-bytes=1000", "-streams-total-quota-bytes=5000"},
+			0, 1000, 5000,
+		},
+	}
+	for i, tt := range tests {
+		cfg := NewConfig()
+		if err := cfg.Parse(tt.args); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if cfg.streamsMaxEntryBytes != tt.wmaxEntry {
+			t.Errorf("#%d: streamsMaxEntryBytes = %d, want %d", i, cfg.streamsMaxEntryBytes, tt.wmaxEntry)
+		}
+		if cfg.streamsQuotaBytes != tt.wquota {
+			t.Errorf("#%d: streamsQuotaBytes = %d, want %d", i, cfg.streamsQuotaBytes, tt.wquota)
+		}
+		if cfg.streamsTotalQuotaBytes != tt.wtotalQuota {
+			t.Errorf("#%d: streamsTotalQuotaBytes = %d, want %d", i, cfg.streamsTotalQuotaBytes, tt.wtotalQuota)
+		}
+	}
+}
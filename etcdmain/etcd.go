@@ -175,6 +175,13 @@ func startEtcd(cfg *config) (<-chan struct{}, error) {
 		Transport:       pt,
 		TickMs:          cfg.TickMs,
 		ElectionTicks:   cfg.electionTicks(),
+		StreamsBackend:  cfg.streamsBackend.String(),
+		StreamsSync:     cfg.streamsSync(),
+		StreamsMaxOpen:  int(cfg.streamsMaxOpen),
+
+		StreamsMaxEntryBytes:   int64(cfg.streamsMaxEntryBytes),
+		StreamsQuotaBytes:      int64(cfg.streamsQuotaBytes),
+		StreamsTotalQuotaBytes: int64(cfg.streamsTotalQuotaBytes),
 	}
 	var s *etcdserver.EtcdServer
 	s, err = etcdserver.NewServer(srvcfg)
@@ -67,6 +67,24 @@ clustering flags:
 		dns srv domain used to bootstrap the cluster.
 
 
+streams flags:
+
+	--streams-backend 'file'
+		where streams are stored ('file' or 'memory').
+	--streams-fsync 'append'
+		when appends to streams are synced to disk ('append', 'interval' or 'none').
+	--streams-fsync-interval '100'
+		time (in milliseconds) within which appends are synced when --streams-fsync is 'interval'.
+	--streams-max-open '1024'
+		maximum number of streams whose files are kept open (0 is unlimited).
+	--streams-max-entry-bytes '1048576'
+		maximum size in bytes of an entry appended to a stream (0 is unlimited).
+	--streams-quota-bytes '0'
+		maximum number of bytes retained by a single stream (0 is unlimited).
+	--streams-total-quota-bytes '0'
+		maximum number of bytes retained by all the streams (0 is unlimited).
+
+
 proxy flags:
 
 	--proxy 'off'
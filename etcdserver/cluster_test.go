@@ -95,7 +95,7 @@ func TestClusterFromStore(t *testing.T) {
 	}
 	for i, tt := range tests {
 		hc := newTestCluster(nil)
-		hc.SetStore(store.New())
+		hc.SetStore(store.New(""))
 		hc.SetTransport(&nopTransporter{})
 		for j, m := range tt.mems {
 			hc.AddMember(m, uint64(j))
@@ -357,7 +357,7 @@ func TestClusterValidateAndAssignIDs(t *testing.T) {
 
 func TestClusterValidateConfigurationChange(t *testing.T) {
 	cl := newCluster("")
-	cl.SetStore(store.New())
+	cl.SetStore(store.New(""))
 	cl.SetTransport(&nopTransporter{})
 	for i := 1; i <= 4; i++ {
 		attr := RaftAttributes{PeerURLs: []string{fmt.Sprintf("http://127.0.0.1:%d", i)}}
@@ -24,6 +24,8 @@ import (
 	"github.com/coreos/etcd/pkg/netutil"
 	"github.com/coreos/etcd/pkg/types"
 	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/store"
+	"github.com/coreos/etcd/store/streams"
 )
 
 // ServerConfig holds the configuration of etcd as taken from the command line or discovery.
@@ -44,6 +46,24 @@ type ServerConfig struct {
 
 	TickMs        uint
 	ElectionTicks int
+
+	// StreamsBackend names the backend storing the streams, the file
+	// backend if empty.
+	StreamsBackend string
+	// StreamsSync is the durability policy of the appends to streams.
+	StreamsSync streams.SyncPolicy
+	// StreamsMaxOpen is the number of streams whose files are kept open.
+	// Zero places no limit.
+	StreamsMaxOpen int
+	// StreamsMaxEntryBytes is the size of the largest entry which can be
+	// appended to a stream, a stored record beyond it being taken as
+	// corrupt. Zero places no limit.
+	StreamsMaxEntryBytes int64
+	// StreamsQuotaBytes and StreamsTotalQuotaBytes bound the bytes retained
+	// by a single stream and by all the streams, appends beyond them being
+	// rejected. Zero places no limit.
+	StreamsQuotaBytes      int64
+	StreamsTotalQuotaBytes int64
 }
 
 // VerifyBootstrapConfig sanity-checks the initial config for bootstrap case
@@ -112,6 +132,33 @@ func (c *ServerConfig) SnapDir() string { return path.Join(c.MemberDir(), "snap"
 
 func (c *ServerConfig) StreamsDir() string { return path.Join(c.MemberDir(), "streams") }
 
+func (c *ServerConfig) streamsBackend() string {
+	if c.StreamsBackend == "" {
+		return streams.BackendFile
+	}
+	return c.StreamsBackend
+}
+
+// streamsConfig returns the configuration of the streams of the store. The
+// sync policy and the open files only apply to the file backend.
+func (c *ServerConfig) streamsConfig() (store.StreamsConfig, error) {
+	cfg := store.StreamsConfig{
+		Sync:            c.StreamsSync,
+		MaxOpen:         c.StreamsMaxOpen,
+		MaxEntryBytes:   c.StreamsMaxEntryBytes,
+		QuotaBytes:      c.StreamsQuotaBytes,
+		TotalQuotaBytes: c.StreamsTotalQuotaBytes,
+	}
+	switch c.streamsBackend() {
+	case streams.BackendFile:
+	case streams.BackendMemory:
+		cfg.Backend = streams.NewMemoryBackend(c.StreamsMaxEntryBytes)
+	default:
+		return cfg, fmt.Errorf("unknown streams backend %q", c.StreamsBackend)
+	}
+	return cfg, nil
+}
+
 func (c *ServerConfig) ShouldDiscover() bool { return c.DiscoveryURL != "" }
 
 func (c *ServerConfig) PrintWithInitial() { c.print(true) }
@@ -128,6 +175,12 @@ func (c *ServerConfig) print(initial bool) {
 	log.Printf("etcdserver: heartbeat = %dms", c.TickMs)
 	log.Printf("etcdserver: election = %dms", c.ElectionTicks*int(c.TickMs))
 	log.Printf("etcdserver: snapshot count = %d", c.SnapCount)
+	log.Printf("etcdserver: streams backend = %s", c.streamsBackend())
+	log.Printf("etcdserver: streams fsync = %v", c.StreamsSync)
+	log.Printf("etcdserver: streams max open = %d", c.StreamsMaxOpen)
+	log.Printf("etcdserver: streams max entry bytes = %d", c.StreamsMaxEntryBytes)
+	log.Printf("etcdserver: streams quota bytes = %d", c.StreamsQuotaBytes)
+	log.Printf("etcdserver: streams total quota bytes = %d", c.StreamsTotalQuotaBytes)
 	if len(c.DiscoveryURL) != 0 {
 		log.Printf("etcdserver: discovery URL= %s", c.DiscoveryURL)
 		if len(c.DiscoveryProxy) != 0 {
@@ -19,6 +19,7 @@ import (
 	"testing"
 
 	"github.com/coreos/etcd/pkg/types"
+	"github.com/coreos/etcd/store/streams"
 )
 
 func mustNewURLs(t *testing.T, urls []string) []url.URL {
@@ -197,3 +198,42 @@ func TestShouldDiscover(t *testing.T) {
 		}
 	}
 }
+
+func TestStreamsConfig(t *testing.T) {
+	tests := []struct {
+		backend string
+
+		wmemory bool
+		werr    bool
+	}{
+		{"", false, false},
+		{"file", false, false},
+		{"memory", true, false},
+		{"tape", false, true},
+	}
+	for i, tt := range tests {
+		cfg := ServerConfig{
+			StreamsBackend:         tt.backend,
+			StreamsMaxOpen:         8,
+			StreamsMaxEntryBytes:   16,
+			StreamsQuotaBytes:      32,
+			StreamsTotalQuotaBytes: 64,
+		}
+		scfg, err := cfg.streamsConfig()
+		if (err != nil) != tt.werr {
+			t.Errorf("#%d: err = %v, want error %t", i, err, tt.werr)
+		}
+		if _, ok := scfg.Backend.(*streams.MemoryBackend); ok != tt.wmemory {
+			t.Errorf("#%d: backend = %T, want memory %t", i, scfg.Backend, tt.wmemory)
+		}
+		if scfg.MaxOpen != 8 {
+			t.Errorf("#%d: max open = %d, want 8", i, scfg.MaxOpen)
+		}
+		if scfg.MaxEntryBytes != 16 {
+			t.Errorf("#%d: max entry bytes = %d, want 16", i, scfg.MaxEntryBytes)
+		}
+		if scfg.QuotaBytes != 32 || scfg.TotalQuotaBytes != 64 {
+			t.Errorf("#%d: quotas = %d, %d, want 32, 64", i, scfg.QuotaBytes, scfg.TotalQuotaBytes)
+		}
+	}
+}
@@ -15,10 +15,13 @@
 package etcdhttp
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"expvar"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -42,6 +45,7 @@ import (
 	"github.com/coreos/etcd/pkg/types"
 	"github.com/coreos/etcd/raft"
 	"github.com/coreos/etcd/store"
+	"github.com/coreos/etcd/store/streams"
 	"github.com/coreos/etcd/version"
 )
 
@@ -59,6 +63,10 @@ const (
 	versionPath              = "/version"
 )
 
+// streamsBatchBytes bounds the body of a batch append to a stream, unless
+// a single entry of the maximum size takes more.
+var streamsBatchBytes int64 = 4 * 1024 * 1024
+
 // NewClientHandler generates a muxed http.Handler with the given parameters to serve etcd client requests.
 func NewClientHandler(server *etcdserver.EtcdServer) http.Handler {
 	sec := security.NewStore(server, defaultServerTimeout)
@@ -72,11 +80,12 @@ func NewClientHandler(server *etcdserver.EtcdServer) http.Handler {
 	}
 
 	streamsHandler := &streamsHandler {
-		sec:         sec,
-		server:      server,
-		clusterInfo: server.Cluster,
-		timer:       server,
-		timeout:     defaultServerTimeout,
+		sec:           sec,
+		server:        server,
+		clusterInfo:   server.Cluster,
+		timer:         server,
+		timeout:       defaultServerTimeout,
+		maxEntryBytes: server.StreamsMaxEntryBytes(),
 	}
 
 	websocketStreamsHandler := &websocketStreamsHandler {
@@ -111,7 +120,8 @@ func NewClientHandler(server *etcdserver.EtcdServer) http.Handler {
 	mux.Handle(keysPrefix, kh)
 	mux.Handle(keysPrefix+"/", kh)
 	mux.Handle(streamsPrefix, streamsHandler)
-	mux.Handle(wsStreamsPrefix + "/", websocketStreamsHandler.server)
+	mux.Handle(wsStreamsPrefix, websocketStreamsHandler)
+	mux.Handle(wsStreamsPrefix + "/", websocketStreamsHandler)
 	mux.Handle(streamsPrefix+"/", streamsHandler)
 	mux.HandleFunc(statsPrefix+"/store", sh.serveStore)
 	mux.HandleFunc(statsPrefix+"/self", sh.serveSelf)
@@ -169,7 +179,7 @@ func (h *keysHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case resp.Watcher != nil:
 		ctx, cancel := context.WithTimeout(context.Background(), defaultWatchTimeout)
 		defer cancel()
-		handleKeyWatch(ctx, w, resp.Watcher, rr.Stream, h.timer)
+		handleWatch(ctx, w, resp.Watcher, etcdserver.StoreKeysPrefix, rr.Stream, h.timer)
 	default:
 		writeError(w, errors.New("received response with no Event/Watcher!"))
 	}
@@ -181,6 +191,9 @@ type streamsHandler struct {
 	clusterInfo etcdserver.ClusterInfo
 	timer       etcdserver.RaftTimer
 	timeout     time.Duration
+	// maxEntryBytes is the size of the largest entry which can be
+	// appended, if non-zero.
+	maxEntryBytes int64
 }
 
 type websocketStreamsHandler struct {
@@ -190,6 +203,12 @@ type websocketStreamsHandler struct {
 
 func (h *websocketStreamsHandler) init() {
 	h.server.Handler  = func (ws *websocket.Conn) {
+		if streamIdFromPath(ws.Config().Location.Path[len(wsStreamsPrefix):]) == "" {
+			// the streams root multiplexes the tails of many streams
+			access := h.muxAccess(ws.Request())
+			newStreamsMuxSession(&websocketMuxConn{ws}, h.streamsHandler.server, access).serve()
+			return
+		}
 		session := &websocketStreamsSession{}
 		session.ws = ws
 		session.streamsHandler = h.streamsHandler
@@ -197,6 +216,48 @@ func (h *websocketStreamsHandler) init() {
 	}
 }
 
+// ServeHTTP checks that the caller may tail the stream before handing the
+// request to the websocket server. The access of a multiplexed session on
+// the streams root is checked as each stream is subscribed to.
+func (h *websocketStreamsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.hasAccess(r) {
+		writeNoAuth(w)
+		return
+	}
+	h.server.ServeHTTP(w, r)
+}
+
+// muxAccess returns the check of the subscriptions of a multiplexed session
+// opened by r. The user is authenticated once, by the handshake, as a tail
+// token expires long before the session ends; the user and its roles are
+// looked up again as each stream is subscribed to.
+func (h *websocketStreamsHandler) muxAccess(r *http.Request) func(id string) bool {
+	sec := h.streamsHandler.sec
+	user, ok := streamUser(sec, r, security.StreamTail)
+	return func(id string) bool {
+		if sec == nil || !sec.SecurityEnabled() {
+			return true
+		}
+		if !ok {
+			return false
+		}
+		u, err := sec.GetUser(user.User)
+		if err != nil {
+			log.Printf("security: No such user: %s.", user.User)
+			return false
+		}
+		return userHasStreamAccess(sec, u, id, security.StreamTail)
+	}
+}
+
+// hasAccess checks that the caller may open the websocket of r, which
+// tails a single stream or multiplexes the tails of many on the streams
+// root.
+func (h *websocketStreamsHandler) hasAccess(r *http.Request) bool {
+	id := streamIdFromPath(r.URL.Path[len(wsStreamsPrefix):])
+	return id == "" || hasStreamAccess(h.streamsHandler.sec, r, id, security.StreamTail)
+}
+
 type websocketStreamsSession struct {
 	ws *websocket.Conn
 	streamsHandler *streamsHandler
@@ -209,8 +270,10 @@ func (h *websocketStreamsSession) End(err error) {
 	}
 }
 
+// GotValue sends the entry as a JSON message carrying its offset, in the
+// same form as the entries of a tail over HTTP.
 func (h *websocketStreamsSession) GotValue(pos int64, value []byte) error {
-	err := websocket.Message.Send(h.ws, value)
+	err := websocket.JSON.Send(h.ws, streamEntry{Offset: strconv.FormatInt(pos, 16), Value: string(value)})
 	if err != nil {
 		log.Print("Error sending message on websocket: ", err)
 		return err
@@ -218,15 +281,26 @@ func (h *websocketStreamsSession) GotValue(pos int64, value []byte) error {
 	return nil
 }
 
+// Keepalive sends a heartbeat message, which carries the tail of the
+// stream rather than an entry.
+func (h *websocketStreamsSession) Keepalive(tail int64) error {
+	return websocket.JSON.Send(h.ws, streamHeartbeat{Tail: strconv.FormatInt(tail, 16)})
+}
+
 func (s *websocketStreamsSession) ServeWebsocket() {
 	u := s.ws.Config().Location
 
-	// TODO: Security?
-
+	// Access to the stream was checked by websocketStreamsHandler before
+	// the handshake.
 	path := u.Path
 
 	if !strings.HasPrefix(path, wsStreamsPrefix) {
-		log.Print("Invalid prefix ", path)
+		s.ws.Close()
+		return
+	}
+
+	options, err := parseStreamsTailOptions(u.Query())
+	if err != nil {
 		s.ws.Close()
 		return
 	}
@@ -238,8 +312,17 @@ func (s *websocketStreamsSession) ServeWebsocket() {
 		StoreId:   etcdserver.StoreStreamsId,
 	}
 
-	log.Print("RR", rr);
-	s.streamsHandler.server.DoStream(rr, s)
+	// The client sends nothing, so reads only end once it goes away, which
+	// cancels the tail.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		io.Copy(ioutil.Discard, s.ws)
+		cancel()
+	}()
+	defer s.ws.Close()
+
+	s.streamsHandler.server.DoStream(ctx, rr, options, s)
 }
 
 func (h *streamsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -252,17 +335,24 @@ func (h *streamsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
 	defer cancel()
 
-	rr, err := parseStreamsRequest(r, clockwork.NewRealClock())
+	rr, err := parseStreamsRequest(r, clockwork.NewRealClock(), h.maxEntryBytes)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
+	// A watch is recursive, while a tail is of a single stream.
+	tail := rr.Method == "GET" && rr.Wait && !rr.Recursive
 	// The path must be valid at this point (we've parsed the request successfully).
-	if !hasKeyPrefixAccess(h.sec, r, r.URL.Path[len(streamsPrefix):]) {
+	if !hasStreamsRequestAccess(h.sec, r, r.URL.Path[len(streamsPrefix):], rr.Wait) {
 		writeNoAuth(w)
 		return
 	}
 
+	if tail {
+		handleStreamsTail(w, r, h.server, rr, h.timer)
+		return
+	}
+
 	resp, err := h.server.Do(ctx, rr)
 	if err != nil {
 		err = trimErrorPrefix(err, etcdserver.StoreStreamsPrefix)
@@ -270,16 +360,40 @@ func (h *streamsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	raw := strings.Contains(r.Header.Get("Accept"), "application/octet-stream")
 	switch {
+	case resp.Entry != nil && raw:
+		if err := writeStreamsEntry(w, resp.Entry, h.timer); err != nil {
+			log.Printf("error writing entry: %v", err)
+		}
+	case resp.Range != nil:
+		if err := writeStreamsRange(w, resp.Range, raw, h.timer); err != nil {
+			log.Printf("error writing range: %v", err)
+		}
 	case resp.Event != nil:
 		if err := writeStreamsEvent(w, resp.Event, h.timer); err != nil {
 			// Should never be reached
 			log.Printf("error writing event: %v", err)
 		}
-//	case resp.Watcher != nil:
-//		ctx, cancel := context.WithTimeout(context.Background(), defaultWatchTimeout)
-//		defer cancel()
-//		handleStreamsWatch(ctx, w, resp.Watcher, rr.Stream, h.timer)
+	case resp.Streams != nil:
+		if err := writeStreamsList(w, resp.Streams, h.timer); err != nil {
+			// Should never be reached
+			log.Printf("error writing streams: %v", err)
+		}
+	case resp.Cursors != nil:
+		if err := writeStreamsCursors(w, rr.Path, resp.Cursors, h.timer); err != nil {
+			// Should never be reached
+			log.Printf("error writing cursors: %v", err)
+		}
+	case resp.Hashes != nil:
+		if err := writeStreamsHashes(w, resp.Hashes, h.timer); err != nil {
+			// Should never be reached
+			log.Printf("error writing hashes: %v", err)
+		}
+	case resp.Watcher != nil:
+		ctx, cancel := context.WithTimeout(context.Background(), defaultWatchTimeout)
+		defer cancel()
+		handleWatch(ctx, w, resp.Watcher, etcdserver.StoreStreamsPrefix, rr.Stream, h.timer)
 	default:
 		writeError(w, errors.New("received response with no Event/Watcher!"))
 	}
@@ -642,7 +756,8 @@ func parseKeyRequest(r *http.Request, clock clockwork.Clock) (etcdserverpb.Reque
 // parseStreamsRequest converts a received http.Request on keysPrefix to
 // a server Request, performing validation of supplied fields as appropriate.
 // If any validation fails, an empty Request and non-nil error is returned.
-func parseStreamsRequest(r *http.Request, clock clockwork.Clock) (etcdserverpb.Request, error) {
+// An appended entry larger than maxEntryBytes, if non-zero, is rejected.
+func parseStreamsRequest(r *http.Request, clock clockwork.Clock, maxEntryBytes int64) (etcdserverpb.Request, error) {
 	emptyReq := etcdserverpb.Request{}
 
 	params, err := url.ParseQuery(r.URL.RawQuery)
@@ -663,11 +778,64 @@ func parseStreamsRequest(r *http.Request, clock clockwork.Clock) (etcdserverpb.R
 
 	quorum := params.Get("quorum") == "1"
 
+	wait, err := getBool(params, "wait")
+	if err != nil {
+		return emptyReq, etcdErr.NewRequestError(
+			etcdErr.EcodeInvalidField,
+			`invalid value for "wait"`,
+		)
+	}
+
+	// wait on the streams root or on a stream, rather than on an entry or
+	// a cursor, and without a tail option, watches the events of the
+	// streams as a recursive watch of keys does. The events of the streams
+	// are indexed by the raft index of the entry applying them, so that
+	// waitIndex, and the modified and created indexes of the events, are
+	// raft indexes rather than indexes of the key space.
+	var watch, stream bool
+	var wIdx uint64
+	if r.Method == "GET" && wait && !strings.Contains(strings.Trim(r.URL.Path[len(streamsPrefix):], "/"), "/") {
+		options, err := parseStreamsTailOptions(params)
+		if err != nil {
+			return emptyReq, err
+		}
+		watch = !options.FromTail && options.Back == 0
+	}
+	if watch {
+		if wIdx, err = getUint64(params, "waitIndex"); err != nil {
+			return emptyReq, etcdErr.NewRequestError(
+				etcdErr.EcodeIndexNaN,
+				`invalid value for "waitIndex"`,
+			)
+		}
+		if stream, err = getBool(params, "stream"); err != nil {
+			return emptyReq, etcdErr.NewRequestError(
+				etcdErr.EcodeInvalidField,
+				`invalid value for "stream"`,
+			)
+		}
+	}
+
 	var value []byte
+	var values [][]byte
+	var prevValue string
 
 	if r.Method == "POST" {
 		if r.Body != nil {
-			value, err = ioutil.ReadAll(r.Body)
+			// the body is bounded as it is read, rather than checked once
+			// buffered
+			body := r.Body
+			limit := maxStreamsBodyBytes(params.Get("batch") != "", maxEntryBytes)
+			if limit > 0 {
+				body = http.MaxBytesReader(nil, r.Body, limit)
+			}
+			value, err = ioutil.ReadAll(body)
+			if err != nil && limit > 0 && int64(len(value)) >= limit {
+				return emptyReq, etcdErr.NewRequestError(
+					etcdErr.EcodeEntryTooLarge,
+					fmt.Sprintf("request body [> %d]", limit),
+				)
+			}
 			if err != nil {
 				return emptyReq, etcdErr.NewRequestError(
 					etcdErr.EcodeInvalidField,
@@ -681,19 +849,276 @@ func parseStreamsRequest(r *http.Request, clock clockwork.Clock) (etcdserverpb.R
 				"request body is required with POST method",
 			)
 		}
+		// expectedTail makes the append conditional on the tail of the
+		// stream, and is carried as PrevValue.
+		if prevValue = params.Get("expectedTail"); prevValue != "" {
+			if tail, err := strconv.ParseInt(prevValue, 16, 64); err != nil || tail < 0 {
+				return emptyReq, etcdErr.NewRequestError(
+					etcdErr.EcodeInvalidField,
+					`invalid value for "expectedTail"`,
+				)
+			}
+		}
+		if framing := params.Get("batch"); framing != "" {
+			if values, err = splitStreamsBatch(framing, value); err != nil {
+				return emptyReq, err
+			}
+			value = nil
+		}
+		entries := values
+		if entries == nil {
+			entries = [][]byte{value}
+		}
+		for i, v := range entries {
+			if maxEntryBytes > 0 && int64(len(v)) > maxEntryBytes {
+				return emptyReq, etcdErr.NewRequestError(
+					etcdErr.EcodeEntryTooLarge,
+					fmt.Sprintf("entry %d [%d > %d]", i, len(v), maxEntryBytes),
+				)
+			}
+		}
+	}
+
+	// GET with "from" reads a range of entries from that offset, and the
+	// options of the range are carried as JSON.
+	if r.Method == "GET" && !wait && params.Get("from") != "" {
+		from, err := strconv.ParseInt(params.Get("from"), 16, 64)
+		if err != nil || from < 0 {
+			return emptyReq, etcdErr.NewRequestError(
+				etcdErr.EcodeInvalidField,
+				`invalid value for "from"`,
+			)
+		}
+		limit, err := getUint64(params, "limit")
+		if err != nil {
+			return emptyReq, etcdErr.NewRequestError(
+				etcdErr.EcodeInvalidField,
+				`invalid value for "limit"`,
+			)
+		}
+		maxBytes, err := getUint64(params, "maxBytes")
+		if err != nil {
+			return emptyReq, etcdErr.NewRequestError(
+				etcdErr.EcodeInvalidField,
+				`invalid value for "maxBytes"`,
+			)
+		}
+		value, err = json.Marshal(streams.RangeOptions{
+			From:     from,
+			Limit:    int(limit),
+			MaxBytes: int64(maxBytes),
+		})
+		if err != nil {
+			return emptyReq, err
+		}
+	}
+
+	// GET with "hash=true" hashes the streams root or a stream as of the
+	// raft index given by "index", or the latest index applied, which is
+	// carried as Since.
+	method := r.Method
+	hash, err := getBool(params, "hash")
+	if err != nil {
+		return emptyReq, etcdErr.NewRequestError(
+			etcdErr.EcodeInvalidField,
+			`invalid value for "hash"`,
+		)
+	}
+	if r.Method == "GET" && hash {
+		if wait || strings.Contains(strings.Trim(r.URL.Path[len(streamsPrefix):], "/"), "/") {
+			return emptyReq, etcdErr.NewRequestError(
+				etcdErr.EcodeInvalidField,
+				`"hash" applies to the streams root or to a stream`,
+			)
+		}
+		if wIdx, err = getUint64(params, "index"); err != nil {
+			return emptyReq, etcdErr.NewRequestError(
+				etcdErr.EcodeIndexNaN,
+				`invalid value for "index"`,
+			)
+		}
+		method = "HASH"
+	}
+
+	// PUT on a consumer cursor commits the given offset.
+	_, _, cursor := store.SplitStreamCursorPath(p)
+	if r.Method == "PUT" && cursor {
+		offset := params.Get("offset")
+		if n, err := strconv.ParseInt(offset, 16, 64); err != nil || n < 0 {
+			return emptyReq, etcdErr.NewRequestError(
+				etcdErr.EcodeInvalidField,
+				`invalid value for "offset"`,
+			)
+		}
+		value = []byte(offset)
+	}
+
+	// PUT sets the retention policy of a stream, or of all streams on the
+	// streams root.
+	if r.Method == "PUT" && !cursor {
+		var maxBytes, maxAge uint64
+		if maxBytes, err = getUint64(params, "maxBytes"); err != nil {
+			return emptyReq, etcdErr.NewRequestError(
+				etcdErr.EcodeInvalidField,
+				`invalid value for "maxBytes"`,
+			)
+		}
+		if maxAge, err = getUint64(params, "maxAge"); err != nil {
+			return emptyReq, etcdErr.NewRequestError(
+				etcdErr.EcodeInvalidField,
+				`invalid value for "maxAge"`,
+			)
+		}
+		value, err = json.Marshal(streams.RetentionPolicy{
+			MaxBytes: int64(maxBytes),
+			MaxAge:   int64(maxAge),
+		})
+		if err != nil {
+			return emptyReq, err
+		}
+	}
+
+	// DELETE with an offset trims the entries before it, rather than
+	// deleting the stream.
+	if r.Method == "DELETE" {
+		if before := params.Get("before"); before != "" {
+			if _, err = strconv.ParseInt(before, 16, 64); err != nil {
+				return emptyReq, etcdErr.NewRequestError(
+					etcdErr.EcodeInvalidField,
+					`invalid value for "before"`,
+				)
+			}
+			value = []byte(before)
+		}
 	}
 
 	rr := etcdserverpb.Request{
-		Method:    r.Method,
+		Method:    method,
 		Path:      p,
 		Val:       string(value),
+		Vals:      values,
+		PrevValue: prevValue,
 		Quorum:    quorum,
+		Wait:      wait,
+		Recursive: watch,
+		Since:     wIdx,
+		Stream:    stream,
 		StoreId:   etcdserver.StoreStreamsId,
 	}
 
 	return rr, nil
 }
 
+// parseStreamsTailOptions converts the query parameters of a tail to its
+// options: "count" stops the tail after that many entries, "fromTail=true"
+// starts it at the current tail of the stream and "back=N" N entries before
+// it, and "keepalive" is the idle interval in seconds between heartbeats.
+func parseStreamsTailOptions(params url.Values) (streams.TailOptions, error) {
+	var options streams.TailOptions
+
+	count, err := getUint64(params, "count")
+	if err != nil {
+		return options, etcdErr.NewRequestError(
+			etcdErr.EcodeInvalidField,
+			`invalid value for "count"`,
+		)
+	}
+	if options.FromTail, err = getBool(params, "fromTail"); err != nil {
+		return options, etcdErr.NewRequestError(
+			etcdErr.EcodeInvalidField,
+			`invalid value for "fromTail"`,
+		)
+	}
+	back, err := getUint64(params, "back")
+	if err != nil {
+		return options, etcdErr.NewRequestError(
+			etcdErr.EcodeInvalidField,
+			`invalid value for "back"`,
+		)
+	}
+	if options.FromTail && back > 0 {
+		return options, etcdErr.NewRequestError(
+			etcdErr.EcodeInvalidField,
+			`"fromTail" and "back" are mutually exclusive`,
+		)
+	}
+	keepalive, err := getUint64(params, "keepalive")
+	if err != nil {
+		return options, etcdErr.NewRequestError(
+			etcdErr.EcodeInvalidField,
+			`invalid value for "keepalive"`,
+		)
+	}
+
+	options.Count = int(count)
+	options.Back = int64(back)
+	options.Keepalive = time.Duration(keepalive) * time.Second
+	return options, nil
+}
+
+// maxStreamsBodyBytes returns the size of the largest body of an append:
+// an entry of the maximum size, or for a batch the larger of
+// streamsBatchBytes and such an entry with its length. Zero places no
+// limit, as there is no maximum entry size.
+func maxStreamsBodyBytes(batch bool, maxEntryBytes int64) int64 {
+	if maxEntryBytes <= 0 {
+		return 0
+	}
+	if !batch {
+		return maxEntryBytes
+	}
+	if n := maxEntryBytes + 4; n > streamsBatchBytes {
+		return n
+	}
+	return streamsBatchBytes
+}
+
+// splitStreamsBatch splits the body of a batch append into its entries.
+// With "lines" framing each line of the body is an entry, and with
+// "length" framing each entry is preceded by its length as a 4 byte
+// little endian integer.
+func splitStreamsBatch(framing string, body []byte) ([][]byte, error) {
+	var values [][]byte
+	switch framing {
+	case "lines":
+		body = bytes.TrimSuffix(body, []byte("\n"))
+		if len(body) > 0 {
+			values = bytes.Split(body, []byte("\n"))
+		}
+	case "length":
+		for len(body) > 0 {
+			if len(body) < 4 {
+				return nil, etcdErr.NewRequestError(
+					etcdErr.EcodeInvalidField,
+					"truncated batch entry length",
+				)
+			}
+			n := binary.LittleEndian.Uint32(body[:4])
+			body = body[4:]
+			if uint64(n) > uint64(len(body)) {
+				return nil, etcdErr.NewRequestError(
+					etcdErr.EcodeInvalidField,
+					"truncated batch entry",
+				)
+			}
+			values = append(values, body[:n])
+			body = body[n:]
+		}
+	default:
+		return nil, etcdErr.NewRequestError(
+			etcdErr.EcodeInvalidField,
+			`invalid value for "batch"`,
+		)
+	}
+	if len(values) == 0 {
+		return nil, etcdErr.NewRequestError(
+			etcdErr.EcodeInvalidField,
+			"batch holds no entries",
+		)
+	}
+	return values, nil
+}
+
 // writeKeyEvent trims the prefix of key path in a single Event under
 // StoreKeysPrefix, serializes it and writes the resulting JSON to the given
 // ResponseWriter, along with the appropriate headers.
@@ -734,7 +1159,270 @@ func writeStreamsEvent(w http.ResponseWriter, ev *store.Event, rt etcdserver.Raf
 	return json.NewEncoder(w).Encode(ev)
 }
 
-func handleKeyWatch(ctx context.Context, w http.ResponseWriter, wa store.Watcher, stream bool, rt etcdserver.RaftTimer) {
+// writeStreamsEntry writes the raw value of a stream entry to the given
+// ResponseWriter. The offsets of the entry and of the next entry, and the
+// CRC-32C of the value, are written in hexadecimal as headers.
+func writeStreamsEntry(w http.ResponseWriter, entry *streams.Entry, rt etcdserver.RaftTimer) error {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry.Value)))
+	w.Header().Set("X-Stream-Offset", strconv.FormatInt(entry.Offset, 16))
+	w.Header().Set("X-Stream-Next-Offset", strconv.FormatInt(entry.Next, 16))
+	w.Header().Set("X-Stream-Crc32c", fmt.Sprintf("%08x", entry.Checksum))
+	w.Header().Set("X-Raft-Index", fmt.Sprint(rt.Index()))
+	w.Header().Set("X-Raft-Term", fmt.Sprint(rt.Term()))
+	_, err := w.Write(entry.Value)
+	return err
+}
+
+// writeStreamsRange writes the entries of a range read to the given
+// ResponseWriter, along with the offset to continue reading from. The raw
+// form is the entries as they are stored, each preceded by the header
+// holding its checksum and length, with the offsets of the first entry and
+// of the next one as headers.
+func writeStreamsRange(w http.ResponseWriter, rng *streams.Range, raw bool, rt etcdserver.RaftTimer) error {
+	w.Header().Set("X-Raft-Index", fmt.Sprint(rt.Index()))
+	w.Header().Set("X-Raft-Term", fmt.Sprint(rt.Term()))
+
+	if raw {
+		offset := rng.Next
+		var b []byte
+		for i, entry := range rng.Entries {
+			if i == 0 {
+				offset = entry.Offset
+			}
+			b = entry.AppendFramed(b)
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Header().Set("X-Stream-Offset", strconv.FormatInt(offset, 16))
+		w.Header().Set("X-Stream-Next-Offset", strconv.FormatInt(rng.Next, 16))
+		_, err := w.Write(b)
+		return err
+	}
+
+	var rangeCollection struct {
+		Entries []streamEntry `json:"entries"`
+		Next    string        `json:"next"`
+	}
+	rangeCollection.Entries = make([]streamEntry, len(rng.Entries))
+	for i, entry := range rng.Entries {
+		rangeCollection.Entries[i] = streamEntry{
+			Offset: strconv.FormatInt(entry.Offset, 16),
+			Value:  string(entry.Value),
+		}
+	}
+	rangeCollection.Next = strconv.FormatInt(rng.Next, 16)
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(rangeCollection)
+}
+
+// writeStreamsList serializes the given stream information as JSON and
+// writes it to the given ResponseWriter, along with the appropriate headers.
+func writeStreamsList(w http.ResponseWriter, infos []*store.StreamInfo, rt etcdserver.RaftTimer) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Raft-Index", fmt.Sprint(rt.Index()))
+	w.Header().Set("X-Raft-Term", fmt.Sprint(rt.Term()))
+
+	var streamsCollection struct {
+		Streams []*store.StreamInfo `json:"streams"`
+	}
+	streamsCollection.Streams = infos
+	return json.NewEncoder(w).Encode(streamsCollection)
+}
+
+// writeStreamsHashes serializes the given hashes as JSON and writes them to
+// the given ResponseWriter.
+func writeStreamsHashes(w http.ResponseWriter, hs *store.StreamHashes, rt etcdserver.RaftTimer) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Raft-Index", fmt.Sprint(rt.Index()))
+	w.Header().Set("X-Raft-Term", fmt.Sprint(rt.Term()))
+	return json.NewEncoder(w).Encode(hs)
+}
+
+// streamEntry is a single entry of a stream tail over HTTP.
+type streamEntry struct {
+	Offset string `json:"offset"`
+	Value  string `json:"value"`
+}
+
+// streamHeartbeat is sent on an idle websocket tail in place of an entry.
+type streamHeartbeat struct {
+	Tail string `json:"tail"`
+}
+
+// writeStreamsCursors serializes the given cursors as JSON and writes them
+// to the given ResponseWriter: a single cursor if p names one, or the
+// collection of the cursors of a stream.
+func writeStreamsCursors(w http.ResponseWriter, p string, infos []*store.CursorInfo, rt etcdserver.RaftTimer) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Raft-Index", fmt.Sprint(rt.Index()))
+	w.Header().Set("X-Raft-Term", fmt.Sprint(rt.Term()))
+
+	if _, name, _ := store.SplitStreamCursorPath(p); name != "" && len(infos) == 1 {
+		return json.NewEncoder(w).Encode(infos[0])
+	}
+	var cursorsCollection struct {
+		Cursors []*store.CursorInfo `json:"cursors"`
+	}
+	cursorsCollection.Cursors = infos
+	return json.NewEncoder(w).Encode(cursorsCollection)
+}
+
+// httpStreamsTail is a StreamListener writing the entries of a tail to an
+// HTTP response, either as server-sent events or as a chunked stream of
+// JSON entries. The response header is only written with the first entry,
+// so that a tail which fails to start is answered with an error status.
+type httpStreamsTail struct {
+	w   http.ResponseWriter
+	rt  etcdserver.RaftTimer
+	sse bool
+	// done is closed once the client goes away
+	done <-chan struct{}
+
+	// skip is the offset of an entry the client has already seen, or -1.
+	skip    int64
+	started bool
+	err     error
+}
+
+func (t *httpStreamsTail) GotValue(pos int64, value []byte) error {
+	select {
+	case <-t.done:
+		return errors.New("client closed connection")
+	default:
+	}
+	if pos == t.skip {
+		return nil
+	}
+	if !t.started {
+		t.start()
+	}
+
+	offset := strconv.FormatInt(pos, 16)
+	if t.sse {
+		fmt.Fprintf(t.w, "id: %s\n", offset)
+		for _, line := range strings.Split(string(value), "\n") {
+			fmt.Fprintf(t.w, "data: %s\n", line)
+		}
+		if _, err := fmt.Fprint(t.w, "\n"); err != nil {
+			return err
+		}
+	} else {
+		if err := json.NewEncoder(t.w).Encode(streamEntry{Offset: offset, Value: string(value)}); err != nil {
+			return err
+		}
+	}
+	t.w.(http.Flusher).Flush()
+	return nil
+}
+
+// Keepalive writes a heartbeat to an idle tail: a comment with server-sent
+// events, and an empty line otherwise, which JSON decoders skip.
+func (t *httpStreamsTail) Keepalive(tail int64) error {
+	select {
+	case <-t.done:
+		return errors.New("client closed connection")
+	default:
+	}
+	if !t.started {
+		t.start()
+	}
+
+	var err error
+	if t.sse {
+		_, err = fmt.Fprintf(t.w, ": keepalive %x\n\n", tail)
+	} else {
+		_, err = fmt.Fprint(t.w, "\n")
+	}
+	if err != nil {
+		return err
+	}
+	t.w.(http.Flusher).Flush()
+	return nil
+}
+
+func (t *httpStreamsTail) End(err error) {
+	t.err = err
+}
+
+func (t *httpStreamsTail) start() {
+	t.started = true
+	if t.sse {
+		t.w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		t.w.Header().Set("Content-Type", "application/json")
+	}
+	t.w.Header().Set("X-Raft-Index", fmt.Sprint(t.rt.Index()))
+	t.w.Header().Set("X-Raft-Term", fmt.Sprint(t.rt.Term()))
+	t.w.WriteHeader(http.StatusOK)
+}
+
+// handleStreamsTail serves a GET with wait=true on a stream entry, by
+// tailing the stream from that entry until the client goes away. Server-sent
+// events are written if the client accepts them; the id of each event is
+// the offset of the entry, and a Last-Event-ID sent by a reconnecting client
+// resumes the tail after that entry.
+func handleStreamsTail(w http.ResponseWriter, r *http.Request, server etcdserver.Server, rr etcdserverpb.Request, rt etcdserver.RaftTimer) {
+	options, err := parseStreamsTailOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// the tail is cancelled once the client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if x, ok := w.(http.CloseNotifier); ok {
+		nch := x.CloseNotify()
+		go func() {
+			select {
+			case <-nch:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	t := &httpStreamsTail{
+		w:    w,
+		rt:   rt,
+		sse:  strings.Contains(r.Header.Get("Accept"), "text/event-stream"),
+		done: ctx.Done(),
+		skip: -1,
+	}
+	if id := r.Header.Get("Last-Event-ID"); t.sse && id != "" {
+		if pos, err := strconv.ParseInt(id, 16, 64); err == nil {
+			// resume at the entry itself, even when tailing from a cursor
+			streamId := streamIdFromPath(strings.TrimPrefix(rr.Path, etcdserver.StoreStreamsPrefix))
+			rr.Path = path.Join(etcdserver.StoreStreamsPrefix, streamId, id)
+			t.skip = pos
+			// the resumed tail starts at the entry, which is not counted
+			options.FromTail, options.Back = false, 0
+			if options.Count > 0 {
+				options.Count++
+			}
+		}
+	}
+
+	rr.Method = "TAIL"
+	server.DoStream(ctx, rr, options, t)
+
+	if t.err == nil || ctx.Err() != nil {
+		return
+	}
+	if !t.started {
+		writeError(w, trimErrorPrefix(t.err, etcdserver.StoreStreamsPrefix))
+		return
+	}
+	log.Printf("etcdhttp: stream tail ended: %v", t.err)
+	if t.sse {
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", t.err)
+	}
+}
+
+// handleWatch writes the events of the watcher, trimming the given store
+// prefix from their keys.
+func handleWatch(ctx context.Context, w http.ResponseWriter, wa store.Watcher, prefix string, stream bool, rt etcdserver.RaftTimer) {
 	defer wa.Remove()
 	ech := wa.EventChan()
 	var nch <-chan bool
@@ -766,7 +1454,7 @@ func handleKeyWatch(ctx context.Context, w http.ResponseWriter, wa store.Watcher
 				// send to the client in time. Then we simply end streaming.
 				return
 			}
-			ev = trimEventPrefix(ev, etcdserver.StoreKeysPrefix)
+			ev = trimEventPrefix(ev, prefix)
 			if err := json.NewEncoder(w).Encode(ev); err != nil {
 				// Should never be reached
 				log.Printf("error writing event: %v\n", err)
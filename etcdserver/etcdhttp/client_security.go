@@ -20,11 +20,13 @@ import (
 	"net/http"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/coreos/etcd/etcdserver"
 	"github.com/coreos/etcd/etcdserver/etcdhttp/httptypes"
 	"github.com/coreos/etcd/etcdserver/security"
 	"github.com/coreos/etcd/pkg/netutil"
+	"github.com/coreos/etcd/store"
 )
 
 type securityHandler struct {
@@ -78,14 +80,8 @@ func hasKeyPrefixAccess(sec *security.Store, r *http.Request, key string) bool {
 	if !ok {
 		return false
 	}
-	user, err := sec.GetUser(username)
-	if err != nil {
-		log.Printf("security: No such user: %s.", username)
-		return false
-	}
-	authAsUser := user.CheckPassword(password)
-	if !authAsUser {
-		log.Printf("security: Incorrect password for user: %s.", username)
+	user, ok := checkUser(sec, username, password)
+	if !ok {
 		return false
 	}
 	if user.User == "root" {
@@ -105,6 +101,121 @@ func hasKeyPrefixAccess(sec *security.Store, r *http.Request, key string) bool {
 	return false
 }
 
+// hasStreamsRequestAccess checks access to a request on streamsPrefix for
+// the given path, which tails the stream if tail is set. Reads, appends and
+// tails are checked against the streams permissions of the roles of the
+// user. Consumer cursors are fetched with read access, and committed and
+// deleted with append access, as moving a cursor makes its consumers skip
+// entries. Listing, deleting and trimming streams and setting their retention
+// require root.
+func hasStreamsRequestAccess(sec *security.Store, r *http.Request, p string, tail bool) bool {
+	id := streamIdFromPath(p)
+	_, _, cursor := store.SplitStreamCursorPath(path.Join(etcdserver.StoreStreamsPrefix, p))
+	switch {
+	case id == "":
+		return hasRootAccess(sec, r)
+	case cursor && (r.Method == "PUT" || r.Method == "DELETE"):
+		return hasStreamAccess(sec, r, id, security.StreamAppend)
+	case cursor && !tail:
+		return hasStreamAccess(sec, r, id, security.StreamRead)
+	case r.Method == "PUT" || r.Method == "DELETE":
+		return hasRootAccess(sec, r)
+	case tail:
+		return hasStreamAccess(sec, r, id, security.StreamTail)
+	case r.Method == "POST":
+		return hasStreamAccess(sec, r, id, security.StreamAppend)
+	default:
+		return hasStreamAccess(sec, r, id, security.StreamRead)
+	}
+}
+
+// hasStreamAccess checks the given access of the user to the stream with
+// the given id. As browsers cannot set headers on a websocket handshake or
+// an EventSource, a tail may be authenticated by a token issued on
+// securityPrefix/tokens, given as the "token" query parameter, instead of
+// with basic auth.
+func hasStreamAccess(sec *security.Store, r *http.Request, id string, access security.StreamAccess) bool {
+	if sec == nil {
+		// No store means no security avaliable, eg, tests.
+		return true
+	}
+	if !sec.SecurityEnabled() {
+		return true
+	}
+	user, ok := streamUser(sec, r, access)
+	return ok && userHasStreamAccess(sec, user, id, access)
+}
+
+// streamUser authenticates the user of a request for the given access to a
+// stream, by basic auth or, for a tail, by a tail token.
+func streamUser(sec *security.Store, r *http.Request, access security.StreamAccess) (security.User, bool) {
+	if sec == nil {
+		return security.User{}, false
+	}
+	username, password, ok := netutil.BasicAuth(r)
+	switch {
+	case ok:
+		return checkUser(sec, username, password)
+	case access == security.StreamTail && r.URL.Query().Get("token") != "":
+		if username, ok = sec.TailTokenUser(r.URL.Query().Get("token")); !ok {
+			log.Printf("security: Invalid or expired tail token.")
+			return security.User{}, false
+		}
+		// the roles of the user are looked up as the token is used
+		user, err := sec.GetUser(username)
+		if err != nil {
+			log.Printf("security: No such user: %s.", username)
+			return user, false
+		}
+		return user, true
+	default:
+		return security.User{}, false
+	}
+}
+
+// userHasStreamAccess checks the given access of an authenticated user to
+// the stream with the given id, against the current roles of the user.
+func userHasStreamAccess(sec *security.Store, user security.User, id string, access security.StreamAccess) bool {
+	if user.User == "root" {
+		return true
+	}
+	for _, roleName := range user.Roles {
+		role, err := sec.GetRole(roleName)
+		if err != nil {
+			continue
+		}
+		if role.HasStreamAccess(id, access) {
+			return true
+		}
+	}
+	log.Printf("security: Invalid access for user %s on stream %s.", user.User, id)
+	return false
+}
+
+// checkUser returns the user with the given name, if the password matches.
+func checkUser(sec *security.Store, username, password string) (security.User, bool) {
+	user, err := sec.GetUser(username)
+	if err != nil {
+		log.Printf("security: No such user: %s.", username)
+		return user, false
+	}
+	if !user.CheckPassword(password) {
+		log.Printf("security: Incorrect password for user: %s.", username)
+		return user, false
+	}
+	return user, true
+}
+
+// streamIdFromPath returns the stream id of a path relative to
+// streamsPrefix, such as "/foo/1a".
+func streamIdFromPath(p string) string {
+	p = strings.TrimPrefix(p, "/")
+	if i := strings.Index(p, "/"); i >= 0 {
+		return p[:i]
+	}
+	return p
+}
+
 func writeNoAuth(w http.ResponseWriter) {
 	herr := httptypes.NewHTTPError(http.StatusUnauthorized, "Insufficient credentials")
 	herr.WriteTo(w)
@@ -116,6 +227,7 @@ func handleSecurity(mux *http.ServeMux, sh *securityHandler) {
 	mux.HandleFunc(securityPrefix+"/users", sh.baseUsers)
 	mux.HandleFunc(securityPrefix+"/users/", sh.handleUsers)
 	mux.HandleFunc(securityPrefix+"/enable", sh.enableDisable)
+	mux.HandleFunc(securityPrefix+"/tokens", sh.newTailToken)
 }
 
 func (sh *securityHandler) baseRoles(w http.ResponseWriter, r *http.Request) {
@@ -308,6 +420,47 @@ func (sh *securityHandler) forUser(w http.ResponseWriter, r *http.Request, user
 	}
 }
 
+type tailToken struct {
+	Token string `json:"token"`
+	TTL   int64  `json:"ttl"`
+}
+
+// newTailToken issues a token authenticating the tails of the user, for
+// clients which cannot set headers, such as browsers on a websocket or an
+// EventSource. The token is opaque and expires, so that the credentials of
+// the user are not carried in URLs.
+func (sh *securityHandler) newTailToken(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r.Method, "POST") {
+		return
+	}
+	w.Header().Set("X-Etcd-Cluster-ID", sh.clusterInfo.ID().String())
+	if !sh.sec.SecurityEnabled() {
+		writeError(w, httptypes.NewHTTPError(http.StatusBadRequest, "Security is not enabled"))
+		return
+	}
+	username, password, ok := netutil.BasicAuth(r)
+	if !ok {
+		writeNoAuth(w)
+		return
+	}
+	if _, ok = checkUser(sh.sec, username, password); !ok {
+		writeNoAuth(w)
+		return
+	}
+	token, err := sh.sec.NewTailToken(username)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	tt := tailToken{Token: token, TTL: int64(security.TailTokenTTL / time.Second)}
+	if err := json.NewEncoder(w).Encode(tt); err != nil {
+		log.Println("etcdhttp: error encoding tail token on", r.URL)
+	}
+}
+
 type enabled struct {
 	Enabled bool `json:"enabled"`
 }
@@ -0,0 +1,299 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdhttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/crypto/bcrypt"
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+	etcdErr "github.com/coreos/etcd/error"
+	"github.com/coreos/etcd/etcdserver"
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/etcdserver/security"
+	"github.com/coreos/etcd/pkg/testutil"
+	"github.com/coreos/etcd/store"
+)
+
+// securityDoer serves the users and roles of a security.Store from memory.
+type securityDoer struct {
+	values map[string]string
+}
+
+func newSecurityDoer(t *testing.T, users []security.User, roles map[string]string) *securityDoer {
+	d := &securityDoer{values: make(map[string]string)}
+	for _, u := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.Password = string(hash)
+		b, err := json.Marshal(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.values[path.Join(security.StorePermsPrefix, "users", u.User)] = string(b)
+	}
+	for name, r := range roles {
+		d.values[path.Join(security.StorePermsPrefix, "roles", name)] = r
+	}
+	return d
+}
+
+func (d *securityDoer) Do(_ context.Context, r etcdserverpb.Request) (etcdserver.Response, error) {
+	v, ok := d.values[r.Path]
+	if !ok {
+		return etcdserver.Response{}, etcdErr.NewError(etcdErr.EcodeKeyNotFound, r.Path, 0)
+	}
+	return etcdserver.Response{Event: &store.Event{Node: &store.NodeExtern{Key: r.Path, Value: &v}}}, nil
+}
+
+func newStreamsSecurityStore(t *testing.T) *security.Store {
+	doer := newSecurityDoer(t,
+		[]security.User{
+			{User: "root", Password: "rootpw", Roles: []string{"root"}},
+			{User: "alice", Password: "alicepw", Roles: []string{"logs"}},
+		},
+		map[string]string{
+			"logs": `{"role":"logs","permissions":{` +
+				`"kv":{"read":["/other/*"],"write":["/other/*"]},` +
+				`"streams":{"read":["logs*"],"append":["logs-app"],"tail":["logs"]}}}`,
+		},
+	)
+	sec := security.NewStore(doer, time.Second)
+	if !sec.SecurityEnabled() {
+		t.Fatal("security is not enabled")
+	}
+	return sec
+}
+
+func TestStreamsHandlerAccess(t *testing.T) {
+	sec := newStreamsSecurityStore(t)
+	tests := []struct {
+		method   string
+		p        string
+		user     string
+		password string
+
+		waccess bool
+	}{
+		{"GET", "/logs/0", "", "", false},
+		{"GET", "/logs/0", "alice", "alicepw", true},
+		{"GET", "/logs-db/0", "alice", "alicepw", true},
+		{"POST", "/logs-app", "alice", "alicepw", true},
+		{"POST", "/logs-db", "alice", "alicepw", false},
+		// KV permissions do not apply to streams
+		{"GET", "/other/0", "alice", "alicepw", false},
+		// listing, deleting and retention require root
+		{"GET", "", "alice", "alicepw", false},
+		{"GET", "", "root", "rootpw", true},
+		{"DELETE", "/logs-app", "alice", "alicepw", false},
+		{"DELETE", "/logs-app", "root", "rootpw", true},
+		{"PUT", "/logs-app", "alice", "alicepw", false},
+		// consumer cursors are read with read access, and committed and
+		// deleted with append access
+		{"GET", "/logs-db/cursors", "alice", "alicepw", true},
+		{"PUT", "/logs-db/cursors/w?offset=0", "alice", "alicepw", false},
+		{"DELETE", "/logs-db/cursors/w", "alice", "alicepw", false},
+		{"PUT", "/logs-app/cursors/w?offset=0", "alice", "alicepw", true},
+		{"DELETE", "/logs-app/cursors/w", "alice", "alicepw", true},
+		{"PUT", "/other/cursors/w?offset=0", "alice", "alicepw", false},
+		// tails from a cursor need tail access
+		{"GET", "/logs/cursors/w?wait=true", "alice", "alicepw", true},
+		{"GET", "/logs-db/cursors/w?wait=true", "alice", "alicepw", false},
+	}
+	for i, tt := range tests {
+		req, err := http.NewRequest(tt.method, testutil.MustNewURL(t, streamsPrefix+tt.p).String(), strings.NewReader("bar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.password)
+		}
+		h := &streamsHandler{
+			sec:         sec,
+			server:      &resServer{etcdserver.Response{Event: &store.Event{Node: &store.NodeExtern{}}}},
+			clusterInfo: &fakeCluster{id: 1},
+			timer:       &dummyRaftTimer{},
+			timeout:     time.Hour,
+		}
+		rw := httptest.NewRecorder()
+
+		h.ServeHTTP(rw, req)
+
+		if g := rw.Code != http.StatusUnauthorized; g != tt.waccess {
+			t.Errorf("#%d: access = %v, want %v (code %d)", i, g, tt.waccess, rw.Code)
+		}
+	}
+}
+
+func TestWebsocketStreamsAccess(t *testing.T) {
+	sec := newStreamsSecurityStore(t)
+	token := func(user string) string {
+		token, err := sec.NewTailToken(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		p        string
+		user     string
+		password string
+
+		waccess bool
+	}{
+		// no credentials
+		{"/logs/0", "", "", false},
+		{"/logs/0?token=" + token("alice"), "", "", true},
+		{"/logs/0?token=unknown", "", "", false},
+		// a token only stands for an existing user
+		{"/logs/0?token=" + token("bob"), "", "", false},
+		// credentials are not taken from the URL
+		{"/logs/0?token=YWxpY2U6YWxpY2Vwdw==", "", "", false},
+		{"/logs/0", "alice", "alicepw", true},
+		{"/logs/0", "alice", "wrong", false},
+		// read access does not grant tails
+		{"/logs-db/0", "alice", "alicepw", false},
+		// KV permissions do not apply to streams
+		{"/other/0", "alice", "alicepw", false},
+		{"/other/0?token=" + token("root"), "", "", true},
+		// a multiplexed session checks each subscription instead
+		{"", "", "", true},
+	}
+	for i, tt := range tests {
+		req := &http.Request{
+			Method: "GET",
+			URL:    testutil.MustNewURL(t, wsStreamsPrefix+tt.p),
+			Header: make(http.Header),
+		}
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.password)
+		}
+		h := &websocketStreamsHandler{
+			streamsHandler: &streamsHandler{sec: sec},
+		}
+
+		// the check is made directly, as a request passing it would be
+		// handed to the websocket server, which hijacks the connection
+		if g := h.hasAccess(req); g != tt.waccess {
+			t.Errorf("#%d: access = %v, want %v", i, g, tt.waccess)
+		}
+	}
+}
+
+// Ensure that the subscriptions of a multiplexed session are checked
+// against the user authenticated by the handshake, once its tail token has
+// expired.
+func TestWebsocketStreamsMuxAccess(t *testing.T) {
+	sec := newStreamsSecurityStore(t)
+	defer func(ttl time.Duration) { security.TailTokenTTL = ttl }(security.TailTokenTTL)
+	security.TailTokenTTL = 50 * time.Millisecond
+	token, err := sec.NewTailToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		p        string
+		user     string
+		password string
+
+		waccess map[string]bool
+	}{
+		{"?token=" + token, "", "", map[string]bool{"logs": true, "logs-db": false}},
+		{"", "alice", "alicepw", map[string]bool{"logs": true, "logs-db": false}},
+		{"", "alice", "wrong", map[string]bool{"logs": false}},
+		{"?token=unknown", "", "", map[string]bool{"logs": false}},
+		{"", "", "", map[string]bool{"logs": false}},
+	}
+	h := &websocketStreamsHandler{
+		streamsHandler: &streamsHandler{sec: sec},
+	}
+	var accesses []func(id string) bool
+	for _, tt := range tests {
+		req := &http.Request{
+			Method: "GET",
+			URL:    testutil.MustNewURL(t, wsStreamsPrefix+tt.p),
+			Header: make(http.Header),
+		}
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.password)
+		}
+		accesses = append(accesses, h.muxAccess(req))
+	}
+
+	time.Sleep(2 * security.TailTokenTTL)
+	if _, ok := sec.TailTokenUser(token); ok {
+		t.Fatal("token has not expired")
+	}
+	for i, tt := range tests {
+		for id, w := range tt.waccess {
+			if g := accesses[i](id); g != w {
+				t.Errorf("#%d: access to %s = %v, want %v", i, id, g, w)
+			}
+		}
+	}
+}
+
+func TestSecurityHandlerTailToken(t *testing.T) {
+	sec := newStreamsSecurityStore(t)
+	tests := []struct {
+		method   string
+		user     string
+		password string
+
+		wcode int
+	}{
+		{"POST", "alice", "alicepw", http.StatusCreated},
+		{"POST", "alice", "wrong", http.StatusUnauthorized},
+		{"POST", "", "", http.StatusUnauthorized},
+		{"GET", "alice", "alicepw", http.StatusMethodNotAllowed},
+	}
+	for i, tt := range tests {
+		req, err := http.NewRequest(tt.method, testutil.MustNewURL(t, securityPrefix+"/tokens").String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.password)
+		}
+		sh := &securityHandler{sec: sec, clusterInfo: &fakeCluster{id: 1}}
+		rw := httptest.NewRecorder()
+
+		sh.newTailToken(rw, req)
+
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+		if tt.wcode != http.StatusCreated {
+			continue
+		}
+		var tok tailToken
+		if err := json.Unmarshal(rw.Body.Bytes(), &tok); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if user, ok := sec.TailTokenUser(tok.Token); !ok || user != tt.user {
+			t.Errorf("#%d: token user = %q, %v, want %q, true", i, user, ok, tt.user)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/etcd/etcdserver"
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/store/streams"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// defaultMuxWindow is the number of entries a subscription may be sent
+	// before the client acknowledges them, unless it asks for another
+	// window.
+	defaultMuxWindow = 64
+	maxMuxWindow     = 1024
+	// maxMuxSubscriptions bounds the subscriptions of a single session.
+	maxMuxSubscriptions = 1024
+)
+
+// muxControl is a control message sent by the client of a multiplexed
+// session. "subscribe" starts a tail of the stream with the given id, from
+// an offset, a cursor, or relative to the tail of the stream as the tail
+// options of a tail over HTTP do, and from the tail of the stream if none
+// is given. "unsubscribe" ends it. "ack" allows the given number of entries
+// more to be sent to the subscription.
+type muxControl struct {
+	Action string `json:"action"`
+	Id     string `json:"id"`
+
+	Offset    string `json:"offset,omitempty"`
+	Cursor    string `json:"cursor,omitempty"`
+	FromTail  bool   `json:"fromTail,omitempty"`
+	Back      int64  `json:"back,omitempty"`
+	Count     int    `json:"count,omitempty"`
+	Keepalive int    `json:"keepalive,omitempty"`
+	Window    int    `json:"window,omitempty"`
+
+	Entries int `json:"entries,omitempty"`
+}
+
+// muxEntry is an entry of a subscription. The messages sent by the server
+// are tagged with their type and the id of the stream of their
+// subscription.
+type muxEntry struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+	streamEntry
+}
+
+// muxHeartbeat is sent on an idle subscription in place of an entry.
+type muxHeartbeat struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+	streamHeartbeat
+}
+
+// muxEnd is sent once a subscription has ended, along with the error which
+// ended it, if any. A control message which is rejected is answered with
+// the same message of type "error", which does not end any subscription.
+type muxEnd struct {
+	Type  string `json:"type"`
+	Id    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+// muxConn is the connection of a multiplexed session, over which JSON
+// messages are exchanged.
+type muxConn interface {
+	Receive(v interface{}) error
+	Send(v interface{}) error
+	Close() error
+}
+
+type websocketMuxConn struct {
+	ws *websocket.Conn
+}
+
+func (c *websocketMuxConn) Receive(v interface{}) error { return websocket.JSON.Receive(c.ws, v) }
+func (c *websocketMuxConn) Send(v interface{}) error    { return websocket.JSON.Send(c.ws, v) }
+func (c *websocketMuxConn) Close() error                { return c.ws.Close() }
+
+// streamsMuxSession tails many streams over a single connection. Every
+// subscription is a tail of its own, whose entries are sent as long as the
+// client has acknowledged enough of the previous ones, so that a
+// subscription the client is slow to consume waits without holding back
+// the others.
+type streamsMuxSession struct {
+	conn   muxConn
+	server etcdserver.Server
+	// access reports whether the client may tail the stream with the
+	// given id.
+	access func(id string) bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// out holds the messages waiting for the connection
+	out chan interface{}
+	// wg waits for the tails of the subscriptions
+	wg sync.WaitGroup
+
+	mu   sync.Mutex
+	subs map[string]*muxSubscription
+}
+
+func newStreamsMuxSession(conn muxConn, server etcdserver.Server, access func(id string) bool) *streamsMuxSession {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &streamsMuxSession{
+		conn:   conn,
+		server: server,
+		access: access,
+		ctx:    ctx,
+		cancel: cancel,
+		out:    make(chan interface{}, 16),
+		subs:   make(map[string]*muxSubscription),
+	}
+}
+
+// serve handles the control messages of the client until the connection
+// fails, and then ends every subscription.
+func (s *streamsMuxSession) serve() {
+	go s.writeLoop()
+	go func() {
+		// unblocks the receive once writing fails
+		<-s.ctx.Done()
+		s.conn.Close()
+	}()
+
+	for {
+		var c muxControl
+		err := s.conn.Receive(&c)
+		if err != nil {
+			switch err.(type) {
+			case *json.SyntaxError, *json.UnmarshalTypeError:
+				s.reject("", fmt.Sprintf("invalid control message: %v", err))
+				continue
+			}
+			break
+		}
+		s.handle(c)
+	}
+
+	s.cancel()
+	s.wg.Wait()
+}
+
+func (s *streamsMuxSession) writeLoop() {
+	for {
+		select {
+		case m := <-s.out:
+			if err := s.conn.Send(m); err != nil {
+				log.Printf("etcdhttp: error sending message on websocket: %v", err)
+				s.cancel()
+				return
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// send queues a message for the connection, waiting while the connection
+// is behind.
+func (s *streamsMuxSession) send(m interface{}) error {
+	select {
+	case s.out <- m:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func (s *streamsMuxSession) reject(id, cause string) {
+	s.send(muxEnd{Type: "error", Id: id, Error: cause})
+}
+
+func (s *streamsMuxSession) handle(c muxControl) {
+	switch c.Action {
+	case "subscribe":
+		s.subscribe(c)
+	case "unsubscribe":
+		if sub := s.subscription(c.Id); sub != nil {
+			sub.cancel()
+		} else {
+			s.reject(c.Id, "not subscribed")
+		}
+	case "ack":
+		if sub := s.subscription(c.Id); sub != nil {
+			sub.grant(c.Entries)
+		} else {
+			s.reject(c.Id, "not subscribed")
+		}
+	default:
+		s.reject(c.Id, fmt.Sprintf("unknown action %q", c.Action))
+	}
+}
+
+func (s *streamsMuxSession) subscription(id string) *muxSubscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.subs[id]
+}
+
+func (s *streamsMuxSession) subscribe(c muxControl) {
+	rr, options, err := parseMuxSubscribe(c)
+	if err != nil {
+		s.reject(c.Id, err.Error())
+		return
+	}
+	if !s.access(c.Id) {
+		s.reject(c.Id, "insufficient credentials")
+		return
+	}
+
+	window := c.Window
+	if window <= 0 {
+		window = defaultMuxWindow
+	}
+	if window > maxMuxWindow {
+		window = maxMuxWindow
+	}
+	sub := &muxSubscription{
+		id:      c.Id,
+		session: s,
+		credits: make(chan struct{}, window),
+	}
+	sub.ctx, sub.cancel = context.WithCancel(s.ctx)
+	sub.grant(window)
+
+	s.mu.Lock()
+	if _, ok := s.subs[c.Id]; ok {
+		s.mu.Unlock()
+		sub.cancel()
+		s.reject(c.Id, "already subscribed")
+		return
+	}
+	if len(s.subs) >= maxMuxSubscriptions {
+		s.mu.Unlock()
+		sub.cancel()
+		s.reject(c.Id, "too many subscriptions")
+		return
+	}
+	s.subs[c.Id] = sub
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.server.DoStream(sub.ctx, rr, options, sub)
+	}()
+}
+
+// parseMuxSubscribe converts a subscribe message to the request and the
+// options of its tail.
+func parseMuxSubscribe(c muxControl) (etcdserverpb.Request, streams.TailOptions, error) {
+	rr := etcdserverpb.Request{
+		Method:  "TAIL",
+		StoreId: etcdserver.StoreStreamsId,
+	}
+	options := streams.TailOptions{
+		Count:     c.Count,
+		FromTail:  c.FromTail,
+		Back:      c.Back,
+		Keepalive: time.Duration(c.Keepalive) * time.Second,
+	}
+
+	if c.Id == "" || strings.Contains(c.Id, "/") {
+		return rr, options, fmt.Errorf("invalid stream id")
+	}
+	if c.Count < 0 || c.Back < 0 || c.Keepalive < 0 {
+		return rr, options, fmt.Errorf("invalid tail options")
+	}
+	p := path.Join(etcdserver.StoreStreamsPrefix, c.Id)
+	switch {
+	case c.Offset != "" && c.Cursor != "":
+		return rr, options, fmt.Errorf("offset and cursor are exclusive")
+	case c.Offset != "":
+		if n, err := strconv.ParseInt(c.Offset, 16, 64); err != nil || n < 0 {
+			return rr, options, fmt.Errorf("invalid offset")
+		}
+		p = path.Join(p, c.Offset)
+	case c.Cursor != "":
+		if strings.Contains(c.Cursor, "/") {
+			return rr, options, fmt.Errorf("invalid cursor")
+		}
+		p = path.Join(p, "cursors", c.Cursor)
+	case !c.FromTail && c.Back == 0:
+		options.FromTail = true
+	}
+	rr.Path = p
+	return rr, options, nil
+}
+
+func (s *streamsMuxSession) remove(sub *muxSubscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs[sub.id] == sub {
+		delete(s.subs, sub.id)
+	}
+}
+
+// muxSubscription is the listener of the tail of a subscription.
+type muxSubscription struct {
+	id      string
+	session *streamsMuxSession
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// credits holds a token for every entry which may be sent before the
+	// client acknowledges more.
+	credits chan struct{}
+}
+
+// grant allows n entries more to be sent, up to the window of the
+// subscription.
+func (sub *muxSubscription) grant(n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case sub.credits <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// GotValue waits until the client allows another entry, so that only the
+// tail of this subscription waits on a slow client.
+func (sub *muxSubscription) GotValue(pos int64, value []byte) error {
+	select {
+	case <-sub.credits:
+	case <-sub.ctx.Done():
+		return sub.ctx.Err()
+	}
+	return sub.session.send(muxEntry{
+		Type:        "entry",
+		Id:          sub.id,
+		streamEntry: streamEntry{Offset: strconv.FormatInt(pos, 16), Value: string(value)},
+	})
+}
+
+func (sub *muxSubscription) Keepalive(tail int64) error {
+	return sub.session.send(muxHeartbeat{
+		Type:            "heartbeat",
+		Id:              sub.id,
+		streamHeartbeat: streamHeartbeat{Tail: strconv.FormatInt(tail, 16)},
+	})
+}
+
+// End reports the end of the subscription to the client. A subscription
+// ended by the client has no error.
+func (sub *muxSubscription) End(err error) {
+	sub.session.remove(sub)
+	m := muxEnd{Type: "end", Id: sub.id}
+	if err != nil && sub.ctx.Err() == nil {
+		m.Error = trimErrorPrefix(err, etcdserver.StoreStreamsPrefix).Error()
+	}
+	sub.cancel()
+	sub.session.send(m)
+}
@@ -0,0 +1,227 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+	etcdErr "github.com/coreos/etcd/error"
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/store/streams"
+)
+
+// fakeMuxConn passes the control messages sent on in to the session, and
+// the messages of the session, encoded as JSON, to out.
+type fakeMuxConn struct {
+	in   chan muxControl
+	out  chan string
+	once sync.Once
+	done chan struct{}
+}
+
+func newFakeMuxConn() *fakeMuxConn {
+	return &fakeMuxConn{
+		in:   make(chan muxControl),
+		out:  make(chan string, 100),
+		done: make(chan struct{}),
+	}
+}
+
+func (c *fakeMuxConn) Receive(v interface{}) error {
+	select {
+	case m, ok := <-c.in:
+		if !ok {
+			return io.EOF
+		}
+		*v.(*muxControl) = m
+		return nil
+	case <-c.done:
+		return io.EOF
+	}
+}
+
+func (c *fakeMuxConn) Send(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.out <- string(b)
+	return nil
+}
+
+func (c *fakeMuxConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *fakeMuxConn) next(t *testing.T) string {
+	select {
+	case m := <-c.out:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+	return ""
+}
+
+// muxTailServer tails each stream from a channel of its entries, ending the
+// tail with an error for streams without one.
+type muxTailServer struct {
+	resServer
+	entries map[string]chan tailEntry
+
+	mu   sync.Mutex
+	reqs []etcdserverpb.Request
+	opts []streams.TailOptions
+}
+
+func (ts *muxTailServer) DoStream(ctx context.Context, r etcdserverpb.Request, options streams.TailOptions, l streams.StreamListener) {
+	ts.mu.Lock()
+	ts.reqs = append(ts.reqs, r)
+	ts.opts = append(ts.opts, options)
+	ts.mu.Unlock()
+
+	ch, ok := ts.entries[streamIdFromPath(r.Path[len("/2"):])]
+	if !ok {
+		l.End(etcdErr.NewError(etcdErr.EcodeKeyNotFound, r.Path, 0))
+		return
+	}
+	for {
+		select {
+		case e := <-ch:
+			if err := l.GotValue(e.pos, []byte(e.value)); err != nil {
+				l.End(nil)
+				return
+			}
+		case <-ctx.Done():
+			l.End(ctx.Err())
+			return
+		}
+	}
+}
+
+func TestStreamsMuxSession(t *testing.T) {
+	ts := &muxTailServer{entries: map[string]chan tailEntry{
+		"foo": make(chan tailEntry, 10),
+		"bar": make(chan tailEntry, 10),
+	}}
+	conn := newFakeMuxConn()
+	access := func(id string) bool { return id != "secret" }
+	s := newStreamsMuxSession(conn, ts, access)
+	served := make(chan struct{})
+	go func() {
+		s.serve()
+		close(served)
+	}()
+
+	conn.in <- muxControl{Action: "subscribe", Id: "foo", Offset: "1a", Window: 1}
+	conn.in <- muxControl{Action: "subscribe", Id: "bar"}
+
+	// foo has no credit left after its first entry, while bar goes on
+	ts.entries["foo"] <- tailEntry{0x1a, "a"}
+	ts.entries["foo"] <- tailEntry{0x23, "b"}
+	if g, w := conn.next(t), `{"type":"entry","id":"foo","offset":"1a","value":"a"}`; g != w {
+		t.Errorf("message = %s, want %s", g, w)
+	}
+	ts.entries["bar"] <- tailEntry{0, "c"}
+	if g, w := conn.next(t), `{"type":"entry","id":"bar","offset":"0","value":"c"}`; g != w {
+		t.Errorf("message = %s, want %s", g, w)
+	}
+	conn.in <- muxControl{Action: "ack", Id: "foo", Entries: 1}
+	if g, w := conn.next(t), `{"type":"entry","id":"foo","offset":"23","value":"b"}`; g != w {
+		t.Errorf("message = %s, want %s", g, w)
+	}
+
+	// rejected control messages do not affect the subscriptions
+	conn.in <- muxControl{Action: "subscribe", Id: "foo"}
+	if g, w := conn.next(t), `{"type":"error","id":"foo","error":"already subscribed"}`; g != w {
+		t.Errorf("message = %s, want %s", g, w)
+	}
+	conn.in <- muxControl{Action: "subscribe", Id: "secret"}
+	if g, w := conn.next(t), `{"type":"error","id":"secret","error":"insufficient credentials"}`; g != w {
+		t.Errorf("message = %s, want %s", g, w)
+	}
+	conn.in <- muxControl{Action: "ack", Id: "baz", Entries: 1}
+	if g, w := conn.next(t), `{"type":"error","id":"baz","error":"not subscribed"}`; g != w {
+		t.Errorf("message = %s, want %s", g, w)
+	}
+
+	// a failed tail ends its subscription with the error
+	conn.in <- muxControl{Action: "subscribe", Id: "baz", Cursor: "w"}
+	if g, w := conn.next(t), `{"type":"end","id":"baz","error":"Key not found (/baz/cursors/w)"}`; g != w {
+		t.Errorf("message = %s, want %s", g, w)
+	}
+
+	conn.in <- muxControl{Action: "unsubscribe", Id: "bar"}
+	if g, w := conn.next(t), `{"type":"end","id":"bar"}`; g != w {
+		t.Errorf("message = %s, want %s", g, w)
+	}
+	// the stream may be subscribed to again once its subscription ended
+	conn.in <- muxControl{Action: "subscribe", Id: "bar", Back: 2, Count: 1}
+	ts.entries["bar"] <- tailEntry{9, "d"}
+	if g, w := conn.next(t), `{"type":"entry","id":"bar","offset":"9","value":"d"}`; g != w {
+		t.Errorf("message = %s, want %s", g, w)
+	}
+
+	close(conn.in)
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("session did not end once the connection closed")
+	}
+
+	// the tails start in any order
+	wtails := []string{
+		"/2/bar {Count:0 FromTail:true Back:0 Keepalive:0s}",
+		"/2/bar {Count:1 FromTail:false Back:2 Keepalive:0s}",
+		"/2/baz/cursors/w {Count:0 FromTail:false Back:0 Keepalive:0s}",
+		"/2/foo/1a {Count:0 FromTail:false Back:0 Keepalive:0s}",
+	}
+	var tails []string
+	for i, r := range ts.reqs {
+		tails = append(tails, fmt.Sprintf("%s %+v", r.Path, ts.opts[i]))
+	}
+	sort.Strings(tails)
+	if !reflect.DeepEqual(tails, wtails) {
+		t.Errorf("tails = %v, want %v", tails, wtails)
+	}
+}
+
+func TestParseMuxSubscribeBad(t *testing.T) {
+	tests := []muxControl{
+		{Action: "subscribe"},
+		{Action: "subscribe", Id: "foo/bar"},
+		{Action: "subscribe", Id: "foo", Offset: "xyz"},
+		{Action: "subscribe", Id: "foo", Offset: "-1"},
+		{Action: "subscribe", Id: "foo", Offset: "1a", Cursor: "w"},
+		{Action: "subscribe", Id: "foo", Cursor: "a/b"},
+		{Action: "subscribe", Id: "foo", Count: -1},
+		{Action: "subscribe", Id: "foo", Back: -1},
+		{Action: "subscribe", Id: "foo", Keepalive: -1},
+	}
+	for i, tt := range tests {
+		if _, _, err := parseMuxSubscribe(tt); err == nil {
+			t.Errorf("#%d: err = nil, want error", i)
+		}
+	}
+}
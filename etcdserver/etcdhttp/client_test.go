@@ -39,6 +39,7 @@ import (
 	"github.com/coreos/etcd/pkg/types"
 	"github.com/coreos/etcd/raft/raftpb"
 	"github.com/coreos/etcd/store"
+	"github.com/coreos/etcd/store/streams"
 	"github.com/coreos/etcd/version"
 )
 
@@ -99,6 +100,10 @@ func (s *serverRecorder) Do(_ context.Context, r etcdserverpb.Request) (etcdserv
 	s.actions = append(s.actions, action{name: "Do", params: []interface{}{r}})
 	return etcdserver.Response{}, nil
 }
+func (s *serverRecorder) DoStream(_ context.Context, r etcdserverpb.Request, _ streams.TailOptions, listener streams.StreamListener) {
+	s.actions = append(s.actions, action{name: "DoStream", params: []interface{}{r}})
+	listener.End(nil)
+}
 func (s *serverRecorder) Process(_ context.Context, m raftpb.Message) error {
 	s.actions = append(s.actions, action{name: "Process", params: []interface{}{m}})
 	return nil
@@ -146,6 +151,9 @@ func (rs *resServer) Leader() types.ID { return types.ID(1) }
 func (rs *resServer) Do(_ context.Context, _ etcdserverpb.Request) (etcdserver.Response, error) {
 	return rs.res, nil
 }
+func (rs *resServer) DoStream(_ context.Context, _ etcdserverpb.Request, _ streams.TailOptions, l streams.StreamListener) {
+	l.End(nil)
+}
 func (rs *resServer) Process(_ context.Context, _ raftpb.Message) error         { return nil }
 func (rs *resServer) AddMember(_ context.Context, _ etcdserver.Member) error    { return nil }
 func (rs *resServer) RemoveMember(_ context.Context, _ uint64) error            { return nil }
@@ -344,8 +352,9 @@ func TestGoodParseRequest(t *testing.T) {
 			// good prefix, all other values default
 			mustNewRequest(t, "foo"),
 			etcdserverpb.Request{
-				Method: "GET",
-				Path:   path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				Method:  "GET",
+				Path:    path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				StoreId: etcdserver.StoreKeysId,
 			},
 		},
 		{
@@ -356,9 +365,10 @@ func TestGoodParseRequest(t *testing.T) {
 				url.Values{"value": []string{"some_value"}},
 			),
 			etcdserverpb.Request{
-				Method: "PUT",
-				Val:    "some_value",
-				Path:   path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				Method:  "PUT",
+				Val:     "some_value",
+				Path:    path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				StoreId: etcdserver.StoreKeysId,
 			},
 		},
 		{
@@ -372,6 +382,7 @@ func TestGoodParseRequest(t *testing.T) {
 				Method:    "PUT",
 				PrevIndex: 98765,
 				Path:      path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				StoreId:   etcdserver.StoreKeysId,
 			},
 		},
 		{
@@ -385,6 +396,7 @@ func TestGoodParseRequest(t *testing.T) {
 				Method:    "PUT",
 				Recursive: true,
 				Path:      path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				StoreId:   etcdserver.StoreKeysId,
 			},
 		},
 		{
@@ -395,9 +407,10 @@ func TestGoodParseRequest(t *testing.T) {
 				url.Values{"sorted": []string{"true"}},
 			),
 			etcdserverpb.Request{
-				Method: "PUT",
-				Sorted: true,
-				Path:   path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				Method:  "PUT",
+				Sorted:  true,
+				Path:    path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				StoreId: etcdserver.StoreKeysId,
 			},
 		},
 		{
@@ -408,18 +421,20 @@ func TestGoodParseRequest(t *testing.T) {
 				url.Values{"quorum": []string{"true"}},
 			),
 			etcdserverpb.Request{
-				Method: "PUT",
-				Quorum: true,
-				Path:   path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				Method:  "PUT",
+				Quorum:  true,
+				Path:    path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				StoreId: etcdserver.StoreKeysId,
 			},
 		},
 		{
 			// wait specified
 			mustNewRequest(t, "foo?wait=true"),
 			etcdserverpb.Request{
-				Method: "GET",
-				Wait:   true,
-				Path:   path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				Method:  "GET",
+				Wait:    true,
+				Path:    path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				StoreId: etcdserver.StoreKeysId,
 			},
 		},
 		{
@@ -428,6 +443,7 @@ func TestGoodParseRequest(t *testing.T) {
 			etcdserverpb.Request{
 				Method:     "GET",
 				Path:       path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				StoreId:    etcdserver.StoreKeysId,
 				Expiration: 0,
 			},
 		},
@@ -437,6 +453,7 @@ func TestGoodParseRequest(t *testing.T) {
 			etcdserverpb.Request{
 				Method:     "GET",
 				Path:       path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				StoreId:    etcdserver.StoreKeysId,
 				Expiration: fc.Now().Add(5678 * time.Second).UnixNano(),
 			},
 		},
@@ -446,6 +463,7 @@ func TestGoodParseRequest(t *testing.T) {
 			etcdserverpb.Request{
 				Method:     "GET",
 				Path:       path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				StoreId:    etcdserver.StoreKeysId,
 				Expiration: fc.Now().UnixNano(),
 			},
 		},
@@ -453,18 +471,20 @@ func TestGoodParseRequest(t *testing.T) {
 			// dir specified
 			mustNewRequest(t, "foo?dir=true"),
 			etcdserverpb.Request{
-				Method: "GET",
-				Dir:    true,
-				Path:   path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				Method:  "GET",
+				Dir:     true,
+				Path:    path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				StoreId: etcdserver.StoreKeysId,
 			},
 		},
 		{
 			// dir specified negatively
 			mustNewRequest(t, "foo?dir=false"),
 			etcdserverpb.Request{
-				Method: "GET",
-				Dir:    false,
-				Path:   path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				Method:  "GET",
+				Dir:     false,
+				Path:    path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				StoreId: etcdserver.StoreKeysId,
 			},
 		},
 		{
@@ -478,6 +498,7 @@ func TestGoodParseRequest(t *testing.T) {
 				Method:    "PUT",
 				PrevExist: boolp(true),
 				Path:      path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				StoreId:   etcdserver.StoreKeysId,
 			},
 		},
 		{
@@ -491,6 +512,7 @@ func TestGoodParseRequest(t *testing.T) {
 				Method:    "PUT",
 				PrevExist: boolp(false),
 				Path:      path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				StoreId:   etcdserver.StoreKeysId,
 			},
 		},
 		// mix various fields
@@ -510,6 +532,7 @@ func TestGoodParseRequest(t *testing.T) {
 				PrevValue: "previous value",
 				Val:       "some value",
 				Path:      path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				StoreId:   etcdserver.StoreKeysId,
 			},
 		},
 		// query parameters should be used if given
@@ -523,6 +546,7 @@ func TestGoodParseRequest(t *testing.T) {
 				Method:    "PUT",
 				PrevValue: "woof",
 				Path:      path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				StoreId:   etcdserver.StoreKeysId,
 			},
 		},
 		// but form values should take precedence over query parameters
@@ -538,6 +562,7 @@ func TestGoodParseRequest(t *testing.T) {
 				Method:    "PUT",
 				PrevValue: "miaow",
 				Path:      path.Join(etcdserver.StoreKeysPrefix, "/foo"),
+				StoreId:   etcdserver.StoreKeysId,
 			},
 		},
 	}
@@ -1535,6 +1560,892 @@ func TestServeKeysEvent(t *testing.T) {
 	}
 }
 
+func TestServeStreamsList(t *testing.T) {
+	req := &http.Request{
+		Method: "GET",
+		URL:    testutil.MustNewURL(t, streamsPrefix),
+	}
+	server := &resServer{
+		etcdserver.Response{
+			Streams: []*store.StreamInfo{
+				{Id: "foo", Start: 7, Size: 12, Entries: 2, CreatedIndex: 5},
+			},
+		},
+	}
+	h := &streamsHandler{
+		timeout:     time.Hour,
+		server:      server,
+		clusterInfo: &fakeCluster{id: 1},
+		timer:       &dummyRaftTimer{},
+	}
+	rw := httptest.NewRecorder()
+
+	h.ServeHTTP(rw, req)
+
+	wcode := http.StatusOK
+	wbody := `{"streams":[{"id":"foo","start":7,"size":12,"entries":2,"createdIndex":5}]}`
+
+	if rw.Code != wcode {
+		t.Errorf("got code=%d, want %d", rw.Code, wcode)
+	}
+	if g := strings.TrimSuffix(rw.Body.String(), "\n"); g != wbody {
+		t.Errorf("got body=%#v, want %#v", g, wbody)
+	}
+}
+
+func TestServeStreamsHashes(t *testing.T) {
+	req := &http.Request{
+		Method: "GET",
+		URL:    testutil.MustNewURL(t, streamsPrefix+"?hash=true&index=12"),
+	}
+	server := &resServer{
+		etcdserver.Response{
+			Hashes: &store.StreamHashes{
+				Index: 12,
+				Streams: []*store.StreamHash{
+					{Id: "foo", Start: 7, Tail: 19, Hash: 0xdeadbeef},
+				},
+			},
+		},
+	}
+	h := &streamsHandler{
+		timeout:     time.Hour,
+		server:      server,
+		clusterInfo: &fakeCluster{id: 1},
+		timer:       &dummyRaftTimer{},
+	}
+	rw := httptest.NewRecorder()
+
+	h.ServeHTTP(rw, req)
+
+	wcode := http.StatusOK
+	wbody := `{"index":12,"streams":[{"id":"foo","start":7,"tail":19,"hash":3735928559}]}`
+
+	if rw.Code != wcode {
+		t.Errorf("got code=%d, want %d", rw.Code, wcode)
+	}
+	if g := strings.TrimSuffix(rw.Body.String(), "\n"); g != wbody {
+		t.Errorf("got body=%#v, want %#v", g, wbody)
+	}
+}
+
+func TestServeStreamsEntry(t *testing.T) {
+	value := "\x00\xffbar"
+	server := &resServer{
+		etcdserver.Response{
+			Event: &store.Event{
+				Action: store.Get,
+				Node:   &store.NodeExtern{Key: "/2/foo/1a", Value: &value},
+			},
+			Entry: &streams.Entry{Offset: 0x1a, Next: 0x27, Checksum: 0xc0ffee, Value: []byte(value)},
+		},
+	}
+	tests := []struct {
+		accept string
+
+		wctype  string
+		wbody   string
+		wheader http.Header
+	}{
+		{
+			"application/octet-stream",
+			"application/octet-stream",
+			value,
+			http.Header{
+				"X-Stream-Offset":      {"1a"},
+				"X-Stream-Next-Offset": {"27"},
+				"X-Stream-Crc32c":      {"00c0ffee"},
+			},
+		},
+		{
+			"",
+			"application/json",
+			// the JSON value cannot hold the binary payload
+			"{\"action\":\"get\",\"node\":{\"key\":\"/foo/1a\",\"value\":\"\\u0000\ufffdbar\"}}\n",
+			http.Header{},
+		},
+	}
+	for i, tt := range tests {
+		req := &http.Request{
+			Method: "GET",
+			URL:    testutil.MustNewURL(t, streamsPrefix+"/foo/1a"),
+			Header: http.Header{},
+		}
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		h := &streamsHandler{
+			timeout:     time.Hour,
+			server:      server,
+			clusterInfo: &fakeCluster{id: 1},
+			timer:       &dummyRaftTimer{},
+		}
+		rw := httptest.NewRecorder()
+
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusOK {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, http.StatusOK)
+		}
+		if g := rw.Header().Get("Content-Type"); g != tt.wctype {
+			t.Errorf("#%d: content type = %s, want %s", i, g, tt.wctype)
+		}
+		for k := range tt.wheader {
+			if g, w := rw.Header().Get(k), tt.wheader.Get(k); g != w {
+				t.Errorf("#%d: header %s = %s, want %s", i, k, g, w)
+			}
+		}
+		if g := rw.Body.String(); g != tt.wbody {
+			t.Errorf("#%d: body = %q, want %q", i, g, tt.wbody)
+		}
+	}
+}
+
+func TestServeStreamsRange(t *testing.T) {
+	tests := []struct {
+		rng    *streams.Range
+		accept string
+
+		wctype  string
+		wbody   string
+		wheader http.Header
+	}{
+		{
+			&streams.Range{
+				Entries: []*streams.Entry{
+					{Offset: 0x1a, Next: 0x25, Checksum: 0x01020304, Value: []byte("foo")},
+					{Offset: 0x25, Next: 0x30, Checksum: 0x05060708, Value: []byte("bar")},
+				},
+				Next: 0x30,
+			},
+			"",
+			"application/json",
+			`{"entries":[{"offset":"1a","value":"foo"},{"offset":"25","value":"bar"}],"next":"30"}` + "\n",
+			http.Header{},
+		},
+		{
+			&streams.Range{
+				Entries: []*streams.Entry{
+					{Offset: 0x1a, Next: 0x25, Checksum: 0x01020304, Value: []byte("foo")},
+					{Offset: 0x25, Next: 0x30, Checksum: 0x05060708, Value: []byte("bar")},
+				},
+				Next: 0x30,
+			},
+			"application/octet-stream",
+			"application/octet-stream",
+			"\x04\x03\x02\x01\x03\x00\x00\x00foo\x08\x07\x06\x05\x03\x00\x00\x00bar",
+			http.Header{
+				"X-Stream-Offset":      {"1a"},
+				"X-Stream-Next-Offset": {"30"},
+				"Content-Length":       {"22"},
+			},
+		},
+		// a range at the tail holds no entries
+		{
+			&streams.Range{Next: 0x30},
+			"",
+			"application/json",
+			`{"entries":[],"next":"30"}` + "\n",
+			http.Header{},
+		},
+		{
+			&streams.Range{Next: 0x30},
+			"application/octet-stream",
+			"application/octet-stream",
+			"",
+			http.Header{
+				"X-Stream-Offset":      {"30"},
+				"X-Stream-Next-Offset": {"30"},
+			},
+		},
+	}
+	for i, tt := range tests {
+		req := &http.Request{
+			Method: "GET",
+			URL:    testutil.MustNewURL(t, streamsPrefix+"/foo?from=1a"),
+			Header: http.Header{},
+		}
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		h := &streamsHandler{
+			timeout:     time.Hour,
+			server:      &resServer{etcdserver.Response{Range: tt.rng}},
+			clusterInfo: &fakeCluster{id: 1},
+			timer:       &dummyRaftTimer{},
+		}
+		rw := httptest.NewRecorder()
+
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusOK {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, http.StatusOK)
+		}
+		if g := rw.Header().Get("Content-Type"); g != tt.wctype {
+			t.Errorf("#%d: content type = %s, want %s", i, g, tt.wctype)
+		}
+		for k := range tt.wheader {
+			if g, w := rw.Header().Get(k), tt.wheader.Get(k); g != w {
+				t.Errorf("#%d: header %s = %s, want %s", i, k, g, w)
+			}
+		}
+		if g := rw.Body.String(); g != tt.wbody {
+			t.Errorf("#%d: body = %q, want %q", i, g, tt.wbody)
+		}
+	}
+}
+
+func TestServeStreamsCursors(t *testing.T) {
+	tests := []struct {
+		p string
+
+		wbody string
+	}{
+		{
+			"/foo/cursors",
+			`{"cursors":[{"name":"w","offset":9,"lag":10}]}`,
+		},
+		{
+			"/foo/cursors/w",
+			`{"name":"w","offset":9,"lag":10}`,
+		},
+	}
+	for i, tt := range tests {
+		req := &http.Request{
+			Method: "GET",
+			URL:    testutil.MustNewURL(t, streamsPrefix+tt.p),
+		}
+		server := &resServer{
+			etcdserver.Response{
+				Cursors: []*store.CursorInfo{
+					{Name: "w", Offset: 9, Lag: 10},
+				},
+			},
+		}
+		h := &streamsHandler{
+			timeout:     time.Hour,
+			server:      server,
+			clusterInfo: &fakeCluster{id: 1},
+			timer:       &dummyRaftTimer{},
+		}
+		rw := httptest.NewRecorder()
+
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusOK {
+			t.Errorf("#%d: got code=%d, want %d", i, rw.Code, http.StatusOK)
+		}
+		if g := strings.TrimSuffix(rw.Body.String(), "\n"); g != tt.wbody {
+			t.Errorf("#%d: got body=%#v, want %#v", i, g, tt.wbody)
+		}
+	}
+}
+
+func TestParseStreamsRequest(t *testing.T) {
+	tests := []struct {
+		method string
+		p      string
+
+		w     etcdserverpb.Request
+		wcode int
+	}{
+		{
+			"PUT", "/foo?maxBytes=1024&maxAge=60",
+			etcdserverpb.Request{
+				Method:  "PUT",
+				Path:    path.Join(etcdserver.StoreStreamsPrefix, "/foo"),
+				Val:     `{"maxBytes":1024,"maxAge":60}`,
+				StoreId: etcdserver.StoreStreamsId,
+			},
+			0,
+		},
+		{
+			// default policy of all streams
+			"PUT", "?maxAge=60",
+			etcdserverpb.Request{
+				Method:  "PUT",
+				Path:    etcdserver.StoreStreamsPrefix,
+				Val:     `{"maxAge":60}`,
+				StoreId: etcdserver.StoreStreamsId,
+			},
+			0,
+		},
+		{
+			"PUT", "/foo?maxBytes=-1",
+			etcdserverpb.Request{},
+			etcdErr.EcodeInvalidField,
+		},
+		{
+			"PUT", "/foo/cursors/w?offset=1a",
+			etcdserverpb.Request{
+				Method:  "PUT",
+				Path:    path.Join(etcdserver.StoreStreamsPrefix, "/foo/cursors/w"),
+				Val:     "1a",
+				StoreId: etcdserver.StoreStreamsId,
+			},
+			0,
+		},
+		{
+			"PUT", "/foo/cursors/w",
+			etcdserverpb.Request{},
+			etcdErr.EcodeInvalidField,
+		},
+		{
+			"DELETE", "/foo?before=1a",
+			etcdserverpb.Request{
+				Method:  "DELETE",
+				Path:    path.Join(etcdserver.StoreStreamsPrefix, "/foo"),
+				Val:     "1a",
+				StoreId: etcdserver.StoreStreamsId,
+			},
+			0,
+		},
+		{
+			"DELETE", "/foo?before=xyz",
+			etcdserverpb.Request{},
+			etcdErr.EcodeInvalidField,
+		},
+		{
+			"DELETE", "/foo",
+			etcdserverpb.Request{
+				Method:  "DELETE",
+				Path:    path.Join(etcdserver.StoreStreamsPrefix, "/foo"),
+				StoreId: etcdserver.StoreStreamsId,
+			},
+			0,
+		},
+		{
+			"GET", "/foo?from=1a&limit=2&maxBytes=100",
+			etcdserverpb.Request{
+				Method:  "GET",
+				Path:    path.Join(etcdserver.StoreStreamsPrefix, "/foo"),
+				Val:     `{"from":26,"limit":2,"maxBytes":100}`,
+				StoreId: etcdserver.StoreStreamsId,
+			},
+			0,
+		},
+		{
+			"GET", "/foo?from=1a",
+			etcdserverpb.Request{
+				Method:  "GET",
+				Path:    path.Join(etcdserver.StoreStreamsPrefix, "/foo"),
+				Val:     `{"from":26}`,
+				StoreId: etcdserver.StoreStreamsId,
+			},
+			0,
+		},
+		{
+			"GET", "/foo?from=xyz",
+			etcdserverpb.Request{},
+			etcdErr.EcodeInvalidField,
+		},
+		{
+			"GET", "/foo?from=1a&limit=-1",
+			etcdserverpb.Request{},
+			etcdErr.EcodeInvalidField,
+		},
+		{
+			"GET", "/foo?from=1a&maxBytes=x",
+			etcdserverpb.Request{},
+			etcdErr.EcodeInvalidField,
+		},
+		{
+			"GET", "/foo/1a?wait=true",
+			etcdserverpb.Request{
+				Method:  "GET",
+				Path:    path.Join(etcdserver.StoreStreamsPrefix, "/foo/1a"),
+				Wait:    true,
+				StoreId: etcdserver.StoreStreamsId,
+			},
+			0,
+		},
+		{
+			"GET", "/foo/1a?wait=yes",
+			etcdserverpb.Request{},
+			etcdErr.EcodeInvalidField,
+		},
+		{
+			"GET", "/foo?wait=true&waitIndex=5&stream=true",
+			etcdserverpb.Request{
+				Method:    "GET",
+				Path:      path.Join(etcdserver.StoreStreamsPrefix, "/foo"),
+				Wait:      true,
+				Recursive: true,
+				Since:     5,
+				Stream:    true,
+				StoreId:   etcdserver.StoreStreamsId,
+			},
+			0,
+		},
+		{
+			"GET", "?wait=true",
+			etcdserverpb.Request{
+				Method:    "GET",
+				Path:      etcdserver.StoreStreamsPrefix,
+				Wait:      true,
+				Recursive: true,
+				StoreId:   etcdserver.StoreStreamsId,
+			},
+			0,
+		},
+		{
+			"GET", "/foo?wait=true&back=2",
+			etcdserverpb.Request{
+				Method:  "GET",
+				Path:    path.Join(etcdserver.StoreStreamsPrefix, "/foo"),
+				Wait:    true,
+				StoreId: etcdserver.StoreStreamsId,
+			},
+			0,
+		},
+		{
+			"GET", "/foo?wait=true&waitIndex=x",
+			etcdserverpb.Request{},
+			etcdErr.EcodeIndexNaN,
+		},
+		// hashes of all streams as of an index
+		{
+			"GET", "?hash=true&index=12",
+			etcdserverpb.Request{
+				Method:  "HASH",
+				Path:    etcdserver.StoreStreamsPrefix,
+				Since:   12,
+				StoreId: etcdserver.StoreStreamsId,
+			},
+			0,
+		},
+		{
+			"GET", "/foo?hash=true",
+			etcdserverpb.Request{
+				Method:  "HASH",
+				Path:    path.Join(etcdserver.StoreStreamsPrefix, "/foo"),
+				StoreId: etcdserver.StoreStreamsId,
+			},
+			0,
+		},
+		{
+			"GET", "?hash=true&index=x",
+			etcdserverpb.Request{},
+			etcdErr.EcodeIndexNaN,
+		},
+		{
+			"GET", "/foo/0?hash=true",
+			etcdserverpb.Request{},
+			etcdErr.EcodeInvalidField,
+		},
+		{
+			"GET", "?hash=maybe",
+			etcdserverpb.Request{},
+			etcdErr.EcodeInvalidField,
+		},
+	}
+
+	for i, tt := range tests {
+		req := &http.Request{
+			Method: tt.method,
+			URL:    testutil.MustNewURL(t, streamsPrefix+tt.p),
+		}
+		got, err := parseStreamsRequest(req, clockwork.NewFakeClock(), 0)
+		if tt.wcode != 0 {
+			if ee, ok := err.(*etcdErr.Error); !ok || ee.ErrorCode != tt.wcode {
+				t.Errorf("#%d: err = %v, want error code %d", i, err, tt.wcode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: err = %v, want nil", i, err)
+		}
+		if !reflect.DeepEqual(got, tt.w) {
+			t.Errorf("#%d: request = %#v, want %#v", i, got, tt.w)
+		}
+	}
+}
+
+func TestParseStreamsAppendRequest(t *testing.T) {
+	tests := []struct {
+		p    string
+		body string
+
+		wval  string
+		wvals [][]byte
+		wprev string
+		wcode int
+	}{
+		{"/foo", "a\nb", "a\nb", nil, "", 0},
+		{"/foo?batch=lines", "a\nbb\n", "", [][]byte{[]byte("a"), []byte("bb")}, "", 0},
+		{"/foo?batch=lines", "a\n\nc", "", [][]byte{[]byte("a"), []byte{}, []byte("c")}, "", 0},
+		{"/foo?batch=lines", "", "", nil, "", etcdErr.EcodeInvalidField},
+		{"/foo?batch=length", "\x01\x00\x00\x00a\x02\x00\x00\x00bb", "", [][]byte{[]byte("a"), []byte("bb")}, "", 0},
+		{"/foo?batch=length", "\x00\x00\x00\x00", "", [][]byte{[]byte{}}, "", 0},
+		// truncated length
+		{"/foo?batch=length", "\x01\x00\x00\x00a\x02\x00", "", nil, "", etcdErr.EcodeInvalidField},
+		// truncated entry
+		{"/foo?batch=length", "\x03\x00\x00\x00ab", "", nil, "", etcdErr.EcodeInvalidField},
+		{"/foo?batch=words", "a b", "", nil, "", etcdErr.EcodeInvalidField},
+		{"/foo?expectedTail=1a", "a", "a", nil, "1a", 0},
+		{"/foo?expectedTail=0&batch=lines", "a", "", [][]byte{[]byte("a")}, "0", 0},
+		{"/foo?expectedTail=-1", "a", "", nil, "", etcdErr.EcodeInvalidField},
+		{"/foo?expectedTail=xyz", "a", "", nil, "", etcdErr.EcodeInvalidField},
+		// entries are limited to 4 bytes
+		{"/foo", "abcd", "abcd", nil, "", 0},
+		{"/foo", "abcde", "", nil, "", etcdErr.EcodeEntryTooLarge},
+		{"/foo?batch=lines", "a\nbcdef", "", nil, "", etcdErr.EcodeEntryTooLarge},
+		{"/foo?batch=length", "\x05\x00\x00\x00abcde", "", nil, "", etcdErr.EcodeEntryTooLarge},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("POST", testutil.MustNewURL(t, streamsPrefix+tt.p).String(), strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseStreamsRequest(req, clockwork.NewFakeClock(), 4)
+		if tt.wcode != 0 {
+			if ee, ok := err.(*etcdErr.Error); !ok || ee.ErrorCode != tt.wcode {
+				t.Errorf("#%d: err = %v, want error code %d", i, err, tt.wcode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: err = %v, want nil", i, err)
+			continue
+		}
+		w := etcdserverpb.Request{
+			Method:    "POST",
+			Path:      path.Join(etcdserver.StoreStreamsPrefix, "/foo"),
+			Val:       tt.wval,
+			Vals:      tt.wvals,
+			PrevValue: tt.wprev,
+			StoreId:   etcdserver.StoreStreamsId,
+		}
+		if !reflect.DeepEqual(got, w) {
+			t.Errorf("#%d: request = %#v, want %#v", i, got, w)
+		}
+	}
+}
+
+func TestParseStreamsAppendRequestBodyLimit(t *testing.T) {
+	defer func(n int64) { streamsBatchBytes = n }(streamsBatchBytes)
+	streamsBatchBytes = 16
+
+	tests := []struct {
+		p    string
+		body string
+
+		wcode int
+	}{
+		{"/foo", "abcd", 0},
+		{"/foo", strings.Repeat("a", 1024), etcdErr.EcodeEntryTooLarge},
+		{"/foo?batch=lines", "ab\ncd\nef\ngh\nij", 0},
+		{"/foo?batch=lines", "ab\ncd\nef\ngh\nij\nkl", etcdErr.EcodeEntryTooLarge},
+		{"/foo?batch=length", strings.Repeat("\x01\x00\x00\x00a", 4), etcdErr.EcodeEntryTooLarge},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("POST", testutil.MustNewURL(t, streamsPrefix+tt.p).String(), strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = parseStreamsRequest(req, clockwork.NewFakeClock(), 4)
+		if tt.wcode == 0 {
+			if err != nil {
+				t.Errorf("#%d: err = %v, want nil", i, err)
+			}
+			continue
+		}
+		if ee, ok := err.(*etcdErr.Error); !ok || ee.ErrorCode != tt.wcode {
+			t.Errorf("#%d: err = %v, want error code %d", i, err, tt.wcode)
+		}
+	}
+}
+
+func TestMaxStreamsBodyBytes(t *testing.T) {
+	defer func(n int64) { streamsBatchBytes = n }(streamsBatchBytes)
+	streamsBatchBytes = 16
+
+	tests := []struct {
+		batch bool
+		max   int64
+
+		w int64
+	}{
+		{false, 0, 0},
+		{true, 0, 0},
+		{false, 4, 4},
+		{true, 4, 16},
+		{true, 32, 36},
+	}
+	for i, tt := range tests {
+		if g := maxStreamsBodyBytes(tt.batch, tt.max); g != tt.w {
+			t.Errorf("#%d: limit = %d, want %d", i, g, tt.w)
+		}
+	}
+}
+
+type tailEntry struct {
+	pos   int64
+	value string
+}
+
+// tailServer is a resServer whose tails send the given entries.
+type tailServer struct {
+	resServer
+	entries []tailEntry
+	err     error
+
+	req     etcdserverpb.Request
+	options streams.TailOptions
+}
+
+func (ts *tailServer) DoStream(_ context.Context, r etcdserverpb.Request, options streams.TailOptions, l streams.StreamListener) {
+	ts.req = r
+	ts.options = options
+	for _, e := range ts.entries {
+		if err := l.GotValue(e.pos, []byte(e.value)); err != nil {
+			break
+		}
+	}
+	l.End(ts.err)
+}
+
+func TestServeStreamsTail(t *testing.T) {
+	entries := []tailEntry{{0, "foo"}, {0xb, "bar\nbaz"}}
+	tests := []struct {
+		header http.Header
+		err    error
+
+		wpath  string
+		wcode  int
+		wctype string
+		wbody  string
+	}{
+		{
+			http.Header{},
+			nil,
+			"/2/foo/0",
+			http.StatusOK,
+			"application/json",
+			`{"offset":"0","value":"foo"}` + "\n" + `{"offset":"b","value":"bar\nbaz"}` + "\n",
+		},
+		{
+			http.Header{"Accept": {"text/event-stream"}},
+			nil,
+			"/2/foo/0",
+			http.StatusOK,
+			"text/event-stream",
+			"id: 0\ndata: foo\n\nid: b\ndata: bar\ndata: baz\n\n",
+		},
+		{
+			// a reconnecting client resumes after the last event it saw
+			http.Header{"Accept": {"text/event-stream"}, "Last-Event-Id": {"0"}},
+			nil,
+			"/2/foo/0",
+			http.StatusOK,
+			"text/event-stream",
+			"id: b\ndata: bar\ndata: baz\n\n",
+		},
+		{
+			http.Header{"Accept": {"text/event-stream"}},
+			streams.ErrStreamClosed,
+			"/2/foo/0",
+			http.StatusOK,
+			"text/event-stream",
+			"id: 0\ndata: foo\n\nid: b\ndata: bar\ndata: baz\n\nevent: error\ndata: streams: stream closed\n\n",
+		},
+	}
+	for i, tt := range tests {
+		req := &http.Request{
+			Method: "GET",
+			URL:    testutil.MustNewURL(t, streamsPrefix+"/foo/0?wait=true"),
+			Header: tt.header,
+		}
+		server := &tailServer{entries: entries, err: tt.err}
+		h := &streamsHandler{
+			timeout:     time.Hour,
+			server:      server,
+			clusterInfo: &fakeCluster{id: 1},
+			timer:       &dummyRaftTimer{},
+		}
+		rw := httptest.NewRecorder()
+
+		h.ServeHTTP(rw, req)
+
+		if server.req.Method != "TAIL" || server.req.Path != tt.wpath {
+			t.Errorf("#%d: request = %s %s, want TAIL %s", i, server.req.Method, server.req.Path, tt.wpath)
+		}
+		if rw.Code != tt.wcode {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, tt.wcode)
+		}
+		if g := rw.Header().Get("Content-Type"); g != tt.wctype {
+			t.Errorf("#%d: content type = %s, want %s", i, g, tt.wctype)
+		}
+		if g := rw.Body.String(); g != tt.wbody {
+			t.Errorf("#%d: body = %q, want %q", i, g, tt.wbody)
+		}
+	}
+}
+
+func TestServeStreamsTailError(t *testing.T) {
+	req := &http.Request{
+		Method: "GET",
+		URL:    testutil.MustNewURL(t, streamsPrefix+"/foo/0?wait=true"),
+		Header: http.Header{},
+	}
+	h := &streamsHandler{
+		timeout:     time.Hour,
+		server:      &tailServer{err: etcdErr.NewError(etcdErr.EcodeKeyNotFound, "/2/foo", 0)},
+		clusterInfo: &fakeCluster{id: 1},
+		timer:       &dummyRaftTimer{},
+	}
+	rw := httptest.NewRecorder()
+
+	h.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("code = %d, want %d", rw.Code, http.StatusNotFound)
+	}
+	wbody := `{"errorCode":100,"message":"Key not found","cause":"/foo","index":0}`
+	if g := strings.TrimSuffix(rw.Body.String(), "\n"); g != wbody {
+		t.Errorf("body = %s, want %s", g, wbody)
+	}
+}
+
+// idleTailServer is a resServer whose tails send nothing until they are
+// cancelled.
+type idleTailServer struct {
+	resServer
+}
+
+func (ts *idleTailServer) DoStream(ctx context.Context, _ etcdserverpb.Request, _ streams.TailOptions, l streams.StreamListener) {
+	<-ctx.Done()
+	l.End(ctx.Err())
+}
+
+func TestServeStreamsTailClientGone(t *testing.T) {
+	req := &http.Request{
+		Method: "GET",
+		URL:    testutil.MustNewURL(t, streamsPrefix+"/foo/0?wait=true"),
+		Header: http.Header{},
+	}
+	h := &streamsHandler{
+		timeout:     time.Hour,
+		server:      &idleTailServer{},
+		clusterInfo: &fakeCluster{id: 1},
+		timer:       &dummyRaftTimer{},
+	}
+	rw := &recordingCloseNotifier{
+		ResponseRecorder: httptest.NewRecorder(),
+		cn:               make(chan bool, 1),
+	}
+	rw.cn <- true
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(rw, req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("tail did not end once the client went away")
+	}
+
+	// nothing is written to the client which has gone away
+	if g := rw.Body.String(); g != "" {
+		t.Errorf("body = %q, want empty", g)
+	}
+}
+
+func TestParseStreamsTailOptions(t *testing.T) {
+	tests := []struct {
+		query string
+
+		woptions streams.TailOptions
+		wcode    int
+	}{
+		{"", streams.TailOptions{}, 0},
+		{"count=2", streams.TailOptions{Count: 2}, 0},
+		{"fromTail=true&keepalive=5", streams.TailOptions{FromTail: true, Keepalive: 5 * time.Second}, 0},
+		{"back=3&count=1", streams.TailOptions{Back: 3, Count: 1}, 0},
+		{"count=-1", streams.TailOptions{}, etcdErr.EcodeInvalidField},
+		{"fromTail=maybe", streams.TailOptions{}, etcdErr.EcodeInvalidField},
+		{"back=x", streams.TailOptions{}, etcdErr.EcodeInvalidField},
+		{"keepalive=1s", streams.TailOptions{}, etcdErr.EcodeInvalidField},
+		{"fromTail=true&back=3", streams.TailOptions{}, etcdErr.EcodeInvalidField},
+	}
+	for i, tt := range tests {
+		params, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		options, err := parseStreamsTailOptions(params)
+		if tt.wcode != 0 {
+			if e, ok := err.(*etcdErr.Error); !ok || e.ErrorCode != tt.wcode {
+				t.Errorf("#%d: err = %v, want error code %d", i, err, tt.wcode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: err = %v, want nil", i, err)
+		}
+		if options != tt.woptions {
+			t.Errorf("#%d: options = %+v, want %+v", i, options, tt.woptions)
+		}
+	}
+}
+
+func TestServeStreamsTailOptions(t *testing.T) {
+	req := &http.Request{
+		Method: "GET",
+		URL:    testutil.MustNewURL(t, streamsPrefix+"/foo?wait=true&back=2&count=2"),
+		Header: http.Header{},
+	}
+	server := &tailServer{entries: []tailEntry{{0, "foo"}}}
+	h := &streamsHandler{
+		timeout:     time.Hour,
+		server:      server,
+		clusterInfo: &fakeCluster{id: 1},
+		timer:       &dummyRaftTimer{},
+	}
+	rw := httptest.NewRecorder()
+
+	h.ServeHTTP(rw, req)
+
+	if server.req.Path != "/2/foo" {
+		t.Errorf("path = %s, want %s", server.req.Path, "/2/foo")
+	}
+	if w := (streams.TailOptions{Back: 2, Count: 2}); server.options != w {
+		t.Errorf("options = %+v, want %+v", server.options, w)
+	}
+	if rw.Code != http.StatusOK {
+		t.Errorf("code = %d, want %d", rw.Code, http.StatusOK)
+	}
+}
+
+func TestStreamsTailKeepalive(t *testing.T) {
+	tests := []struct {
+		sse bool
+
+		wbody string
+	}{
+		{false, "\n"},
+		{true, ": keepalive 1a\n\n"},
+	}
+	for i, tt := range tests {
+		rw := httptest.NewRecorder()
+		tail := &httpStreamsTail{w: rw, rt: &dummyRaftTimer{}, sse: tt.sse, skip: -1}
+
+		if err := tail.Keepalive(0x1a); err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if rw.Code != http.StatusOK {
+			t.Errorf("#%d: code = %d, want %d", i, rw.Code, http.StatusOK)
+		}
+		if g := rw.Body.String(); g != tt.wbody {
+			t.Errorf("#%d: body = %q, want %q", i, g, tt.wbody)
+		}
+	}
+}
+
 func TestServeKeysWatch(t *testing.T) {
 	req := mustNewRequest(t, "/foo/bar")
 	ec := make(chan *store.Event)
@@ -1594,6 +2505,48 @@ func (rcn *recordingCloseNotifier) CloseNotify() <-chan bool {
 	return rcn.cn
 }
 
+func TestServeStreamsWatch(t *testing.T) {
+	value := "bar"
+	wa := &dummyWatcher{
+		echan: make(chan *store.Event, 1),
+		sidx:  10,
+	}
+	wa.echan <- &store.Event{
+		Action: store.Create,
+		Node: &store.NodeExtern{
+			Key:           "/2/foo/0",
+			Value:         &value,
+			ModifiedIndex: 11,
+			CreatedIndex:  11,
+		},
+		EtcdIndex: 11,
+	}
+	h := &streamsHandler{
+		timeout:     time.Hour,
+		server:      &resServer{etcdserver.Response{Watcher: wa}},
+		clusterInfo: &fakeCluster{id: 1},
+		timer:       &dummyRaftTimer{},
+	}
+	rw := httptest.NewRecorder()
+	req := &http.Request{
+		Method: "GET",
+		URL:    testutil.MustNewURL(t, streamsPrefix+"/foo?wait=true&waitIndex=10"),
+	}
+
+	h.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Errorf("code = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if g := rw.Header().Get("X-Etcd-Index"); g != "10" {
+		t.Errorf("X-Etcd-Index = %s, want 10", g)
+	}
+	wbody := `{"action":"create","node":{"key":"/foo/0","value":"bar","modifiedIndex":11,"createdIndex":11}}` + "\n"
+	if g := rw.Body.String(); g != wbody {
+		t.Errorf("body = %q, want %q", g, wbody)
+	}
+}
+
 func TestHandleWatch(t *testing.T) {
 	defaultRwRr := func() (http.ResponseWriter, *httptest.ResponseRecorder) {
 		r := httptest.NewRecorder()
@@ -1674,7 +2627,7 @@ func TestHandleWatch(t *testing.T) {
 		}
 		tt.doToChan(wa.echan)
 
-		handleKeyWatch(tt.getCtx(), rw, wa, false, dummyRaftTimer{})
+		handleWatch(tt.getCtx(), rw, wa, etcdserver.StoreKeysPrefix, false, dummyRaftTimer{})
 
 		wcode := http.StatusOK
 		wct := "application/json"
@@ -1718,7 +2671,7 @@ func TestHandleWatchStreaming(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	done := make(chan struct{})
 	go func() {
-		handleKeyWatch(ctx, rw, wa, true, dummyRaftTimer{})
+		handleWatch(ctx, rw, wa, etcdserver.StoreKeysPrefix, true, dummyRaftTimer{})
 		close(done)
 	}()
 
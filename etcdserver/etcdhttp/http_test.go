@@ -27,6 +27,7 @@ import (
 	"github.com/coreos/etcd/etcdserver/etcdserverpb"
 	"github.com/coreos/etcd/pkg/types"
 	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/store/streams"
 )
 
 type fakeCluster struct {
@@ -61,6 +62,9 @@ func (fs *errServer) Leader() types.ID { return types.ID(1) }
 func (fs *errServer) Do(ctx context.Context, r etcdserverpb.Request) (etcdserver.Response, error) {
 	return etcdserver.Response{}, fs.err
 }
+func (fs *errServer) DoStream(ctx context.Context, r etcdserverpb.Request, options streams.TailOptions, listener streams.StreamListener) {
+	listener.End(fs.err)
+}
 func (fs *errServer) Process(ctx context.Context, m raftpb.Message) error {
 	return fs.err
 }
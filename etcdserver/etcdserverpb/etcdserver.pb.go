@@ -28,24 +28,25 @@ var _ = proto.Marshal
 var _ = math.Inf
 
 type Request struct {
-	ID               uint64 `protobuf:"varint,1,req" json:"ID"`
-	Method           string `protobuf:"bytes,2,req" json:"Method"`
-	Path             string `protobuf:"bytes,3,req" json:"Path"`
-	Val              string `protobuf:"bytes,4,req" json:"Val"`
-	Dir              bool   `protobuf:"varint,5,req" json:"Dir"`
-	PrevValue        string `protobuf:"bytes,6,req" json:"PrevValue"`
-	PrevIndex        uint64 `protobuf:"varint,7,req" json:"PrevIndex"`
-	PrevExist        *bool  `protobuf:"varint,8,req" json:"PrevExist,omitempty"`
-	Expiration       int64  `protobuf:"varint,9,req" json:"Expiration"`
-	Wait             bool   `protobuf:"varint,10,req" json:"Wait"`
-	Since            uint64 `protobuf:"varint,11,req" json:"Since"`
-	Recursive        bool   `protobuf:"varint,12,req" json:"Recursive"`
-	Sorted           bool   `protobuf:"varint,13,req" json:"Sorted"`
-	Quorum           bool   `protobuf:"varint,14,req" json:"Quorum"`
-	Time             int64  `protobuf:"varint,15,req" json:"Time"`
-	Stream           bool   `protobuf:"varint,16,req" json:"Stream"`
-	StoreId          int32  `protobuf:"varint,17,req" json:"StoreId"`
-	XXX_unrecognized []byte `json:"-"`
+	ID               uint64   `protobuf:"varint,1,req" json:"ID"`
+	Method           string   `protobuf:"bytes,2,req" json:"Method"`
+	Path             string   `protobuf:"bytes,3,req" json:"Path"`
+	Val              string   `protobuf:"bytes,4,req" json:"Val"`
+	Dir              bool     `protobuf:"varint,5,req" json:"Dir"`
+	PrevValue        string   `protobuf:"bytes,6,req" json:"PrevValue"`
+	PrevIndex        uint64   `protobuf:"varint,7,req" json:"PrevIndex"`
+	PrevExist        *bool    `protobuf:"varint,8,req" json:"PrevExist,omitempty"`
+	Expiration       int64    `protobuf:"varint,9,req" json:"Expiration"`
+	Wait             bool     `protobuf:"varint,10,req" json:"Wait"`
+	Since            uint64   `protobuf:"varint,11,req" json:"Since"`
+	Recursive        bool     `protobuf:"varint,12,req" json:"Recursive"`
+	Sorted           bool     `protobuf:"varint,13,req" json:"Sorted"`
+	Quorum           bool     `protobuf:"varint,14,req" json:"Quorum"`
+	Time             int64    `protobuf:"varint,15,req" json:"Time"`
+	Stream           bool     `protobuf:"varint,16,req" json:"Stream"`
+	StoreId          int32    `protobuf:"varint,17,req" json:"StoreId"`
+	Vals             [][]byte `protobuf:"bytes,18,rep" json:"Vals,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
 }
 
 func (m *Request) Reset()         { *m = Request{} }
@@ -381,6 +382,29 @@ func (m *Request) Unmarshal(data []byte) error {
 					break
 				}
 			}
+		case 18:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Vals", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Vals = append(m.Vals, make([]byte, postIndex-index))
+			copy(m.Vals[len(m.Vals)-1], data[index:postIndex])
+			index = postIndex
 		default:
 			var sizeOfWire int
 			for {
@@ -502,6 +526,12 @@ func (m *Request) Size() (n int) {
 	n += 1 + sovEtcdserver(uint64(m.Time))
 	n += 3
 	n += 2 + sovEtcdserver(uint64(m.StoreId))
+	if len(m.Vals) > 0 {
+		for _, b := range m.Vals {
+			l = len(b)
+			n += 2 + l + sovEtcdserver(uint64(l))
+		}
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -643,6 +673,16 @@ func (m *Request) MarshalTo(data []byte) (n int, err error) {
 	data[i] = 0x1
 	i++
 	i = encodeVarintEtcdserver(data, i, uint64(m.StoreId))
+	if len(m.Vals) > 0 {
+		for _, b := range m.Vals {
+			data[i] = 0x92
+			i++
+			data[i] = 0x1
+			i++
+			i = encodeVarintEtcdserver(data, i, uint64(len(b)))
+			i += copy(data[i:], b)
+		}
+	}
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
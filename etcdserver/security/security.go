@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"path"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/crypto/bcrypt"
@@ -41,6 +42,11 @@ type Store struct {
 	server  doer
 	timeout time.Duration
 	enabled bool
+
+	// tokens holds the tail tokens issued by this member, guarded by
+	// tokensMu.
+	tokensMu sync.Mutex
+	tokens   map[string]tailToken
 }
 
 type User struct {
@@ -59,7 +65,8 @@ type Role struct {
 }
 
 type Permissions struct {
-	KV rwPermission `json:"kv"`
+	KV      rwPermission      `json:"kv"`
+	Streams streamsPermission `json:"streams"`
 }
 
 type rwPermission struct {
@@ -67,6 +74,23 @@ type rwPermission struct {
 	Write []string `json:"write"`
 }
 
+// streamsPermission holds the globs of the stream ids which may be read,
+// appended to and tailed.
+type streamsPermission struct {
+	Read   []string `json:"read"`
+	Append []string `json:"append"`
+	Tail   []string `json:"tail"`
+}
+
+// StreamAccess is a kind of access to a stream.
+type StreamAccess int
+
+const (
+	StreamRead StreamAccess = iota
+	StreamAppend
+	StreamTail
+)
+
 type MergeError struct {
 	errmsg string
 }
@@ -81,6 +105,7 @@ func NewStore(server doer, timeout time.Duration) *Store {
 	s := &Store{
 		server:  server,
 		timeout: timeout,
+		tokens:  make(map[string]tailToken),
 	}
 	s.enabled = s.detectSecurity()
 	return s
@@ -322,6 +347,10 @@ func (r Role) HasKeyAccess(key string, write bool) bool {
 	return r.Permissions.KV.HasAccess(key, write)
 }
 
+func (r Role) HasStreamAccess(id string, access StreamAccess) bool {
+	return r.Permissions.Streams.HasAccess(id, access)
+}
+
 // Grant adds a set of permissions to the permission object on which it is called,
 // returning a new permission object.
 func (p Permissions) Grant(n *Permissions) (Permissions, error) {
@@ -331,6 +360,10 @@ func (p Permissions) Grant(n *Permissions) (Permissions, error) {
 		return p, nil
 	}
 	out.KV, err = p.KV.Grant(n.KV)
+	if err != nil {
+		return out, err
+	}
+	out.Streams, err = p.Streams.Grant(n.Streams)
 	return out, err
 }
 
@@ -343,6 +376,10 @@ func (p Permissions) Revoke(n *Permissions) (Permissions, error) {
 		return p, nil
 	}
 	out.KV, err = p.KV.Revoke(n.KV)
+	if err != nil {
+		return out, err
+	}
+	out.Streams, err = p.Streams.Revoke(n.Streams)
 	return out, err
 }
 
@@ -407,3 +444,74 @@ func (rw rwPermission) HasAccess(key string, write bool) bool {
 	}
 	return false
 }
+
+// Grant adds a set of permissions to the permission object on which it is called,
+// returning a new permission object.
+func (sp streamsPermission) Grant(n streamsPermission) (streamsPermission, error) {
+	var out streamsPermission
+	var err error
+	if out.Read, err = grantGlobs("read", sp.Read, n.Read); err != nil {
+		return out, err
+	}
+	if out.Append, err = grantGlobs("append", sp.Append, n.Append); err != nil {
+		return out, err
+	}
+	out.Tail, err = grantGlobs("tail", sp.Tail, n.Tail)
+	return out, err
+}
+
+// Revoke removes a set of permissions to the permission object on which it is called,
+// returning a new permission object.
+func (sp streamsPermission) Revoke(n streamsPermission) (streamsPermission, error) {
+	var out streamsPermission
+	var err error
+	if out.Read, err = revokeGlobs("read", sp.Read, n.Read); err != nil {
+		return out, err
+	}
+	if out.Append, err = revokeGlobs("append", sp.Append, n.Append); err != nil {
+		return out, err
+	}
+	out.Tail, err = revokeGlobs("tail", sp.Tail, n.Tail)
+	return out, err
+}
+
+func (sp streamsPermission) HasAccess(id string, access StreamAccess) bool {
+	var list []string
+	switch access {
+	case StreamRead:
+		list = sp.Read
+	case StreamAppend:
+		list = sp.Append
+	case StreamTail:
+		list = sp.Tail
+	}
+	for _, pat := range list {
+		match, err := path.Match(pat, id)
+		if err == nil && match {
+			return true
+		}
+	}
+	return false
+}
+
+func grantGlobs(kind string, current, granted []string) ([]string, error) {
+	set := types.NewUnsafeSet(current...)
+	for _, g := range granted {
+		if set.Contains(g) {
+			return nil, mergeErr("Granting duplicate %s permission %s", kind, g)
+		}
+		set.Add(g)
+	}
+	return set.Values(), nil
+}
+
+func revokeGlobs(kind string, current, revoked []string) ([]string, error) {
+	set := types.NewUnsafeSet(current...)
+	for _, r := range revoked {
+		if !set.Contains(r) {
+			return nil, mergeErr("Revoking ungranted %s permission %s", kind, r)
+		}
+		set.Remove(r)
+	}
+	return set.Values(), nil
+}
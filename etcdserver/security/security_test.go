@@ -95,6 +95,7 @@ func TestMergeUser(t *testing.T) {
 }
 
 func TestMergeRole(t *testing.T) {
+	noStreams := streamsPermission{Read: []string{}, Append: []string{}, Tail: []string{}}
 	tbl := []struct {
 		input  Role
 		merge  Role
@@ -109,19 +110,43 @@ func TestMergeRole(t *testing.T) {
 		},
 		{
 			Role{Role: "foo"},
-			Role{Role: "foo", Grant: Permissions{KV: rwPermission{Read: []string{"/foodir"}, Write: []string{"/foodir"}}}},
-			Role{Role: "foo", Permissions: Permissions{KV: rwPermission{Read: []string{"/foodir"}, Write: []string{"/foodir"}}}},
+			Role{Role: "foo", Grant: &Permissions{KV: rwPermission{Read: []string{"/foodir"}, Write: []string{"/foodir"}}}},
+			Role{Role: "foo", Permissions: Permissions{KV: rwPermission{Read: []string{"/foodir"}, Write: []string{"/foodir"}}, Streams: noStreams}},
 			false,
 		},
 		{
 			Role{Role: "foo", Permissions: Permissions{KV: rwPermission{Read: []string{"/foodir"}, Write: []string{"/foodir"}}}},
-			Role{Role: "foo", Revoke: Permissions{KV: rwPermission{Read: []string{"/foodir"}, Write: []string{"/foodir"}}}},
-			Role{Role: "foo", Permissions: Permissions{KV: rwPermission{Read: []string{}, Write: []string{}}}},
+			Role{Role: "foo", Revoke: &Permissions{KV: rwPermission{Read: []string{"/foodir"}, Write: []string{"/foodir"}}}},
+			Role{Role: "foo", Permissions: Permissions{KV: rwPermission{Read: []string{}, Write: []string{}}, Streams: noStreams}},
 			false,
 		},
 		{
 			Role{Role: "foo", Permissions: Permissions{KV: rwPermission{Read: []string{"/bardir"}}}},
-			Role{Role: "foo", Revoke: Permissions{KV: rwPermission{Read: []string{"/foodir"}}}},
+			Role{Role: "foo", Revoke: &Permissions{KV: rwPermission{Read: []string{"/foodir"}}}},
+			Role{},
+			true,
+		},
+		{
+			Role{Role: "foo"},
+			Role{Role: "foo", Grant: &Permissions{Streams: streamsPermission{Read: []string{"logs-*"}, Tail: []string{"logs-*"}}}},
+			Role{Role: "foo", Permissions: Permissions{KV: rwPermission{Read: []string{}, Write: []string{}}, Streams: streamsPermission{Read: []string{"logs-*"}, Append: []string{}, Tail: []string{"logs-*"}}}},
+			false,
+		},
+		{
+			Role{Role: "foo", Permissions: Permissions{Streams: streamsPermission{Append: []string{"logs-*"}}}},
+			Role{Role: "foo", Grant: &Permissions{Streams: streamsPermission{Append: []string{"logs-*"}}}},
+			Role{},
+			true,
+		},
+		{
+			Role{Role: "foo", Permissions: Permissions{Streams: streamsPermission{Append: []string{"logs-*"}, Tail: []string{"logs-*"}}}},
+			Role{Role: "foo", Revoke: &Permissions{Streams: streamsPermission{Append: []string{"logs-*"}}}},
+			Role{Role: "foo", Permissions: Permissions{KV: rwPermission{Read: []string{}, Write: []string{}}, Streams: streamsPermission{Read: []string{}, Append: []string{}, Tail: []string{"logs-*"}}}},
+			false,
+		},
+		{
+			Role{Role: "foo", Permissions: Permissions{Streams: streamsPermission{Tail: []string{"logs-*"}}}},
+			Role{Role: "foo", Revoke: &Permissions{Streams: streamsPermission{Read: []string{"logs-*"}}}},
 			Role{},
 			true,
 		},
@@ -139,6 +164,37 @@ func TestMergeRole(t *testing.T) {
 	}
 }
 
+func TestRoleHasStreamAccess(t *testing.T) {
+	r := Role{
+		Role: "foo",
+		Permissions: Permissions{
+			KV:      rwPermission{Read: []string{"*"}, Write: []string{"*"}},
+			Streams: streamsPermission{Read: []string{"logs-*"}, Append: []string{"logs-app"}, Tail: []string{"logs-*", "metrics"}},
+		},
+	}
+	tests := []struct {
+		id     string
+		access StreamAccess
+
+		w bool
+	}{
+		{"logs-app", StreamRead, true},
+		{"logs-app", StreamAppend, true},
+		{"logs-app", StreamTail, true},
+		{"logs-db", StreamRead, true},
+		{"logs-db", StreamAppend, false},
+		{"metrics", StreamRead, false},
+		{"metrics", StreamTail, true},
+		// KV permissions do not apply to streams
+		{"other", StreamRead, false},
+	}
+	for i, tt := range tests {
+		if g := r.HasStreamAccess(tt.id, tt.access); g != tt.w {
+			t.Errorf("#%d: access = %v, want %v", i, g, tt.w)
+		}
+	}
+}
+
 type testDoer struct {
 	get etcdserver.Response
 }
@@ -267,3 +323,34 @@ func TestGetAndDeleteRole(t *testing.T) {
 		t.Error("Unexpected error", err)
 	}
 }
+
+func TestTailToken(t *testing.T) {
+	s := NewStore(&testDoer{}, time.Second)
+	token, err := s.NewTailToken("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, ok := s.TailTokenUser(token); !ok || user != "foo" {
+		t.Errorf("user = %q, %v, want %q, true", user, ok, "foo")
+	}
+	if _, ok := s.TailTokenUser("bar"); ok {
+		t.Errorf("unknown token accepted")
+	}
+
+	defer func(ttl time.Duration) { TailTokenTTL = ttl }(TailTokenTTL)
+	TailTokenTTL = -time.Second
+	expired, err := s.NewTailToken("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.TailTokenUser(expired); ok {
+		t.Errorf("expired token accepted")
+	}
+	// expired tokens are dropped as others are issued
+	if _, err = s.NewTailToken("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.tokens[expired]; ok {
+		t.Errorf("expired token kept")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// TailTokenTTL is the time for which a tail token is valid.
+var TailTokenTTL = time.Minute
+
+// tailToken records the user a tail token was issued to.
+type tailToken struct {
+	user    string
+	expires time.Time
+}
+
+// NewTailToken issues an opaque token standing for the given user, which
+// has already been authenticated, for TailTokenTTL. Browsers cannot set
+// headers on a websocket handshake or an EventSource, so their tails carry
+// such a token in the URL rather than the credentials of the user. Tokens
+// are held in memory, and are only valid on the member which issued them.
+func (s *Store) NewTailToken(user string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	s.tokensMu.Lock()
+	defer s.tokensMu.Unlock()
+	now := time.Now()
+	for t, tt := range s.tokens {
+		if now.After(tt.expires) {
+			delete(s.tokens, t)
+		}
+	}
+	s.tokens[token] = tailToken{user: user, expires: now.Add(TailTokenTTL)}
+	return token, nil
+}
+
+// TailTokenUser returns the user the given token was issued to, if it has
+// not expired.
+func (s *Store) TailTokenUser(token string) (string, bool) {
+	s.tokensMu.Lock()
+	defer s.tokensMu.Unlock()
+	tt, ok := s.tokens[token]
+	if !ok || time.Now().After(tt.expires) {
+		return "", false
+	}
+	return tt.user, true
+}
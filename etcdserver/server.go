@@ -21,8 +21,10 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
 	"path"
 	"regexp"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -92,7 +94,15 @@ func init() {
 type Response struct {
 	Event   *store.Event
 	Watcher store.Watcher
-	err     error
+	Streams []*store.StreamInfo
+	Cursors []*store.CursorInfo
+	// Entry is the stream entry read by a GET on its offset.
+	Entry *streams.Entry
+	// Range holds the entries read by a GET on a stream with range options.
+	Range *streams.Range
+	// Hashes holds the hashes of the streams read by a HASH.
+	Hashes *store.StreamHashes
+	err   error
 }
 
 type Server interface {
@@ -111,7 +121,8 @@ type Server interface {
 	// Do takes a request and attempts to fulfill it, returning a Response.
 	Do(ctx context.Context, r pb.Request) (Response, error)
 	// Do takes a request and attempts to fulfill it, streaming responses
-	DoStream(r pb.Request, listener streams.StreamListener)
+	// to the listener until ctx is done or the server stops.
+	DoStream(ctx context.Context, r pb.Request, options streams.TailOptions, listener streams.StreamListener)
 	// Process takes a raft message and applies it to the server's raft state
 	// machine, respecting any timeout of the given context.
 	Process(ctx context.Context, m raftpb.Message) error
@@ -158,7 +169,11 @@ type EtcdServer struct {
 // NewServer creates a new EtcdServer from the supplied configuration. The
 // configuration is considered static for the lifetime of the EtcdServer.
 func NewServer(cfg *ServerConfig) (*EtcdServer, error) {
-	st := store.New(cfg.StreamsDir(), StoreAdminPrefix, StoreKeysPrefix)
+	streamsCfg, err := cfg.streamsConfig()
+	if err != nil {
+		return nil, err
+	}
+	st := store.NewWithStreams(cfg.StreamsDir(), streamsCfg, StoreAdminPrefix, StoreKeysPrefix)
 	var w *wal.WAL
 	var n raft.Node
 	var s *raft.MemoryStorage
@@ -232,11 +247,19 @@ func NewServer(cfg *ServerConfig) (*EtcdServer, error) {
 		if err != nil && err != snap.ErrNoSnapshot {
 			return nil, err
 		}
+		if err := os.MkdirAll(cfg.StreamsDir(), privateDirMode); err != nil {
+			return nil, fmt.Errorf("cannot create streams directory: %v", err)
+		}
 		if snapshot != nil {
 			if err := st.Recovery(snapshot.Data); err != nil {
 				log.Panicf("etcdserver: recovered store from snapshot error: %v", err)
 			}
+			st.StreamCheckpoint(snapshot.Metadata.Index)
 			log.Printf("etcdserver: recovered store from snapshot at index %d", snapshot.Metadata.Index)
+		} else if err := resetStreamsDir(cfg.StreamsDir()); err != nil {
+			return nil, fmt.Errorf("cannot reset streams directory: %v", err)
+		} else {
+			st.StreamCheckpoint(0)
 		}
 		cfg.Cluster = NewClusterFromStore(cfg.Cluster.token, st)
 		cfg.Print()
@@ -382,6 +405,7 @@ func (s *EtcdServer) run() {
 				if err := s.store.Recovery(apply.snapshot.Data); err != nil {
 					log.Panicf("recovery store error: %v", err)
 				}
+				s.store.StreamCheckpoint(apply.snapshot.Metadata.Index)
 
 				// Avoid snapshot recovery overwriting newer cluster and
 				// transport setting, which may block the communication.
@@ -464,6 +488,14 @@ func (s *EtcdServer) Do(ctx context.Context, r pb.Request) (Response, error) {
 	if r.Method == "GET" && r.Quorum {
 		r.Method = "QGET"
 	}
+	if r.StoreId == StoreStreamsId && r.Method == "POST" {
+		// The time of an append is used for age based retention, so it
+		// must be agreed on through raft.
+		r.Time = time.Now().UnixNano()
+		if err := s.store.StreamCheckQuota(r.Path, streamAppendBytes(r)); err != nil {
+			return Response{}, err
+		}
+	}
 	switch r.Method {
 	case "POST", "PUT", "DELETE", "QGET":
 		data, err := r.Marshal()
@@ -495,11 +527,15 @@ func (s *EtcdServer) Do(ctx context.Context, r pb.Request) (Response, error) {
 	case "GET":
 		switch {
 		case r.Wait:
+			// the events of both stores are watched alike
 			wc, err := s.store.Watch(r.Path, r.Recursive, r.Stream, r.Since)
 			if err != nil {
 				return Response{}, err
 			}
 			return Response{Watcher: wc}, nil
+		case r.StoreId == StoreStreamsId:
+			resp := s.applyStreamsGet(r)
+			return resp, resp.err
 		default:
 			ev, err := s.store.Get(r.Path, r.Recursive, r.Sorted)
 			if err != nil {
@@ -507,6 +543,14 @@ func (s *EtcdServer) Do(ctx context.Context, r pb.Request) (Response, error) {
 			}
 			return Response{Event: ev}, nil
 		}
+	case "HASH":
+		// every member hashes its own copy of the streams, as of the index
+		// given in Since
+		hs, err := s.store.StreamHashes(r.Path, r.Since)
+		if err != nil {
+			return Response{}, err
+		}
+		return Response{Hashes: hs}, nil
 	case "HEAD":
 		ev, err := s.store.Get(r.Path, r.Recursive, r.Sorted)
 		if err != nil {
@@ -519,10 +563,20 @@ func (s *EtcdServer) Do(ctx context.Context, r pb.Request) (Response, error) {
 }
 
 
-func (s *EtcdServer) DoStream(r pb.Request, listener streams.StreamListener) {
+func (s *EtcdServer) DoStream(ctx context.Context, r pb.Request, options streams.TailOptions, listener streams.StreamListener) {
 	if r.StoreId == StoreStreamsId {
 		if r.Method == "TAIL" {
-			s.store.StreamTail(r.Path, listener)
+			// stopping the server ends all tails
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			go func() {
+				select {
+				case <-s.done:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			s.store.StreamTail(ctx, r.Path, options, listener)
 			return
 		}
 	}
@@ -530,6 +584,10 @@ func (s *EtcdServer) DoStream(r pb.Request, listener streams.StreamListener) {
 	listener.End(ErrUnknownMethod)
 }
 
+// StreamsMaxEntryBytes returns the size of the largest entry which can be
+// appended to a stream, or zero if there is no limit.
+func (s *EtcdServer) StreamsMaxEntryBytes() int64 { return s.cfg.StreamsMaxEntryBytes }
+
 func (s *EtcdServer) SelfStats() []byte { return s.stats.JSON() }
 
 func (s *EtcdServer) LeaderStats() []byte {
@@ -700,6 +758,7 @@ func (s *EtcdServer) apply(es []raftpb.Entry, confState *raftpb.ConfState) (uint
 		default:
 			log.Panicf("entry type should be either EntryNormal or EntryConfChange")
 		}
+		s.store.StreamCheckpoint(e.Index)
 		atomic.StoreUint64(&s.r.index, e.Index)
 		atomic.StoreUint64(&s.r.term, e.Term)
 		applied = e.Index
@@ -717,9 +776,50 @@ func (s *EtcdServer) applyRequest(r pb.Request) Response {
 	if r.StoreId == StoreStreamsId {
 		switch r.Method {
 		case "POST":
-			return f(s.store.StreamAppend(r.Path, []byte(r.Val)))
+			now := time.Unix(0, r.Time)
+			// PrevValue holds the expected tail of a conditional append
+			if r.PrevValue != "" {
+				prevTail, err := strconv.ParseInt(r.PrevValue, 16, 64)
+				if err != nil {
+					return Response{err: err}
+				}
+				if len(r.Vals) > 0 {
+					return f(s.store.StreamCompareAndAppendBatch(r.Path, prevTail, r.Vals, now))
+				}
+				return f(s.store.StreamCompareAndAppend(r.Path, prevTail, []byte(r.Val), now))
+			}
+			if len(r.Vals) > 0 {
+				return f(s.store.StreamAppendBatch(r.Path, r.Vals, now))
+			}
+			return f(s.store.StreamAppend(r.Path, []byte(r.Val), now))
+		case "PUT":
+			// A PUT on a cursor commits the offset held in Val
+			if _, _, ok := store.SplitStreamCursorPath(r.Path); ok {
+				offset, err := strconv.ParseInt(r.Val, 16, 64)
+				if err != nil {
+					return Response{err: err}
+				}
+				return f(s.store.StreamCommitCursor(r.Path, offset))
+			}
+			var policy streams.RetentionPolicy
+			if err := json.Unmarshal([]byte(r.Val), &policy); err != nil {
+				return Response{err: err}
+			}
+			return f(s.store.StreamSetRetention(r.Path, policy))
+		case "DELETE":
+			if _, _, ok := store.SplitStreamCursorPath(r.Path); ok {
+				return f(s.store.StreamDeleteCursor(r.Path))
+			}
+			if r.Val != "" {
+				before, err := strconv.ParseInt(r.Val, 16, 64)
+				if err != nil {
+					return Response{err: err}
+				}
+				return f(s.store.StreamTrim(r.Path, before))
+			}
+			return f(s.store.StreamDelete(r.Path))
 		case "QGET":
-			return f(s.store.StreamGet(r.Path))
+			return s.applyStreamsGet(r)
 		case "SYNC":
 			s.store.DeleteExpiredKeys(time.Unix(0, r.Time))
 			return Response{}
@@ -769,6 +869,7 @@ func (s *EtcdServer) applyRequest(r pb.Request) Response {
 		return f(s.store.Get(r.Path, r.Recursive, r.Sorted))
 	case "SYNC":
 		s.store.DeleteExpiredKeys(time.Unix(0, r.Time))
+		s.store.StreamRetain(time.Unix(0, r.Time))
 		return Response{}
 	default:
 		// This should never be reached, but just in case:
@@ -776,6 +877,44 @@ func (s *EtcdServer) applyRequest(r pb.Request) Response {
 	}
 }
 
+// streamAppendBytes returns the bytes the append r adds to its stream,
+// entry headers included.
+func streamAppendBytes(r pb.Request) int64 {
+	if len(r.Vals) == 0 {
+		return streams.EntryHeaderLength + int64(len(r.Val))
+	}
+	var n int64
+	for _, v := range r.Vals {
+		n += streams.EntryHeaderLength + int64(len(v))
+	}
+	return n
+}
+
+// applyStreamsGet serves a GET on the streams store: a listing of the
+// streams when r.Path is the streams root, the consumer cursors of a stream,
+// or a single stream entry.
+func (s *EtcdServer) applyStreamsGet(r pb.Request) Response {
+	if r.Path == StoreStreamsPrefix {
+		infos, err := s.store.StreamList()
+		return Response{Streams: infos, err: err}
+	}
+	if _, _, ok := store.SplitStreamCursorPath(r.Path); ok {
+		infos, err := s.store.StreamCursors(r.Path)
+		return Response{Cursors: infos, err: err}
+	}
+	if r.Val != "" {
+		// a range read carries its options as JSON
+		var options streams.RangeOptions
+		if err := json.Unmarshal([]byte(r.Val), &options); err != nil {
+			return Response{err: err}
+		}
+		rng, err := s.store.StreamReadRange(r.Path, options)
+		return Response{Range: rng, err: err}
+	}
+	ev, entry, err := s.store.StreamGetEntry(r.Path)
+	return Response{Event: ev, Entry: entry, err: err}
+}
+
 // applyConfChange applies a ConfChange to the server at the given index. It is only
 // invoked with a ConfChange that has already passed through Raft.
 func (s *EtcdServer) applyConfChange(cc raftpb.ConfChange, confState *raftpb.ConfState, index uint64) (bool, error) {
@@ -36,6 +36,7 @@ import (
 	"github.com/coreos/etcd/raft"
 	"github.com/coreos/etcd/raft/raftpb"
 	"github.com/coreos/etcd/store"
+	"github.com/coreos/etcd/store/streams"
 )
 
 // TestDoLocalAction tests requests which do not need to go through raft to be applied,
@@ -52,6 +53,10 @@ func TestDoLocalAction(t *testing.T) {
 			pb.Request{Method: "GET", ID: 1, Wait: true},
 			Response{Watcher: &nopWatcher{}}, nil, []testutil.Action{{Name: "Watch"}},
 		},
+		{
+			pb.Request{Method: "GET", ID: 1, StoreId: StoreStreamsId, Path: "/2/foo", Wait: true, Recursive: true},
+			Response{Watcher: &nopWatcher{}}, nil, []testutil.Action{{Name: "Watch"}},
+		},
 		{
 			pb.Request{Method: "GET", ID: 1},
 			Response{Event: &store.Event{}}, nil,
@@ -72,6 +77,16 @@ func TestDoLocalAction(t *testing.T) {
 				},
 			},
 		},
+		{
+			pb.Request{Method: "HASH", ID: 1, StoreId: StoreStreamsId, Path: "/2", Since: 5},
+			Response{Hashes: &store.StreamHashes{}}, nil,
+			[]testutil.Action{
+				{
+					Name:   "StreamHashes",
+					Params: []interface{}{"/2", uint64(5)},
+				},
+			},
+		},
 		{
 			pb.Request{Method: "BADMETHOD", ID: 1},
 			Response{}, ErrUnknownMethod, []testutil.Action{},
@@ -129,6 +144,25 @@ func TestDoBadLocalAction(t *testing.T) {
 				},
 			},
 		},
+		// an append over quota is not proposed
+		{
+			pb.Request{Method: "POST", ID: 1, StoreId: StoreStreamsId, Path: "/2/foo", Val: "bar"},
+			[]testutil.Action{
+				{
+					Name:   "StreamCheckQuota",
+					Params: []interface{}{"/2/foo", int64(11)},
+				},
+			},
+		},
+		{
+			pb.Request{Method: "POST", ID: 1, StoreId: StoreStreamsId, Path: "/2/foo", Vals: [][]byte{[]byte("a"), []byte("bc")}},
+			[]testutil.Action{
+				{
+					Name:   "StreamCheckQuota",
+					Params: []interface{}{"/2/foo", int64(19)},
+				},
+			},
+		},
 	}
 	for i, tt := range tests {
 		st := &errStoreRecorder{err: storeErr}
@@ -345,7 +379,7 @@ func TestApplyRequest(t *testing.T) {
 				},
 			},
 		},
-		// SYNC ==> DeleteExpiredKeys
+		// SYNC ==> DeleteExpiredKeys, StreamRetain
 		{
 			pb.Request{Method: "SYNC", ID: 1},
 			Response{},
@@ -354,6 +388,10 @@ func TestApplyRequest(t *testing.T) {
 					Name:   "DeleteExpiredKeys",
 					Params: []interface{}{time.Unix(0, 0)},
 				},
+				{
+					Name:   "StreamRetain",
+					Params: []interface{}{time.Unix(0, 0)},
+				},
 			},
 		},
 		{
@@ -364,6 +402,10 @@ func TestApplyRequest(t *testing.T) {
 					Name:   "DeleteExpiredKeys",
 					Params: []interface{}{time.Unix(0, 12345)},
 				},
+				{
+					Name:   "StreamRetain",
+					Params: []interface{}{time.Unix(0, 12345)},
+				},
 			},
 		},
 		// Unknown method - error
@@ -372,6 +414,146 @@ func TestApplyRequest(t *testing.T) {
 			Response{err: ErrUnknownMethod},
 			[]testutil.Action{},
 		},
+		// POST on streams ==> StreamAppend
+		{
+			pb.Request{Method: "POST", ID: 1, StoreId: StoreStreamsId, Path: "/2/foo", Val: "bar", Time: 12345},
+			Response{Event: &store.Event{}},
+			[]testutil.Action{
+				{
+					Name:   "StreamAppend",
+					Params: []interface{}{"/2/foo", []byte("bar"), time.Unix(0, 12345)},
+				},
+			},
+		},
+		// POST on streams with a batch ==> StreamAppendBatch
+		{
+			pb.Request{Method: "POST", ID: 1, StoreId: StoreStreamsId, Path: "/2/foo", Vals: [][]byte{[]byte("a"), []byte("b")}, Time: 12345},
+			Response{Event: &store.Event{}},
+			[]testutil.Action{
+				{
+					Name:   "StreamAppendBatch",
+					Params: []interface{}{"/2/foo", [][]byte{[]byte("a"), []byte("b")}, time.Unix(0, 12345)},
+				},
+			},
+		},
+		// POST on streams with an expected tail ==> StreamCompareAndAppend
+		{
+			pb.Request{Method: "POST", ID: 1, StoreId: StoreStreamsId, Path: "/2/foo", Val: "bar", PrevValue: "1a", Time: 12345},
+			Response{Event: &store.Event{}},
+			[]testutil.Action{
+				{
+					Name:   "StreamCompareAndAppend",
+					Params: []interface{}{"/2/foo", int64(0x1a), []byte("bar"), time.Unix(0, 12345)},
+				},
+			},
+		},
+		// POST on streams with a batch and an expected tail ==> StreamCompareAndAppendBatch
+		{
+			pb.Request{Method: "POST", ID: 1, StoreId: StoreStreamsId, Path: "/2/foo", Vals: [][]byte{[]byte("a")}, PrevValue: "0", Time: 12345},
+			Response{Event: &store.Event{}},
+			[]testutil.Action{
+				{
+					Name:   "StreamCompareAndAppendBatch",
+					Params: []interface{}{"/2/foo", int64(0), [][]byte{[]byte("a")}, time.Unix(0, 12345)},
+				},
+			},
+		},
+		// PUT on streams ==> StreamSetRetention
+		{
+			pb.Request{Method: "PUT", ID: 1, StoreId: StoreStreamsId, Path: "/2/foo", Val: `{"maxBytes":10}`},
+			Response{Event: &store.Event{}},
+			[]testutil.Action{
+				{
+					Name:   "StreamSetRetention",
+					Params: []interface{}{"/2/foo", streams.RetentionPolicy{MaxBytes: 10}},
+				},
+			},
+		},
+		// DELETE on streams with an offset ==> StreamTrim
+		{
+			pb.Request{Method: "DELETE", ID: 1, StoreId: StoreStreamsId, Path: "/2/foo", Val: "1a"},
+			Response{Event: &store.Event{}},
+			[]testutil.Action{
+				{
+					Name:   "StreamTrim",
+					Params: []interface{}{"/2/foo", int64(26)},
+				},
+			},
+		},
+		// DELETE on streams ==> StreamDelete
+		{
+			pb.Request{Method: "DELETE", ID: 1, StoreId: StoreStreamsId, Path: "/2/foo"},
+			Response{Event: &store.Event{}},
+			[]testutil.Action{
+				{
+					Name:   "StreamDelete",
+					Params: []interface{}{"/2/foo"},
+				},
+			},
+		},
+		// PUT on a stream cursor ==> StreamCommitCursor
+		{
+			pb.Request{Method: "PUT", ID: 1, StoreId: StoreStreamsId, Path: "/2/foo/cursors/bar", Val: "1a"},
+			Response{Event: &store.Event{}},
+			[]testutil.Action{
+				{
+					Name:   "StreamCommitCursor",
+					Params: []interface{}{"/2/foo/cursors/bar", int64(26)},
+				},
+			},
+		},
+		// DELETE on a stream cursor ==> StreamDeleteCursor
+		{
+			pb.Request{Method: "DELETE", ID: 1, StoreId: StoreStreamsId, Path: "/2/foo/cursors/bar"},
+			Response{Event: &store.Event{}},
+			[]testutil.Action{
+				{
+					Name:   "StreamDeleteCursor",
+					Params: []interface{}{"/2/foo/cursors/bar"},
+				},
+			},
+		},
+		// QGET on stream cursors ==> StreamCursors
+		{
+			pb.Request{Method: "QGET", ID: 1, StoreId: StoreStreamsId, Path: "/2/foo/cursors"},
+			Response{Cursors: []*store.CursorInfo{}},
+			[]testutil.Action{
+				{
+					Name:   "StreamCursors",
+					Params: []interface{}{"/2/foo/cursors"},
+				},
+			},
+		},
+		// QGET on streams root ==> StreamList
+		{
+			pb.Request{Method: "QGET", ID: 1, StoreId: StoreStreamsId, Path: StoreStreamsPrefix},
+			Response{Streams: []*store.StreamInfo{}},
+			[]testutil.Action{
+				{Name: "StreamList"},
+			},
+		},
+		// QGET on a stream with range options ==> StreamReadRange
+		{
+			pb.Request{Method: "QGET", ID: 1, StoreId: StoreStreamsId, Path: "/2/foo", Val: `{"from":9,"limit":2}`},
+			Response{Range: &streams.Range{}},
+			[]testutil.Action{
+				{
+					Name:   "StreamReadRange",
+					Params: []interface{}{"/2/foo", streams.RangeOptions{From: 9, Limit: 2}},
+				},
+			},
+		},
+		// QGET on a stream entry ==> StreamGetEntry
+		{
+			pb.Request{Method: "QGET", ID: 1, StoreId: StoreStreamsId, Path: "/2/foo/0"},
+			Response{Event: &store.Event{}, Entry: &streams.Entry{}},
+			[]testutil.Action{
+				{
+					Name:   "StreamGetEntry",
+					Params: []interface{}{"/2/foo/0"},
+				},
+			},
+		},
 	}
 
 	for i, tt := range tests {
@@ -408,9 +590,92 @@ func TestApplyRequestOnAdminMemberAttributes(t *testing.T) {
 	}
 }
 
+// TestApplyStreamCheckpoint ensures that the streams are hashed as of
+// the entries applied.
+func TestApplyStreamCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "etcdserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st := store.New(dir)
+	st.StreamCheckpoint(0)
+	srv := &EtcdServer{
+		store: st,
+		w:     &waitRecorder{},
+	}
+	var ents []raftpb.Entry
+	for i, v := range []string{"a", "bb"} {
+		req := pb.Request{Method: "POST", ID: uint64(i), StoreId: StoreStreamsId, Path: "/2/foo", Val: v}
+		ents = append(ents, raftpb.Entry{Index: uint64(i + 1), Data: pbutil.MustMarshal(&req)})
+	}
+	srv.apply(ents, &raftpb.ConfState{})
+
+	for i, wtail := range []int64{9, 19} {
+		hs, err := st.StreamHashes("/2", uint64(i+1))
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if len(hs.Streams) != 1 || hs.Streams[0].Tail != wtail {
+			t.Errorf("#%d: hashes = %+v, want foo at tail %d", i, hs.Streams, wtail)
+		}
+	}
+}
+
+// TestApplyStreamIndex ensures that the events of the streams take the raft
+// index of the entry applying them.
+func TestApplyStreamIndex(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "etcdserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st := store.New(dir)
+	st.StreamCheckpoint(0)
+	srv := &EtcdServer{
+		store: st,
+		w:     &waitRecorder{},
+	}
+	reqs := []pb.Request{
+		{Method: "POST", ID: 1, StoreId: StoreStreamsId, Path: "/2/foo", Val: "a"},
+		{Method: "PUT", ID: 2, Path: "/1/foo", Val: "bar"},
+		{Method: "POST", ID: 3, StoreId: StoreStreamsId, Path: "/2/foo", Val: "b"},
+	}
+	var ents []raftpb.Entry
+	for i := range reqs {
+		ents = append(ents, raftpb.Entry{Index: uint64(i + 1), Data: pbutil.MustMarshal(&reqs[i])})
+	}
+	srv.apply(ents, &raftpb.ConfState{})
+
+	tests := []struct {
+		since  uint64
+		windex uint64
+	}{
+		{1, 1},
+		{2, 3},
+	}
+	for i, tt := range tests {
+		w, err := st.Watch("/2/foo", true, false, tt.since)
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		select {
+		case ev := <-w.EventChan():
+			if ev.Node.ModifiedIndex != tt.windex {
+				t.Errorf("#%d: index = %d, want %d", i, ev.Node.ModifiedIndex, tt.windex)
+			}
+		default:
+			t.Errorf("#%d: no event", i)
+		}
+	}
+	if g := st.Index(); g != 1 {
+		t.Errorf("store index = %d, want 1", g)
+	}
+}
+
 func TestApplyConfChangeError(t *testing.T) {
 	cl := newCluster("")
-	cl.SetStore(store.New())
+	cl.SetStore(store.New(""))
 	cl.SetTransport(&nopTransporter{})
 	for i := 1; i <= 4; i++ {
 		cl.AddMember(&Member{ID: types.ID(i)}, uint64(i))
@@ -475,7 +740,7 @@ func TestApplyConfChangeError(t *testing.T) {
 
 func TestApplyConfChangeShouldStop(t *testing.T) {
 	cl := newCluster("")
-	cl.SetStore(store.New())
+	cl.SetStore(store.New(""))
 	cl.SetTransport(&nopTransporter{})
 	for i := 1; i <= 3; i++ {
 		cl.AddMember(&Member{ID: types.ID(i)}, uint64(i))
@@ -773,7 +1038,7 @@ func TestRecvSnapshot(t *testing.T) {
 	st := &storeRecorder{}
 	p := &storageRecorder{}
 	cl := newCluster("abc")
-	cl.SetStore(store.New())
+	cl.SetStore(store.New(""))
 	cl.SetTransport(&nopTransporter{})
 	s := &EtcdServer{
 		r: raftNode{
@@ -808,7 +1073,7 @@ func TestApplySnapshotAndCommittedEntries(t *testing.T) {
 	n := newReadyNode()
 	st := &storeRecorder{}
 	cl := newCluster("abc")
-	cl.SetStore(store.New())
+	cl.SetStore(store.New(""))
 	cl.SetTransport(&nopTransporter{})
 	storage := raft.NewMemoryStorage()
 	s := &EtcdServer{
@@ -853,7 +1118,7 @@ func TestAddMember(t *testing.T) {
 		SoftState: &raft.SoftState{RaftState: raft.StateLeader},
 	}
 	cl := newTestCluster(nil)
-	st := store.New()
+	st := store.New("")
 	cl.SetStore(st)
 	cl.SetTransport(&nopTransporter{})
 	s := &EtcdServer{
@@ -892,8 +1157,8 @@ func TestRemoveMember(t *testing.T) {
 		SoftState: &raft.SoftState{RaftState: raft.StateLeader},
 	}
 	cl := newTestCluster(nil)
-	st := store.New()
-	cl.SetStore(store.New())
+	st := store.New("")
+	cl.SetStore(store.New(""))
 	cl.SetTransport(&nopTransporter{})
 	s := &EtcdServer{
 		r: raftNode{
@@ -936,7 +1201,7 @@ func TestUpdateMember(t *testing.T) {
 		SoftState: &raft.SoftState{RaftState: raft.StateLeader},
 	}
 	cl := newTestCluster(nil)
-	st := store.New()
+	st := store.New("")
 	cl.SetStore(st)
 	cl.SetTransport(&nopTransporter{})
 	s := &EtcdServer{
@@ -1183,6 +1448,132 @@ func (s *storeRecorder) Watch(_ string, _, _ bool, _ uint64) (store.Watcher, err
 	s.Record(testutil.Action{Name: "Watch"})
 	return &nopWatcher{}, nil
 }
+func (s *storeRecorder) StreamAppend(path string, val []byte, now time.Time) (*store.Event, error) {
+	s.Record(testutil.Action{
+		Name:   "StreamAppend",
+		Params: []interface{}{path, val, now},
+	})
+	return &store.Event{}, nil
+}
+func (s *storeRecorder) StreamAppendBatch(path string, vals [][]byte, now time.Time) (*store.Event, error) {
+	s.Record(testutil.Action{
+		Name:   "StreamAppendBatch",
+		Params: []interface{}{path, vals, now},
+	})
+	return &store.Event{}, nil
+}
+func (s *storeRecorder) StreamCompareAndAppend(path string, prevTail int64, val []byte, now time.Time) (*store.Event, error) {
+	s.Record(testutil.Action{
+		Name:   "StreamCompareAndAppend",
+		Params: []interface{}{path, prevTail, val, now},
+	})
+	return &store.Event{}, nil
+}
+func (s *storeRecorder) StreamCompareAndAppendBatch(path string, prevTail int64, vals [][]byte, now time.Time) (*store.Event, error) {
+	s.Record(testutil.Action{
+		Name:   "StreamCompareAndAppendBatch",
+		Params: []interface{}{path, prevTail, vals, now},
+	})
+	return &store.Event{}, nil
+}
+func (s *storeRecorder) StreamGet(path string) (*store.Event, error) {
+	s.Record(testutil.Action{
+		Name:   "StreamGet",
+		Params: []interface{}{path},
+	})
+	return &store.Event{}, nil
+}
+func (s *storeRecorder) StreamGetEntry(path string) (*store.Event, *streams.Entry, error) {
+	s.Record(testutil.Action{
+		Name:   "StreamGetEntry",
+		Params: []interface{}{path},
+	})
+	return &store.Event{}, &streams.Entry{}, nil
+}
+func (s *storeRecorder) StreamReadRange(path string, options streams.RangeOptions) (*streams.Range, error) {
+	s.Record(testutil.Action{
+		Name:   "StreamReadRange",
+		Params: []interface{}{path, options},
+	})
+	return &streams.Range{}, nil
+}
+func (s *storeRecorder) StreamList() ([]*store.StreamInfo, error) {
+	s.Record(testutil.Action{Name: "StreamList"})
+	return []*store.StreamInfo{}, nil
+}
+func (s *storeRecorder) StreamDelete(path string) (*store.Event, error) {
+	s.Record(testutil.Action{
+		Name:   "StreamDelete",
+		Params: []interface{}{path},
+	})
+	return &store.Event{}, nil
+}
+func (s *storeRecorder) StreamTrim(path string, before int64) (*store.Event, error) {
+	s.Record(testutil.Action{
+		Name:   "StreamTrim",
+		Params: []interface{}{path, before},
+	})
+	return &store.Event{}, nil
+}
+func (s *storeRecorder) StreamSetRetention(path string, policy streams.RetentionPolicy) (*store.Event, error) {
+	s.Record(testutil.Action{
+		Name:   "StreamSetRetention",
+		Params: []interface{}{path, policy},
+	})
+	return &store.Event{}, nil
+}
+func (s *storeRecorder) StreamRetain(now time.Time) {
+	s.Record(testutil.Action{
+		Name:   "StreamRetain",
+		Params: []interface{}{now},
+	})
+}
+func (s *storeRecorder) StreamCommitCursor(path string, offset int64) (*store.Event, error) {
+	s.Record(testutil.Action{
+		Name:   "StreamCommitCursor",
+		Params: []interface{}{path, offset},
+	})
+	return &store.Event{}, nil
+}
+func (s *storeRecorder) StreamDeleteCursor(path string) (*store.Event, error) {
+	s.Record(testutil.Action{
+		Name:   "StreamDeleteCursor",
+		Params: []interface{}{path},
+	})
+	return &store.Event{}, nil
+}
+func (s *storeRecorder) StreamCursors(path string) ([]*store.CursorInfo, error) {
+	s.Record(testutil.Action{
+		Name:   "StreamCursors",
+		Params: []interface{}{path},
+	})
+	return []*store.CursorInfo{}, nil
+}
+func (s *storeRecorder) StreamTail(_ context.Context, path string, options streams.TailOptions, listener streams.StreamListener) {
+	s.Record(testutil.Action{
+		Name:   "StreamTail",
+		Params: []interface{}{path, options},
+	})
+	listener.End(nil)
+}
+
+// StreamCheckpoint is called once every entry is applied, so it is left
+// out of the recorded actions.
+func (s *storeRecorder) StreamCheckpoint(index uint64) {}
+func (s *storeRecorder) StreamHashes(path string, index uint64) (*store.StreamHashes, error) {
+	s.Record(testutil.Action{
+		Name:   "StreamHashes",
+		Params: []interface{}{path, index},
+	})
+	return &store.StreamHashes{}, nil
+}
+func (s *storeRecorder) StreamCheckQuota(path string, n int64) error {
+	s.Record(testutil.Action{
+		Name:   "StreamCheckQuota",
+		Params: []interface{}{path, n},
+	})
+	return nil
+}
 func (s *storeRecorder) Save() ([]byte, error) {
 	s.Record(testutil.Action{Name: "Save"})
 	return nil, nil
@@ -1217,7 +1608,7 @@ func (w *nopWatcher) StartIndex() uint64           { return 0 }
 func (w *nopWatcher) Remove()                      {}
 
 // errStoreRecorder is a storeRecorder, but returns the given error on
-// Get, Watch methods.
+// Get, Watch and StreamCheckQuota methods.
 type errStoreRecorder struct {
 	storeRecorder
 	err error
@@ -1227,6 +1618,10 @@ func (s *errStoreRecorder) Get(path string, recursive, sorted bool) (*store.Even
 	s.storeRecorder.Get(path, recursive, sorted)
 	return nil, s.err
 }
+func (s *errStoreRecorder) StreamCheckQuota(path string, n int64) error {
+	s.storeRecorder.StreamCheckQuota(path, n)
+	return s.err
+}
 func (s *errStoreRecorder) Watch(path string, recursive, sorted bool, index uint64) (store.Watcher, error) {
 	s.storeRecorder.Watch(path, recursive, sorted, index)
 	return nil, s.err
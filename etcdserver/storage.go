@@ -22,6 +22,7 @@ import (
 
 	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
 	"github.com/coreos/etcd/migrate"
+	"github.com/coreos/etcd/pkg/fileutil"
 	"github.com/coreos/etcd/pkg/pbutil"
 	"github.com/coreos/etcd/pkg/types"
 	"github.com/coreos/etcd/raft/raftpb"
@@ -152,3 +153,19 @@ func makeMemberDir(dir string) error {
 	}
 	return nil
 }
+
+// resetStreamsDir removes the contents of the streams directory. It is used
+// when the whole raft log is replayed, which rebuilds every stream from
+// empty.
+func resetStreamsDir(dir string) error {
+	names, err := fileutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := os.RemoveAll(path.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
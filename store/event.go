@@ -23,6 +23,7 @@ const (
 	CompareAndSwap   = "compareAndSwap"
 	CompareAndDelete = "compareAndDelete"
 	Expire           = "expire"
+	Trim             = "trim"
 )
 
 type Event struct {
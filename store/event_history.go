@@ -17,6 +17,7 @@ package store
 import (
 	"fmt"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 
@@ -44,15 +45,34 @@ func (eh *EventHistory) addEvent(e *Event) *Event {
 	eh.rwl.Lock()
 	defer eh.rwl.Unlock()
 
+	if eh.Queue.Size == eh.Queue.Capacity {
+		// the event at the front is dropped, and with it the history up to
+		// its index
+		eh.StartIndex = eh.Queue.Events[eh.Queue.Front].Index() + 1
+	} else if eh.Queue.Size == 0 && eh.StartIndex == 0 {
+		eh.StartIndex = e.Index()
+	}
+
 	eh.Queue.insert(e)
 
 	eh.LastIndex = e.Index()
 
-	eh.StartIndex = eh.Queue.Events[eh.Queue.Front].Index()
-
 	return e
 }
 
+// reset drops the events of the history, which starts again at index.
+func (eh *EventHistory) reset(index uint64) {
+	eh.rwl.Lock()
+	defer eh.rwl.Unlock()
+
+	eh.Queue = eventQueue{
+		Capacity: eh.Queue.Capacity,
+		Events:   make([]*Event, eh.Queue.Capacity),
+	}
+	eh.StartIndex = index
+	eh.LastIndex = 0
+}
+
 // scan enumerates events from the index history and stops at the first point
 // where the key matches.
 func (eh *EventHistory) scan(key string, recursive bool, index uint64) (*Event, *etcdErr.Error) {
@@ -72,8 +92,13 @@ func (eh *EventHistory) scan(key string, recursive bool, index uint64) (*Event,
 		return nil, nil
 	}
 
-	offset := index - eh.StartIndex
-	i := (eh.Queue.Front + int(offset)) % eh.Queue.Capacity
+	// the indexes of the events increase, but are not consecutive in the
+	// history of the streams, so the first event at or after index is
+	// searched for
+	offset := sort.Search(eh.Queue.Size, func(i int) bool {
+		return eh.Queue.Events[(eh.Queue.Front+i)%eh.Queue.Capacity].Index() >= index
+	})
+	i := (eh.Queue.Front + offset) % eh.Queue.Capacity
 
 	for {
 		e := eh.Queue.Events[i]
@@ -79,6 +79,37 @@ func TestScanHistory(t *testing.T) {
 	}
 }
 
+// TestScanSparseHistory tests scanning a history whose events do not have
+// consecutive indexes, as the history of the streams.
+func TestScanSparseHistory(t *testing.T) {
+	eh := newEventHistory(3)
+	eh.reset(3)
+
+	eh.addEvent(newEvent(Create, "/foo", 4, 4))
+	eh.addEvent(newEvent(Create, "/foo", 7, 7))
+	eh.addEvent(newEvent(Create, "/bar", 8, 8))
+
+	e, err := eh.scan("/foo", false, 5)
+	if err != nil || e.Index() != 7 {
+		t.Fatalf("scan error [/foo] [5] %v", e)
+	}
+
+	_, err = eh.scan("/foo", false, 2)
+	if err == nil {
+		t.Fatalf("scan before the start of the history should fail")
+	}
+
+	// dropping the event at 4 clears the history up to it
+	eh.addEvent(newEvent(Create, "/foo", 12, 12))
+	if eh.StartIndex != 5 {
+		t.Fatalf("StartIndex = %d, want 5", eh.StartIndex)
+	}
+	e, err = eh.scan("/foo", false, 5)
+	if err != nil || e.Index() != 7 {
+		t.Fatalf("scan error [/foo] [5] %v", e)
+	}
+}
+
 // TestFullEventQueue tests a queue with capacity = 10
 // Add 1000 events into that queue, and test if scanning
 // works still for previous events.
@@ -70,6 +70,9 @@ type Stats struct {
 	ExpireCount uint64 `json:"expireCount"`
 
 	Watchers uint64 `json:"watchers"`
+
+	// Number of active stream tails
+	Tails uint64 `json:"tails"`
 }
 
 func newStats() *Stats {
@@ -95,6 +98,7 @@ func (s *Stats) clone() *Stats {
 		CompareAndDeleteFail:    s.CompareAndDeleteFail,
 		ExpireCount:             s.ExpireCount,
 		Watchers:                s.Watchers,
+		Tails:                   s.Tails,
 	}
 }
 
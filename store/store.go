@@ -21,9 +21,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/etcd/Godeps/_workspace/src/github.com/jonboulle/clockwork"
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
 	etcdErr "github.com/coreos/etcd/error"
 	"github.com/coreos/etcd/pkg/types"
 	"github.com/coreos/etcd/store/streams"
@@ -54,9 +56,25 @@ type Store interface {
 
 	Watch(prefix string, recursive, stream bool, sinceIndex uint64) (Watcher, error)
 
-	StreamAppend(nodePath string, value []byte) (*Event, error)
+	StreamAppend(nodePath string, value []byte, now time.Time) (*Event, error)
+	StreamAppendBatch(nodePath string, values [][]byte, now time.Time) (*Event, error)
+	StreamCompareAndAppend(nodePath string, prevTail int64, value []byte, now time.Time) (*Event, error)
+	StreamCompareAndAppendBatch(nodePath string, prevTail int64, values [][]byte, now time.Time) (*Event, error)
 	StreamGet(nodePath string) (*Event, error)
-	StreamTail(nodePath string, listener streams.StreamListener)
+	StreamGetEntry(nodePath string) (*Event, *streams.Entry, error)
+	StreamReadRange(nodePath string, options streams.RangeOptions) (*streams.Range, error)
+	StreamList() ([]*StreamInfo, error)
+	StreamDelete(nodePath string) (*Event, error)
+	StreamTrim(nodePath string, before int64) (*Event, error)
+	StreamSetRetention(nodePath string, policy streams.RetentionPolicy) (*Event, error)
+	StreamRetain(now time.Time)
+	StreamCommitCursor(nodePath string, offset int64) (*Event, error)
+	StreamDeleteCursor(nodePath string) (*Event, error)
+	StreamCursors(nodePath string) ([]*CursorInfo, error)
+	StreamTail(ctx context.Context, nodePath string, options streams.TailOptions, listener streams.StreamListener)
+	StreamCheckpoint(index uint64)
+	StreamHashes(nodePath string, index uint64) (*StreamHashes, error)
+	StreamCheckQuota(nodePath string, n int64) error
 
 	Save() ([]byte, error)
 	Recovery(state []byte) error
@@ -79,20 +97,51 @@ type store struct {
 	clock          clockwork.Clock
 	readonlySet    types.Set
 	streamsDir     string
-	streamsStore   streamsStore
+	Streams        *streamsStore
 }
 
 // The given namespaces will be created as initial directories in the returned store.
 func New(streamsDir string, namespaces ...string) Store {
+	return NewWithStreams(streamsDir, StreamsConfig{}, namespaces...)
+}
+
+// StreamsConfig configures the streams of a store.
+type StreamsConfig struct {
+	// Backend holds the streams. If nil, the streams are stored as files
+	// in the streams directory, as configured by Sync and MaxOpen.
+	Backend streams.Backend
+	// Sync is the durability policy of the appends to streams.
+	Sync streams.SyncPolicy
+	// MaxOpen is the number of streams whose files are kept open, the
+	// least recently used being closed beyond it. Zero places no limit.
+	MaxOpen int
+	// MaxEntryBytes is the size of the largest entry of a stream, beyond
+	// which a stored record is taken as corrupt. Zero places no limit.
+	MaxEntryBytes int64
+	// QuotaBytes and TotalQuotaBytes bound the bytes retained by a single
+	// stream and by all the streams, as checked by StreamCheckQuota. Zero
+	// places no limit.
+	QuotaBytes      int64
+	TotalQuotaBytes int64
+}
+
+// NewWithStreams is New, with the streams configured by cfg.
+func NewWithStreams(streamsDir string, cfg StreamsConfig, namespaces ...string) Store {
 	s := newStore(streamsDir, namespaces...)
 	s.clock = clockwork.NewRealClock()
+	if cfg.Backend == nil {
+		cfg.Backend = streams.NewFileBackend(streamsDir, cfg.Sync, cfg.MaxOpen, cfg.MaxEntryBytes)
+	}
+	s.Streams.backend = cfg.Backend
+	s.Streams.quotaBytes = cfg.QuotaBytes
+	s.Streams.totalQuotaBytes = cfg.TotalQuotaBytes
 	return s
 }
 
 func newStore(streamsDir string, namespaces ...string) *store {
 	s := new(store)
 	s.streamsDir = streamsDir
-	s.streamsStore.init(streamsDir)
+	s.Streams = newStreamsStore(s, streams.NewFileBackend(streamsDir, streams.SyncPolicy{}, 0, 0))
 	s.CurrentVersion = defaultVersion
 	s.Root = newDir(s, "/", s.CurrentIndex, nil, Permanent)
 	for _, namespace := range namespaces {
@@ -162,16 +211,34 @@ func (s *store) Create(nodePath string, dir bool, value string, unique bool, exp
 }
 
 // StreamAppend is similar to Create, but only supports appending to a stream.
-// It will create the stream if it does not already exist.
-func (s *store) StreamAppend(nodePath string, value []byte) (*Event, error) {
+// It will create the stream if it does not already exist. The time of the
+// append is used for age based retention.
+func (s *store) StreamAppend(nodePath string, value []byte, now time.Time) (*Event, error) {
 	s.worldLock.Lock()
 	defer s.worldLock.Unlock()
 
-	e, err := s.streamsStore.StreamAppend(nodePath, value)
+	e, err := s.Streams.StreamAppend(nodePath, value, now)
 
 	if err == nil {
-		e.EtcdIndex = s.CurrentIndex
-		s.WatcherHub.notify(e)
+		s.streamEventDone(e)
+		s.Stats.Inc(CreateSuccess)
+	} else {
+		s.Stats.Inc(CreateFail)
+	}
+
+	return e, err
+}
+
+// StreamAppendBatch appends the values to a stream as consecutive entries,
+// creating the stream if it does not already exist.
+func (s *store) StreamAppendBatch(nodePath string, values [][]byte, now time.Time) (*Event, error) {
+	s.worldLock.Lock()
+	defer s.worldLock.Unlock()
+
+	e, err := s.Streams.StreamAppendBatch(nodePath, values, now)
+
+	if err == nil {
+		s.streamEventDone(e)
 		s.Stats.Inc(CreateSuccess)
 	} else {
 		s.Stats.Inc(CreateFail)
@@ -180,6 +247,50 @@ func (s *store) StreamAppend(nodePath string, value []byte) (*Event, error) {
 	return e, err
 }
 
+// StreamCompareAndAppend is similar to CompareAndSwap, but appends the value
+// to a stream only if the tail of the stream is prevTail.
+func (s *store) StreamCompareAndAppend(nodePath string, prevTail int64, value []byte, now time.Time) (*Event, error) {
+	s.worldLock.Lock()
+	defer s.worldLock.Unlock()
+
+	e, err := s.Streams.StreamCompareAndAppend(nodePath, prevTail, value, now)
+	s.compareAndAppendDone(e, err)
+	return e, err
+}
+
+// StreamCompareAndAppendBatch appends the values to a stream as consecutive
+// entries, only if the tail of the stream is prevTail.
+func (s *store) StreamCompareAndAppendBatch(nodePath string, prevTail int64, values [][]byte, now time.Time) (*Event, error) {
+	s.worldLock.Lock()
+	defer s.worldLock.Unlock()
+
+	e, err := s.Streams.StreamCompareAndAppendBatch(nodePath, prevTail, values, now)
+	s.compareAndAppendDone(e, err)
+	return e, err
+}
+
+// streamEventDone gives the event of a write to the streams store the raft
+// index of the entry being applied, and notifies the watchers of the
+// streams of the event.
+func (s *store) streamEventDone(e *Event) {
+	s.Streams.mutex.Lock()
+	index := s.Streams.applyingIndex()
+	s.Streams.mutex.Unlock()
+
+	e.EtcdIndex = index
+	setStreamNodeIndex(e.Node, index)
+	s.Streams.watcherHub.notify(e)
+}
+
+func (s *store) compareAndAppendDone(e *Event, err error) {
+	if err == nil {
+		s.streamEventDone(e)
+		s.Stats.Inc(CompareAndSwapSuccess)
+	} else {
+		s.Stats.Inc(CompareAndSwapFail)
+	}
+}
+
 // StreamGet is the Get method for stream storage
 func (s *store) StreamGet(nodePath string) (*Event, error) {
 	s.worldLock.RLock()
@@ -187,7 +298,7 @@ func (s *store) StreamGet(nodePath string) (*Event, error) {
 
 	nodePath = path.Clean(path.Join("/", nodePath))
 
-	e, err := s.streamsStore.StreamGet(nodePath)
+	e, err := s.Streams.StreamGet(nodePath)
 
 	if err != nil {
 		s.Stats.Inc(GetFail)
@@ -199,20 +310,262 @@ func (s *store) StreamGet(nodePath string) (*Event, error) {
 	return e, nil
 }
 
-// StreamGet is the Get method for stream storage
-func (s *store) StreamTail(nodePath string, listener streams.StreamListener) {
+// StreamGetEntry is StreamGet, but also returns the entry read.
+func (s *store) StreamGetEntry(nodePath string) (*Event, *streams.Entry, error) {
+	s.worldLock.RLock()
+	defer s.worldLock.RUnlock()
+
+	nodePath = path.Clean(path.Join("/", nodePath))
+
+	e, entry, err := s.Streams.StreamGetEntry(nodePath)
+
+	if err != nil {
+		s.Stats.Inc(GetFail)
+		return nil, nil, err
+	}
+
+	s.Stats.Inc(GetSuccess)
+
+	return e, entry, nil
+}
+
+// StreamReadRange reads consecutive entries of the stream at nodePath.
+func (s *store) StreamReadRange(nodePath string, options streams.RangeOptions) (*streams.Range, error) {
+	s.worldLock.RLock()
+	defer s.worldLock.RUnlock()
+
+	nodePath = path.Clean(path.Join("/", nodePath))
+
+	r, err := s.Streams.StreamReadRange(nodePath, options)
+
+	if err != nil {
+		s.Stats.Inc(GetFail)
+		return nil, err
+	}
+
+	s.Stats.Inc(GetSuccess)
+
+	return r, nil
+}
+
+// StreamList returns the information of every stream.
+func (s *store) StreamList() ([]*StreamInfo, error) {
+	s.worldLock.RLock()
+	defer s.worldLock.RUnlock()
+
+	infos, err := s.Streams.StreamList()
+
+	if err != nil {
+		s.Stats.Inc(GetFail)
+		return nil, err
+	}
+
+	s.Stats.Inc(GetSuccess)
+
+	return infos, nil
+}
+
+// StreamDelete deletes the stream at the given path.
+func (s *store) StreamDelete(nodePath string) (*Event, error) {
+	s.worldLock.Lock()
+	defer s.worldLock.Unlock()
+
+	nodePath = path.Clean(path.Join("/", nodePath))
+
+	e, err := s.Streams.StreamDelete(nodePath)
+
+	if err == nil {
+		s.streamEventDone(e)
+		s.Stats.Inc(DeleteSuccess)
+	} else {
+		s.Stats.Inc(DeleteFail)
+	}
+
+	return e, err
+}
+
+// StreamTrim drops the entries of the stream at the given path before the
+// given offset.
+func (s *store) StreamTrim(nodePath string, before int64) (*Event, error) {
+	s.worldLock.Lock()
+	defer s.worldLock.Unlock()
+
+	nodePath = path.Clean(path.Join("/", nodePath))
+
+	e, err := s.Streams.StreamTrim(nodePath, before)
+
+	if err == nil {
+		s.streamEventDone(e)
+		s.Stats.Inc(DeleteSuccess)
+	} else {
+		s.Stats.Inc(DeleteFail)
+	}
+
+	return e, err
+}
+
+// StreamCommitCursor commits the offset of the consumer cursor at the given
+// path, of the form "<stream>/cursors/<name>".
+func (s *store) StreamCommitCursor(nodePath string, offset int64) (*Event, error) {
+	s.worldLock.Lock()
+	defer s.worldLock.Unlock()
+
+	nodePath = path.Clean(path.Join("/", nodePath))
+
+	e, err := s.Streams.StreamCommitCursor(nodePath, offset)
+
+	if err == nil {
+		s.streamEventDone(e)
+		s.Stats.Inc(SetSuccess)
+	} else {
+		s.Stats.Inc(SetFail)
+	}
+
+	return e, err
+}
+
+// StreamDeleteCursor removes the consumer cursor at the given path.
+func (s *store) StreamDeleteCursor(nodePath string) (*Event, error) {
+	s.worldLock.Lock()
+	defer s.worldLock.Unlock()
+
+	nodePath = path.Clean(path.Join("/", nodePath))
+
+	e, err := s.Streams.StreamDeleteCursor(nodePath)
+
+	if err == nil {
+		s.streamEventDone(e)
+		s.Stats.Inc(DeleteSuccess)
+	} else {
+		s.Stats.Inc(DeleteFail)
+	}
+
+	return e, err
+}
+
+// StreamCursors returns the consumer cursor at the given path, or all the
+// cursors of a stream for a path of the form "<stream>/cursors".
+func (s *store) StreamCursors(nodePath string) ([]*CursorInfo, error) {
+	s.worldLock.RLock()
+	defer s.worldLock.RUnlock()
+
+	nodePath = path.Clean(path.Join("/", nodePath))
+
+	infos, err := s.Streams.StreamCursors(nodePath)
+
+	if err == nil {
+		s.Stats.Inc(GetSuccess)
+	} else {
+		s.Stats.Inc(GetFail)
+	}
+
+	return infos, err
+}
+
+// StreamSetRetention sets the retention policy of the stream at the given
+// path, or the default policy of all streams.
+func (s *store) StreamSetRetention(nodePath string, policy streams.RetentionPolicy) (*Event, error) {
+	s.worldLock.Lock()
+	defer s.worldLock.Unlock()
+
+	nodePath = path.Clean(path.Join("/", nodePath))
+
+	e, err := s.Streams.StreamSetRetention(nodePath, policy)
+
+	if err == nil {
+		s.streamEventDone(e)
+		s.Stats.Inc(SetSuccess)
+	} else {
+		s.Stats.Inc(SetFail)
+	}
+
+	return e, err
+}
+
+// StreamRetain trims the streams as required by their retention policies
+// at the given time.
+func (s *store) StreamRetain(now time.Time) {
+	s.worldLock.Lock()
+	defer s.worldLock.Unlock()
+
+	s.Streams.StreamRetain(now)
+}
+
+// StreamCheckpoint records that the streams hold the entries applied up to
+// the given raft index.
+func (s *store) StreamCheckpoint(index uint64) {
+	s.Streams.StreamCheckpoint(index)
+}
+
+// StreamHashes returns the hashes of the stream at the given path, or of
+// every stream for the streams root, as of the given raft index, or of the
+// latest index applied if index is zero. The entries to hash are fixed with
+// the store held, and then hashed without holding it.
+func (s *store) StreamHashes(nodePath string, index uint64) (*StreamHashes, error) {
+	s.worldLock.RLock()
+
+	nodePath = path.Clean(path.Join("/", nodePath))
+
+	index, ranges, err := s.Streams.streamHashRanges(nodePath, index)
+	etcdIndex := s.CurrentIndex
+
+	s.worldLock.RUnlock()
+
+	var hashes []*StreamHash
+	if err == nil {
+		hashes, err = hashRanges(ranges, etcdIndex)
+	}
+
+	if err != nil {
+		s.Stats.Inc(GetFail)
+		return nil, err
+	}
+
+	s.Stats.Inc(GetSuccess)
+
+	return &StreamHashes{Index: index, Streams: hashes}, nil
+}
+
+// StreamCheckQuota fails with EcodeQuotaExceeded if appending n bytes of
+// entries, headers included, to the stream at nodePath would exceed the
+// quota of the stream or of all the streams. It is checked before an append
+// is proposed rather than when it is applied, so that members configured
+// with different quotas apply the same appends. The quotas are thus soft
+// limits, which appends checked before the others are applied may exceed.
+func (s *store) StreamCheckQuota(nodePath string, n int64) error {
+	s.worldLock.RLock()
+	defer s.worldLock.RUnlock()
+
+	return s.Streams.StreamCheckQuota(nodePath, n)
+}
+
+// StreamTail is the Watch method for stream storage. A tail starting
+// relative to the tail of the stream, with FromTail or Back, is given the
+// path of the stream rather than of an entry. It returns once the tail has
+// ended, which it does when ctx is done.
+func (s *store) StreamTail(ctx context.Context, nodePath string, options streams.TailOptions, listener streams.StreamListener) {
 	s.worldLock.RLock()
 
 	var err error
 
 	nodePath = path.Clean(path.Join("/", nodePath))
 
-	var stream *streams.AppendStream
+	var stream streams.Stream
 	var pos int64
-	var options streams.TailOptions
 
 	lastSlash := strings.LastIndex(nodePath, "/")
-	if lastSlash == -1 {
+	if streamPath, _, ok := SplitStreamCursorPath(nodePath); ok {
+		// A tail from a cursor starts at its committed offset
+		pos, err = s.Streams.cursorOffset(nodePath)
+		if err == nil {
+			stream, err = s.Streams.getStream(streamPath, false)
+		}
+		if err == nil && pos < stream.GetStart() {
+			err = etcdErr.NewError(etcdErr.EcodeOffsetCompacted, nodePath, s.CurrentIndex)
+		}
+	} else if options.FromTail || options.Back > 0 {
+		stream, err = s.Streams.getStream(nodePath, false)
+	} else if lastSlash == -1 {
 		err = fmt.Errorf("Invalid stream path")
 	} else {
 		streamPath := nodePath[:lastSlash]
@@ -224,7 +577,10 @@ func (s *store) StreamTail(nodePath string, listener streams.StreamListener) {
 		}
 
 		if err == nil {
-			stream, err = s.streamsStore.getStream(streamPath)
+			stream, err = s.Streams.getStream(streamPath, false)
+		}
+		if err == nil && pos < stream.GetStart() {
+			err = etcdErr.NewError(etcdErr.EcodeOffsetCompacted, nodePath, s.CurrentIndex)
 		}
 	}
 
@@ -232,13 +588,16 @@ func (s *store) StreamTail(nodePath string, listener streams.StreamListener) {
 		err = fmt.Errorf("Invalid stream path")
 	}
 
+	s.worldLock.RUnlock()
+
 	if err != nil {
 		listener.End(err)
+		return
 	}
 
-	s.worldLock.RUnlock()
-
-	stream.Tail(pos, options, listener)
+	atomic.AddInt64(&s.Streams.tails, 1)
+	defer atomic.AddInt64(&s.Streams.tails, -1)
+	stream.Tail(ctx, pos, options, listener)
 }
 
 // Set creates or replace the node at nodePath.
@@ -459,6 +818,9 @@ func (s *store) Watch(key string, recursive, stream bool, sinceIndex uint64) (Wa
 	defer s.worldLock.RUnlock()
 
 	key = path.Clean(path.Join("/", key))
+	if key+"/" == PREFIX || strings.HasPrefix(key, PREFIX) {
+		return s.Streams.watch(key, recursive, stream, sinceIndex)
+	}
 	if sinceIndex == 0 {
 		sinceIndex = s.CurrentIndex + 1
 	}
@@ -741,12 +1103,14 @@ func (s *store) Clone() Store {
 	clonedStore.WatcherHub = s.WatcherHub.clone()
 	clonedStore.Stats = s.Stats.clone()
 	clonedStore.CurrentVersion = s.CurrentVersion
+	clonedStore.Streams = s.Streams.clone(clonedStore)
 
 	s.worldLock.Unlock()
 	return clonedStore
 }
 
 // Recovery recovers the store system from a static state
+// The streams are rewound to the saved state.
 // It needs to recover the parent field of the nodes.
 // It needs to delete the expired nodes since the saved time and also
 // needs to create monitoring go routines.
@@ -766,6 +1130,7 @@ func (s *store) Recovery(state []byte) error {
 }
 
 func (s *store) JsonStats() []byte {
-	s.Stats.Watchers = uint64(s.WatcherHub.count)
+	s.Stats.Watchers = uint64(s.WatcherHub.count + s.Streams.watcherHub.count)
+	s.Stats.Tails = uint64(atomic.LoadInt64(&s.Streams.tails))
 	return s.Stats.toJson()
 }
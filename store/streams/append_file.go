@@ -1,17 +1,41 @@
 package streams
 
 import (
-	"os"
-	"log"
-	"hash/crc32"
+	"container/list"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
 )
 
 var crc32c_table = crc32.MakeTable(crc32.Castagnoli)
 
+var (
+	ErrCRCMismatch  = errors.New("streams: crc mismatch")
+	ErrStreamClosed = errors.New("streams: stream closed")
+	// ErrOffsetCompacted is returned when reading an entry which has been
+	// dropped by retention.
+	ErrOffsetCompacted = errors.New("streams: offset compacted")
+	ErrSegmentMissing  = errors.New("streams: segment missing")
+	// ErrTornEntry is reported for a record cut short at the end of a
+	// segment, as left behind by a crash in the middle of an append.
+	ErrTornEntry = errors.New("streams: torn entry")
+	// ErrTailMismatch is returned by a conditional append when the tail of
+	// the stream is not the expected one.
+	ErrTailMismatch = errors.New("streams: tail mismatch")
+	// ErrEntryTooLarge is reported for a record whose header claims a value
+	// larger than the maximum entry size of the stream.
+	ErrEntryTooLarge = errors.New("streams: entry too large")
+)
+
 const EntryHeaderLength = 8
 
 type entryHeader struct {
@@ -19,27 +43,25 @@ type entryHeader struct {
 	checksum    uint32
 }
 
-func (s*entryHeader) ReadAt(fd *os.File, offset int64) error {
-	var header  [8]byte
+func (s *entryHeader) ReadAt(fd *os.File, offset int64) error {
+	var header [8]byte
 	_, err := fd.ReadAt(header[0:8], offset)
 	if err != nil {
 		return err
 	}
 
-	s.checksum = binary.LittleEndian.Uint32(header[0:4])
-	//log.Print("crc ", crc)
-	s.payloadSize = binary.LittleEndian.Uint32(header[4:8])
-	//log.Print("length ", length)
-
+	s.Decode(header[:])
 	return nil
 }
 
-func (s*entryHeader) WriteAt(fd *os.File, offset int64) error {
-	var header  [8]byte
-	binary.LittleEndian.PutUint32(header[0:4], s.checksum)
-	binary.LittleEndian.PutUint32(header[4:8], s.payloadSize)
+// Decode decodes the header from the first EntryHeaderLength bytes of b.
+func (s *entryHeader) Decode(b []byte) {
+	s.checksum = binary.LittleEndian.Uint32(b[0:4])
+	s.payloadSize = binary.LittleEndian.Uint32(b[4:8])
+}
 
-	_, err := fd.WriteAt(header[0:8], offset)
+func (s *entryHeader) WriteAt(fd *os.File, offset int64) error {
+	_, err := fd.WriteAt(s.Bytes(), offset)
 	if err != nil {
 		return err
 	}
@@ -47,45 +69,118 @@ func (s*entryHeader) WriteAt(fd *os.File, offset int64) error {
 	return nil
 }
 
-func (s*entryHeader) Init(value []byte) {
+// Bytes returns the encoded header.
+func (s *entryHeader) Bytes() []byte {
+	header := make([]byte, EntryHeaderLength)
+	binary.LittleEndian.PutUint32(header[0:4], s.checksum)
+	binary.LittleEndian.PutUint32(header[4:8], s.payloadSize)
+	return header
+}
+
+// tooLarge reports whether the header claims a value larger than max bytes,
+// which no entry of a stream limited to max holds. Zero places no limit.
+func (s *entryHeader) tooLarge(max int64) bool {
+	return max > 0 && int64(s.payloadSize) > max
+}
+
+func (s *entryHeader) Init(value []byte) {
 	s.checksum = crc32.Checksum(value, crc32c_table)
 	s.payloadSize = uint32(len(value))
 }
 
 type AppendStream struct {
 	streamKey string
-
-	fd   *os.File
-	clone      bool
+	dir       string
+
+	// maxEntryBytes is the size of the largest entry of the stream, beyond
+	// which a header is taken as corrupt. Zero places no limit.
+	maxEntryBytes int64
+
+	// sync is the durability policy of the appends, and syncTimer the
+	// pending sync under SyncInterval, guarded by offsetMutex.
+	sync      SyncPolicy
+	syncTimer *time.Timer
+
+	// cache is the file cache of the stream, if any. elem is the element of
+	// the stream in the list of the cache while its files are open, and refs
+	// the number of uses keeping them open. busy is set while the files are
+	// being closed or reopened, outside of the mutex of the cache, and
+	// uncached once the stream is closed. They are guarded by the mutex of
+	// the cache.
+	cache    *FileCache
+	elem     *list.Element
+	refs     int
+	busy     bool
+	uncached bool
+
+	// segmentsMutex guards the list of segments. Readers hold it while they
+	// read from a segment, so that its file is not closed underneath them;
+	// the list itself is only changed with offsetMutex also held.
+	segmentsMutex sync.RWMutex
+	segments      []*segment
 
 	offsetMutex     sync.Mutex
 	offsetCondition sync.Cond
+	startOffset     int64
 	nextOffset      int64
+	entryCount      int64
+	closed          bool
 }
 
-func NewAppendStream(basedir, streamKey string) (*AppendStream, error) {
-	log.Print("NewAppendStream ", streamKey)
-
-	filePath := basedir + "/" + streamKey
-	fd, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		log.Print("Error opening file ", streamKey, err)
+// NewAppendStream opens the stream stored in basedir under streamKey,
+// creating it if needed. Its appends are synced to disk as required by the
+// given policy, and a record larger than maxEntryBytes, if not zero, is
+// taken as corrupt.
+func NewAppendStream(basedir, streamKey string, policy SyncPolicy, maxEntryBytes int64) (*AppendStream, error) {
+	dir := basedir + "/" + streamKey
+	if err := upgradeFile(dir); err != nil {
+		log.Printf("streams: cannot convert stream %v to segments: %v", streamKey, err)
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Printf("streams: cannot create directory of stream %v: %v", streamKey, err)
 		return nil, err
 	}
 	s := new(AppendStream)
 	s.streamKey = streamKey
-	s.fd = fd
+	s.dir = dir
+	s.sync = policy
+	s.maxEntryBytes = maxEntryBytes
 	s.offsetCondition.L = &s.offsetMutex
+
+	// Without recovering the tail, the first append after a restart
+	// would overwrite the existing entries.
+	if err := s.openSegments(); err != nil {
+		log.Printf("streams: cannot recover stream %v: %v", streamKey, err)
+		s.closeSegments()
+		return nil, err
+	}
 	return s, nil
 }
 
-func (s *AppendStream) GetTail() (int64) {
+func (s *AppendStream) GetTail() int64 {
 	tail := atomic.LoadInt64(&s.nextOffset)
 	return tail
 }
 
+// GetEntryCount returns the number of retained entries in the stream.
+func (s *AppendStream) GetEntryCount() int64 {
+	return atomic.LoadInt64(&s.entryCount)
+}
+
+// TailOptions configure a tail of a stream.
 type TailOptions struct {
+	// Count stops the tail after the given number of entries, if non-zero.
 	Count int
+	// FromTail starts the tail at the current tail of the stream, so that
+	// only the entries appended from then on are sent.
+	FromTail bool
+	// Back starts the tail the given number of entries before the current
+	// tail of the stream, or at its first retained entry if it holds fewer.
+	Back int64
+	// Keepalive is the idle interval after which listeners implementing
+	// KeepaliveListener are sent a heartbeat. Zero sends no heartbeats.
+	Keepalive time.Duration
 }
 
 type StreamListener interface {
@@ -93,58 +188,92 @@ type StreamListener interface {
 	End(err error)
 }
 
-func (s *AppendStream) Tail(startPos int64, options TailOptions, listener StreamListener) {
+// KeepaliveListener is a StreamListener which is told when a tail has been
+// idle for the keepalive interval of its options, along with the current
+// tail of the stream. An error stops the tail.
+type KeepaliveListener interface {
+	StreamListener
+	Keepalive(tail int64) error
+}
+
+// Tail sends the entries of the stream from startPos to the listener as
+// they are appended, until the listener returns an error, the count of the
+// options is reached, or ctx is done. The listener is then ended, with the
+// error of ctx if it is done.
+func (s *AppendStream) Tail(ctx context.Context, startPos int64, options TailOptions, listener StreamListener) {
+	runTail(ctx, s, startPos, options, listener)
+}
+
+// tailSource is a stream as read by a tail.
+type tailSource interface {
+	GetTail() int64
+	ReadEntry(pos int64) (*Entry, error)
+	offsetBack(n int64) (int64, error)
+	waitTail(ctx context.Context, pos int64, timeout time.Duration) (int64, bool)
+}
+
+// runTail implements the Tail of every stream.
+func runTail(ctx context.Context, s tailSource, startPos int64, options TailOptions, listener StreamListener) {
+	activeTails.Inc()
+	defer activeTails.Dec()
+
 	pos := startPos
 	count := 0
 
-	tail := atomic.LoadInt64(&s.nextOffset)
+	if options.FromTail {
+		pos = s.GetTail()
+	} else if options.Back > 0 {
+		var err error
+		if pos, err = s.offsetBack(options.Back); err != nil {
+			listener.End(err)
+			return
+		}
+	}
+
+	var keepalive time.Duration
+	kl, ok := listener.(KeepaliveListener)
+	if ok {
+		keepalive = options.Keepalive
+	}
+
+	tail := s.GetTail()
 
 	for {
 		if pos >= tail {
-			s.offsetMutex.Lock()
-			tail = s.nextOffset
-			for pos >= tail {
-				log.Print("Waiting ", pos, " vs ", tail)
-				s.offsetCondition.Wait()
-				tail = s.nextOffset
+			var closed bool
+			tail, closed = s.waitTail(ctx, pos, keepalive)
+			if err := ctx.Err(); err != nil {
+				listener.End(err)
+				return
+			}
+			if closed {
+				listener.End(ErrStreamClosed)
+				return
+			}
+			if pos >= tail {
+				if err := kl.Keepalive(tail); err != nil {
+					break
+				}
+				continue
 			}
-			s.offsetMutex.Unlock()
 		}
 
-		var header entryHeader
-		err := header.ReadAt(s.fd, pos)
+		entry, err := s.ReadEntry(pos)
 		if err != nil {
-			listener.End(fmt.Errorf("Not a valid offset"))
+			listener.End(err)
 			return
 		}
 
-		// TODO: Sanity check length
-		value := make([]byte, header.payloadSize)
-		_, err = s.fd.ReadAt(value, pos+EntryHeaderLength)
+		tailLag.Observe(float64(s.GetTail() - entry.Next))
+		err = listener.GotValue(pos, entry.Value)
 		if err != nil {
-			listener.End(fmt.Errorf("Not a valid offset"))
-			return
-		}
-
-		actualCrc := crc32.Checksum(value, crc32c_table)
-		if header.checksum != actualCrc {
-			listener.End(fmt.Errorf("Not a valid offset"))
-			return
-		}
-
-		log.Print("Sending value @", pos)
-
-		err = listener.GotValue(pos, value)
-		if err != nil {
-			log.Print("GotValue returned error; stopping");
 			break
 		}
 
 		count++
-		pos += int64(header.payloadSize + EntryHeaderLength)
+		pos = entry.Next
 
 		if options.Count != 0 && count >= options.Count {
-			log.Print("Hit max count: ", options.Count)
 			break
 		}
 	}
@@ -152,16 +281,251 @@ func (s *AppendStream) Tail(startPos int64, options TailOptions, listener Stream
 	listener.End(nil)
 }
 
+// waitTail waits until the tail of the stream is beyond pos or the stream
+// is closed, and returns the tail. The wait also ends once ctx is done or
+// after a non-zero timeout, in which case the tail returned may not be
+// beyond pos.
+func (s *AppendStream) waitTail(ctx context.Context, pos int64, timeout time.Duration) (int64, bool) {
+	s.offsetMutex.Lock()
+	defer s.offsetMutex.Unlock()
+
+	waitUntil(ctx, &s.offsetCondition, timeout, func() bool {
+		return pos < s.nextOffset || s.closed
+	})
+	return s.nextOffset, s.closed
+}
+
+// waitUntil waits on cond, whose lock the caller holds, until ready returns
+// true. The wait also ends once ctx is done or after a non-zero timeout.
+func waitUntil(ctx context.Context, cond *sync.Cond, timeout time.Duration, ready func() bool) {
+	woken := false
+	wake := func() {
+		cond.L.Lock()
+		woken = true
+		cond.Broadcast()
+		cond.L.Unlock()
+	}
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, wake)
+		defer timer.Stop()
+	}
+	if done := ctx.Done(); done != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-done:
+				wake()
+			case <-stop:
+			}
+		}()
+	}
+	for !ready() && !woken {
+		cond.Wait()
+	}
+}
+
+// offsetBack returns the offset of the entry n entries before the tail of
+// the stream, or of the first retained entry if the stream holds fewer.
+func (s *AppendStream) offsetBack(n int64) (int64, error) {
+	if err := s.acquire(); err != nil {
+		return 0, err
+	}
+	defer s.done()
+
+	s.offsetMutex.Lock()
+	defer s.offsetMutex.Unlock()
+	s.segmentsMutex.RLock()
+	defer s.segmentsMutex.RUnlock()
+
+	i := len(s.segments) - 1
+	for ; i > 0 && s.segments[i].entries < n; i-- {
+		n -= s.segments[i].entries
+	}
+	seg := s.segments[i]
+
+	pos := seg.start
+	for skip := seg.entries - n; skip > 0; skip-- {
+		var header entryHeader
+		if err := header.ReadAt(seg.fd, pos-seg.start); err != nil {
+			return 0, err
+		}
+		pos += EntryHeaderLength + int64(header.payloadSize)
+	}
+	return pos, nil
+}
+
 func (s *AppendStream) Read(pos int64) ([]byte, error) {
+	entry, err := s.ReadEntry(pos)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Value, nil
+}
+
+// Entry is an entry read from a stream.
+type Entry struct {
+	Offset int64
+	// Next is the offset of the following entry.
+	Next int64
+	// Checksum is the CRC-32C of the value.
+	Checksum uint32
+	Value    []byte
+}
+
+// AppendFramed appends the entry to b as it is stored in a segment: a
+// header holding the checksum and length of the value, then the value.
+func (e *Entry) AppendFramed(b []byte) []byte {
+	header := entryHeader{payloadSize: uint32(len(e.Value)), checksum: e.Checksum}
+	return append(append(b, header.Bytes()...), e.Value...)
+}
+
+// ReadEntry reads the entry at pos. Reading an entry which is no longer
+// retained fails with ErrOffsetCompacted.
+func (s *AppendStream) ReadEntry(pos int64) (*Entry, error) {
+	defer observeRead(time.Now())
+
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.done()
+
+	s.segmentsMutex.RLock()
+	defer s.segmentsMutex.RUnlock()
+
+	return s.readEntry(pos)
+}
+
+// RangeOptions bound a range read of a stream. A zero Limit places no
+// limit on the number of entries read, and a zero MaxBytes reads up to
+// DefaultRangeBytes of values.
+type RangeOptions struct {
+	From     int64 `json:"from"`
+	Limit    int   `json:"limit,omitempty"`
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+}
+
+// DefaultRangeBytes bounds the size of the values returned by a range read
+// which does not set MaxBytes.
+var DefaultRangeBytes int64 = 1024 * 1024
+
+// Range is a run of consecutive entries of a stream.
+type Range struct {
+	Entries []*Entry
+	// Next is the offset to continue reading from.
+	Next int64
+}
+
+// ReadRange reads the consecutive entries from the offset of the options,
+// up to the tail of the stream, the limit of entries or the size of their
+// values. The first entry is read even if it is larger than MaxBytes, so
+// that successive range reads progress through the stream.
+func (s *AppendStream) ReadRange(options RangeOptions) (*Range, error) {
+	tail := s.GetTail()
+	defer observeRead(time.Now())
+
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.done()
+
+	s.segmentsMutex.RLock()
+	defer s.segmentsMutex.RUnlock()
+
+	return readRange(options, tail, s.readEntry)
+}
+
+// readRange implements ReadRange, reading the entries up to tail with
+// readEntry.
+func readRange(options RangeOptions, tail int64, readEntry func(pos int64) (*Entry, error)) (*Range, error) {
+	maxBytes := options.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultRangeBytes
+	}
+	r := &Range{Next: options.From}
+	var size int64
+	for r.Next < tail {
+		if options.Limit > 0 && len(r.Entries) >= options.Limit {
+			break
+		}
+		entry, err := readEntry(r.Next)
+		if err != nil {
+			return nil, err
+		}
+		size += int64(len(entry.Value))
+		if len(r.Entries) > 0 && size > maxBytes {
+			break
+		}
+		r.Entries = append(r.Entries, entry)
+		r.Next = entry.Next
+	}
+	return r, nil
+}
+
+// Hash returns the CRC-32C of the stored entries between the offsets from
+// and to, headers included, as read from the segment files. Streams holding
+// the same entries have the same hash whatever their segments, so comparing
+// the hashes of the copies of a stream detects a copy damaged on disk.
+func (s *AppendStream) Hash(from, to int64) (uint32, error) {
+	if err := s.acquire(); err != nil {
+		return 0, err
+	}
+	defer s.done()
+
+	s.segmentsMutex.RLock()
+	defer s.segmentsMutex.RUnlock()
+
+	if from > to || to > s.GetTail() {
+		return 0, fmt.Errorf("streams: invalid hash range [%x, %x)", from, to)
+	}
+	var h uint32
+	buf := make([]byte, 32*1024)
+	for pos := from; pos < to; {
+		seg, err := s.segmentFor(pos)
+		if err != nil {
+			return 0, err
+		}
+		// a segment ends where the next one starts
+		end := to
+		if i := sort.Search(len(s.segments), func(i int) bool { return s.segments[i].start > pos }); i < len(s.segments) && s.segments[i].start < end {
+			end = s.segments[i].start
+		}
+		n := int64(len(buf))
+		if end-pos < n {
+			n = end - pos
+		}
+		if _, err := seg.fd.ReadAt(buf[:n], pos-seg.start); err != nil {
+			return 0, err
+		}
+		h = crc32.Update(h, crc32c_table, buf[:n])
+		pos += n
+	}
+	return h, nil
+}
+
+// readEntry reads the entry at pos. The caller must hold segmentsMutex.
+func (s *AppendStream) readEntry(pos int64) (*Entry, error) {
+	seg, err := s.segmentFor(pos)
+	if err != nil {
+		return nil, err
+	}
+	off := pos - seg.start
+
 	var header entryHeader
-	err := header.ReadAt(s.fd, pos)
+	err = header.ReadAt(seg.fd, off)
 	if err != nil {
 		return nil, fmt.Errorf("Not a valid offset")
 	}
 
-	// TODO: Sanity check length
-	value := make([]byte, header.payloadSize)
-	_, err = s.fd.ReadAt(value, pos+EntryHeaderLength)
+	// the header is checked against the tail and the maximum entry size
+	// before its length is trusted with an allocation, as a corrupt one
+	// could claim up to 4GB
+	size := int64(header.payloadSize)
+	if header.tooLarge(s.maxEntryBytes) || pos+EntryHeaderLength+size > s.GetTail() {
+		return nil, fmt.Errorf("Not a valid offset")
+	}
+	value := make([]byte, size)
+	_, err = seg.fd.ReadAt(value, off+EntryHeaderLength)
 	if err != nil {
 		return nil, fmt.Errorf("Not a valid offset")
 	}
@@ -172,79 +536,224 @@ func (s *AppendStream) Read(pos int64) ([]byte, error) {
 		return nil, fmt.Errorf("Not a valid offset")
 	}
 
-	return value, nil
+	return &Entry{
+		Offset:   pos,
+		Next:     pos + EntryHeaderLength + int64(header.payloadSize),
+		Checksum: header.checksum,
+		Value:    value,
+	}, nil
 }
 
-func (s *AppendStream) Append(value []byte) (int64, error) {
-	var err error
+// Append appends the value to the stream, recording now as the time of
+// the append for age based retention. Once the last segment holds
+// SegmentBytes, a new segment is started.
+func (s *AppendStream) Append(value []byte, now time.Time) (int64, error) {
+	offsets, err := s.AppendBatch([][]byte{value}, now)
+	if err != nil {
+		return 0, err
+	}
+	return offsets[0], nil
+}
+
+// AppendBatch appends the values to the stream as consecutive entries, and
+// returns their offsets. The entries are written to a single segment, and
+// become visible to readers and tails together.
+func (s *AppendStream) AppendBatch(values [][]byte, now time.Time) ([]int64, error) {
+	return s.CompareAndAppend(-1, values, now)
+}
 
-	log.Print("Append prelock ", s.streamKey)
+// CompareAndAppend is AppendBatch, but only appends the values if the tail
+// of the stream is prevTail. It fails with ErrTailMismatch otherwise. A
+// negative prevTail matches any tail.
+func (s *AppendStream) CompareAndAppend(prevTail int64, values [][]byte, now time.Time) ([]int64, error) {
+	start := time.Now()
+
+	err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer s.done()
 
 	s.offsetMutex.Lock()
 	defer s.offsetMutex.Unlock()
 
+	if s.closed {
+		return nil, ErrStreamClosed
+	}
 	pos := s.nextOffset
+	if prevTail >= 0 && prevTail != pos {
+		return nil, ErrTailMismatch
+	}
 
-	log.Print("Append ", s.streamKey, "@", pos)
+	seg := s.segments[len(s.segments)-1]
+	if seg.size > 0 && seg.size >= SegmentBytes {
+		seg, err = s.createSegment(pos)
+		if err != nil {
+			return nil, err
+		}
+		s.segmentsMutex.Lock()
+		s.segments = append(s.segments, seg)
+		s.segmentsMutex.Unlock()
+	}
 
-	var header entryHeader
-	header.Init(value)
+	size := 0
+	for _, value := range values {
+		size += EntryHeaderLength + len(value)
+	}
+	offsets := make([]int64, 0, len(values))
+	data := make([]byte, 0, size)
+	for _, value := range values {
+		offsets = append(offsets, pos+int64(len(data)))
 
-	err = header.WriteAt(s.fd, pos)
-	if err != nil {
-		return 0, err
+		var header entryHeader
+		header.Init(value)
+		data = append(data, header.Bytes()...)
+		data = append(data, value...)
 	}
 
-	_, err = s.fd.WriteAt(value, pos+EntryHeaderLength)
+	_, err = seg.fd.WriteAt(data, pos-seg.start)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	if err = s.synced(seg, int64(size)); err != nil {
+		return nil, err
 	}
 
-	atomic.AddInt64(&s.nextOffset, int64(EntryHeaderLength + len(value)))
-	s.offsetCondition.Broadcast()
+	seg.size += int64(size)
+	seg.entries += int64(len(values))
+	if !now.IsZero() {
+		seg.lastAppend = now.UnixNano()
+	}
 
-	return pos, nil
-}
+	atomic.AddInt64(&s.nextOffset, int64(size))
+	atomic.AddInt64(&s.entryCount, int64(len(values)))
+	s.offsetCondition.Broadcast()
 
-func (s *AppendStream) Clone() (*AppendStream) {
-	log.Print("Clone of ", s.streamKey)
+	appendedEntries.Add(float64(len(values)))
+	appendedBytes.Add(float64(size))
+	appendDurations.Observe(float64(time.Since(start).Nanoseconds() / int64(time.Microsecond)))
 
-	clone := &AppendStream{}
-	*clone = *s
-	clone.clone = true
-	return clone
+	return offsets, nil
 }
 
+// Clone returns a copy of the stream, fixed at the current tail, held in
+// memory. The retained segments are read through the file cache as the
+// stream is cloned, so that a clone holds no files and a snapshot of many
+// streams opens no more files than the cache allows.
+func (s *AppendStream) Clone() (Stream, error) {
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.done()
 
-func (s *AppendStream) SaveNoCopy() ([]byte, error) {
-	log.Print("SaveNoCopy of ", s.streamKey)
-
-	n := atomic.LoadInt64(&s.nextOffset)
+	s.offsetMutex.Lock()
+	defer s.offsetMutex.Unlock()
 
-	value := make([]byte, n)
+	clone := newMemStream(s.streamKey, s.maxEntryBytes)
+	clone.segments = make([]*memSegment, 0, len(s.segments))
+	clone.entryCount = s.entryCount
+	for _, seg := range s.segments {
+		data := make([]byte, seg.size)
+		if _, err := seg.fd.ReadAt(data, 0); err != nil {
+			return nil, err
+		}
+		clone.segments = append(clone.segments, &memSegment{
+			start:      seg.start,
+			data:       data,
+			entries:    seg.entries,
+			lastAppend: seg.lastAppend,
+		})
+	}
+	return clone, nil
+}
 
-	_, err := s.fd.ReadAt(value, 0)
-	if err != nil {
+// SaveNoCopy returns the contents of the retained segments of the stream.
+func (s *AppendStream) SaveNoCopy() ([]SegmentState, error) {
+	if err := s.acquire(); err != nil {
 		return nil, err
 	}
+	defer s.done()
+
+	s.offsetMutex.Lock()
+	defer s.offsetMutex.Unlock()
 
-	return value, nil
+	states := make([]SegmentState, 0, len(s.segments))
+	for _, seg := range s.segments {
+		data := make([]byte, seg.size)
+		if _, err := seg.fd.ReadAt(data, 0); err != nil {
+			return nil, err
+		}
+		states = append(states, SegmentState{
+			Start:      seg.start,
+			LastAppend: seg.lastAppend,
+			Data:       data,
+		})
+	}
+	return states, nil
 }
 
+// Recovery replaces the segments of the stream with the saved state.
+func (s *AppendStream) Recovery(states []SegmentState) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.done()
 
-func (s *AppendStream) Recovery(state []byte) error {
 	s.offsetMutex.Lock()
 	defer s.offsetMutex.Unlock()
+	s.segmentsMutex.Lock()
+	defer s.segmentsMutex.Unlock()
 
-	log.Print("Recovery of ", s.streamKey)
-
-	n, err := s.fd.WriteAt(state, 0)
-	if err != nil {
+	// Drop any entries beyond the recovered state; they will be
+	// appended again as the raft log is replayed.
+	if err := s.removeSegments(); err != nil {
+		return err
+	}
+	if len(states) == 0 {
+		states = []SegmentState{{}}
+	}
+	for _, state := range states {
+		seg, err := s.createSegment(state.Start)
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+		if _, err = seg.fd.WriteAt(state.Data, 0); err != nil {
+			return err
+		}
+		if err = s.synced(seg, int64(len(state.Data))); err != nil {
+			return err
+		}
+		seg.lastAppend = state.LastAppend
+	}
+	if err := s.recoverTail(); err != nil {
 		return err
 	}
 
-	atomic.StoreInt64(&s.nextOffset, int64(n))
 	s.offsetCondition.Broadcast()
 
 	return nil
 }
+
+// Close syncs the pending appends and closes the segment files of the
+// stream. Any pending tails are ended with ErrStreamClosed.
+func (s *AppendStream) Close() error {
+	if s.cache != nil {
+		s.uncache()
+	}
+
+	s.offsetMutex.Lock()
+	defer s.offsetMutex.Unlock()
+
+	s.closed = true
+	s.offsetCondition.Broadcast()
+	if s.syncTimer != nil {
+		s.syncTimer.Stop()
+		s.syncTimer = nil
+	}
+	err := s.syncPending()
+	if cerr := s.closeSegments(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,801 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package streams
+
+import (
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/etcd/pkg/fileutil"
+)
+
+// newTestDir creates a directory for the streams of a test, which the test
+// removes once done.
+func newTestDir(t *testing.T) string {
+	p, err := ioutil.TempDir(os.TempDir(), "streamstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// newTestStream opens the stream with the given id in the directory p,
+// creating it if needed.
+func newTestStream(t *testing.T, p, id string, policy SyncPolicy) *AppendStream {
+	s, err := NewAppendStream(p, id, policy, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestAppendStreamRecoverTail(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+
+	s := newTestStream(t, p, "foo", SyncPolicy{})
+	values := [][]byte{[]byte("a"), []byte("bb"), []byte("ccc")}
+	var offsets []int64
+	for _, v := range values {
+		pos, err := s.Append(v, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, pos)
+	}
+	tail := s.GetTail()
+	s.Close()
+
+	s = newTestStream(t, p, "foo", SyncPolicy{})
+	defer s.Close()
+	if g := s.GetTail(); g != tail {
+		t.Errorf("tail = %d, want %d", g, tail)
+	}
+	pos, err := s.Append([]byte("dddd"), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos != tail {
+		t.Errorf("pos = %d, want %d", pos, tail)
+	}
+	for i, off := range offsets {
+		v, err := s.Read(off)
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if !reflect.DeepEqual(v, values[i]) {
+			t.Errorf("#%d: value = %q, want %q", i, v, values[i])
+		}
+	}
+}
+
+// Ensure that a stream stored in a single file, as before streams were split
+// in segments, is converted to a stream holding that file as its first
+// segment, including when a previous conversion was cut short.
+func TestAppendStreamUpgradeFile(t *testing.T) {
+	var data []byte
+	values := []string{"a", "bb"}
+	for _, v := range values {
+		var header entryHeader
+		header.Init([]byte(v))
+		data = append(append(data, header.Bytes()...), v...)
+	}
+
+	for i, name := range []string{"foo", ".foo.upgrade"} {
+		p := newTestDir(t)
+		defer os.RemoveAll(p)
+		if err := ioutil.WriteFile(path.Join(p, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		s, created, err := NewFileBackend(p, SyncPolicy{}, 0, 0).Open("foo", false)
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if created {
+			t.Errorf("#%d: created = true, want false", i)
+		}
+		if g := s.GetTail(); g != int64(len(data)) {
+			t.Errorf("#%d: tail = %d, want %d", i, g, len(data))
+		}
+		r, err := s.ReadRange(RangeOptions{})
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if len(r.Entries) != len(values) || string(r.Entries[1].Value) != values[1] {
+			t.Errorf("#%d: entries = %+v, want %q", i, r.Entries, values)
+		}
+		s.Close()
+
+		got, err := fileutil.ReadDir(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w := []string{"foo"}; !reflect.DeepEqual(got, w) {
+			t.Errorf("#%d: names = %v, want %v", i, got, w)
+		}
+		b, err := ioutil.ReadFile(path.Join(p, "foo", segmentName(0)))
+		if err != nil || !reflect.DeepEqual(b, data) {
+			t.Errorf("#%d: segment = %q, %v, want %q", i, b, err, data)
+		}
+	}
+}
+
+func TestAppendStreamAppendBatch(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+
+	s := newTestStream(t, p, "foo", SyncPolicy{})
+	defer s.Close()
+	if _, err := s.Append([]byte("a"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	values := [][]byte{[]byte("bb"), []byte(""), []byte("ccc")}
+	offsets, err := s.AppendBatch(values, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	woffsets := []int64{9, 19, 27}
+	if !reflect.DeepEqual(offsets, woffsets) {
+		t.Errorf("offsets = %v, want %v", offsets, woffsets)
+	}
+	if g := s.GetTail(); g != 38 {
+		t.Errorf("tail = %d, want %d", g, 38)
+	}
+	if g := s.GetEntryCount(); g != 4 {
+		t.Errorf("entries = %d, want %d", g, 4)
+	}
+	for i, off := range offsets {
+		v, err := s.Read(off)
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if !reflect.DeepEqual(v, values[i]) {
+			t.Errorf("#%d: value = %q, want %q", i, v, values[i])
+		}
+	}
+}
+
+func TestAppendStreamCompareAndAppend(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+
+	s := newTestStream(t, p, "foo", SyncPolicy{})
+	defer s.Close()
+
+	tests := []struct {
+		prevTail int64
+
+		wpos int64
+		werr error
+	}{
+		{0, 0, nil},
+		{0, 0, ErrTailMismatch},
+		{10, 0, ErrTailMismatch},
+		{9, 9, nil},
+		// a negative tail matches any tail
+		{-1, 18, nil},
+	}
+	for i, tt := range tests {
+		offsets, err := s.CompareAndAppend(tt.prevTail, [][]byte{[]byte("a")}, time.Time{})
+		if err != tt.werr {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
+		}
+		if err == nil && offsets[0] != tt.wpos {
+			t.Errorf("#%d: pos = %d, want %d", i, offsets[0], tt.wpos)
+		}
+	}
+	if g := s.GetEntryCount(); g != 3 {
+		t.Errorf("entries = %d, want %d", g, 3)
+	}
+}
+
+func TestAppendStreamRepairTornTail(t *testing.T) {
+	tests := []struct {
+		torn []byte
+	}{
+		// partial header
+		{[]byte{1, 2, 3}},
+		// header claiming more payload than was written
+		{[]byte{0, 0, 0, 0, 10, 0, 0, 0, 'x'}},
+		// complete record with a bad checksum
+		{[]byte{0, 0, 0, 0, 1, 0, 0, 0, 'x'}},
+	}
+	for i, tt := range tests {
+		p := newTestDir(t)
+		defer os.RemoveAll(p)
+
+		s := newTestStream(t, p, "foo", SyncPolicy{})
+		if _, err := s.Append([]byte("good"), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		tail := s.GetTail()
+		if _, err := s.segments[0].fd.WriteAt(tt.torn, tail); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+
+		s, err := NewAppendStream(p, "foo", SyncPolicy{}, 0)
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if g := s.GetTail(); g != tail {
+			t.Errorf("#%d: tail = %d, want %d", i, g, tail)
+		}
+		fi, err := s.segments[0].fd.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != tail {
+			t.Errorf("#%d: size = %d, want %d", i, fi.Size(), tail)
+		}
+		if _, err = os.Stat(path.Join(p, "foo", segmentName(0)+".broken")); err != nil {
+			t.Errorf("#%d: backup file err = %v, want nil", i, err)
+		}
+		s.Close()
+	}
+}
+
+func TestAppendStreamCorruptEntry(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+
+	s := newTestStream(t, p, "foo", SyncPolicy{})
+	pos, err := s.Append([]byte("first"), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Append([]byte("second"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	// flip a byte in the payload of the first entry
+	if _, err = s.segments[0].fd.WriteAt([]byte("F"), pos+EntryHeaderLength); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	if _, err = NewAppendStream(p, "foo", SyncPolicy{}, 0); err != ErrCRCMismatch {
+		t.Errorf("err = %v, want %v", err, ErrCRCMismatch)
+	}
+}
+
+// Ensure that the length in a corrupt entry header is checked before the
+// value is read, rather than trusted with an allocation.
+func TestAppendStreamCorruptLength(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+
+	s := newTestStream(t, p, "foo", SyncPolicy{})
+	defer s.Close()
+	pos, err := s.Append([]byte("first"), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Append([]byte("second"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	// claim a 4GB value in the header of the first entry
+	if _, err = s.segments[0].fd.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, pos+4); err != nil {
+		t.Fatal(err)
+	}
+
+	// the value would run beyond the tail of the stream
+	werr := errors.New("Not a valid offset")
+	if _, err = s.ReadEntry(pos); !reflect.DeepEqual(err, werr) {
+		t.Errorf("err = %v, want %v", err, werr)
+	}
+}
+
+// Ensure that a record larger than the maximum entry size of the stream is
+// taken as corrupt, both when read and when the stream is opened.
+func TestAppendStreamEntryTooLarge(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+
+	s, err := NewAppendStream(p, "foo", SyncPolicy{}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Append([]byte("four"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	// appends are bounded by the server, not by the stream
+	pos, err := s.Append([]byte("fives"), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	werr := errors.New("Not a valid offset")
+	if _, err = s.ReadEntry(pos); !reflect.DeepEqual(err, werr) {
+		t.Errorf("err = %v, want %v", err, werr)
+	}
+	s.Close()
+
+	if _, err = NewAppendStream(p, "foo", SyncPolicy{}, 4); err != ErrEntryTooLarge {
+		t.Errorf("err = %v, want %v", err, ErrEntryTooLarge)
+	}
+	s, err = NewAppendStream(p, "foo", SyncPolicy{}, 5)
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	s.Close()
+}
+
+func TestAppendStreamSegments(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+	defer func(n int64) { SegmentBytes = n }(SegmentBytes)
+	SegmentBytes = 20
+
+	s := newTestStream(t, p, "foo", SyncPolicy{})
+	var offsets []int64
+	for i := 0; i < 6; i++ {
+		// each entry is 12 bytes, so every segment holds two entries
+		pos, err := s.Append([]byte("four"), time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, pos)
+	}
+	if g := len(s.segments); g != 3 {
+		t.Fatalf("len(segments) = %d, want 3", g)
+	}
+
+	start, err := s.Trim(offsets[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != offsets[2] {
+		t.Errorf("start = %d, want %d", start, offsets[2])
+	}
+	if g := s.GetEntryCount(); g != 4 {
+		t.Errorf("entries = %d, want 4", g)
+	}
+	if _, err = s.Read(offsets[1]); err != ErrOffsetCompacted {
+		t.Errorf("err = %v, want %v", err, ErrOffsetCompacted)
+	}
+	if _, err = os.Stat(path.Join(p, "foo", segmentName(0))); !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+
+	// the last segment is never dropped
+	if start, err = s.Trim(s.GetTail()); err != nil {
+		t.Fatal(err)
+	}
+	if start != offsets[4] {
+		t.Errorf("start = %d, want %d", start, offsets[4])
+	}
+	tail := s.GetTail()
+	s.Close()
+
+	s = newTestStream(t, p, "foo", SyncPolicy{})
+	defer s.Close()
+	if g := s.GetStart(); g != offsets[4] {
+		t.Errorf("start = %d, want %d", g, offsets[4])
+	}
+	if g := s.GetTail(); g != tail {
+		t.Errorf("tail = %d, want %d", g, tail)
+	}
+	v, err := s.Read(offsets[5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "four" {
+		t.Errorf("value = %q, want %q", v, "four")
+	}
+}
+
+func TestAppendStreamRetain(t *testing.T) {
+	defer func(n int64) { SegmentBytes = n }(SegmentBytes)
+	SegmentBytes = 12
+
+	base := time.Unix(1000, 0)
+	tests := []struct {
+		policy RetentionPolicy
+		now    time.Time
+
+		wstart int64
+	}{
+		{RetentionPolicy{}, base.Add(time.Hour), 0},
+		// retains at least 24 bytes
+		{RetentionPolicy{MaxBytes: 24}, base, 24},
+		{RetentionPolicy{MaxBytes: 25}, base, 12},
+		// segments last appended to at base, base+1s, base+2s and base+3s
+		{RetentionPolicy{MaxAge: 2}, base.Add(3 * time.Second), 24},
+		{RetentionPolicy{MaxAge: 2}, base.Add(time.Hour), 36},
+		{RetentionPolicy{MaxBytes: 36, MaxAge: 2}, base.Add(3 * time.Second), 24},
+	}
+	for i, tt := range tests {
+		p := newTestDir(t)
+		defer os.RemoveAll(p)
+
+		s := newTestStream(t, p, "foo", SyncPolicy{})
+		for j := 0; j < 4; j++ {
+			if _, err := s.Append([]byte("four"), base.Add(time.Duration(j)*time.Second)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		start, err := s.Retain(tt.policy, tt.now)
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if start != tt.wstart {
+			t.Errorf("#%d: start = %d, want %d", i, start, tt.wstart)
+		}
+		s.Close()
+	}
+}
+
+func TestAppendStreamSaveAndRecovery(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+	defer func(n int64) { SegmentBytes = n }(SegmentBytes)
+	SegmentBytes = 12
+
+	s := newTestStream(t, p, "foo", SyncPolicy{})
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := s.Append([]byte("four"), time.Unix(int64(i), 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Trim(12); err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// trimmed and appended after the clone, so not part of the saved state
+	if _, err = s.Trim(24); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Append([]byte("five!"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	states, err := c.SaveNoCopy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 2 || states[0].Start != 12 || states[1].Start != 24 {
+		t.Fatalf("states = %+v, want segments starting at 12 and 24", states)
+	}
+	if states[1].LastAppend != time.Unix(2, 0).UnixNano() {
+		t.Errorf("lastAppend = %d, want %d", states[1].LastAppend, time.Unix(2, 0).UnixNano())
+	}
+
+	if err = s.Recovery(states); err != nil {
+		t.Fatal(err)
+	}
+	if g := s.GetStart(); g != 12 {
+		t.Errorf("start = %d, want 12", g)
+	}
+	if g := s.GetTail(); g != 36 {
+		t.Errorf("tail = %d, want 36", g)
+	}
+	if g := s.GetEntryCount(); g != 2 {
+		t.Errorf("entries = %d, want 2", g)
+	}
+	if _, err = s.Read(12); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+}
+
+// recordingListener records the offsets of the entries of a tail, and
+// reports its heartbeats on idle.
+type recordingListener struct {
+	offsets []int64
+	idle    chan int64
+	ended   chan error
+	// keepaliveErr is returned by Keepalive to stop the tail
+	keepaliveErr error
+}
+
+func newRecordingListener() *recordingListener {
+	return &recordingListener{idle: make(chan int64, 1), ended: make(chan error, 1)}
+}
+
+func (l *recordingListener) GotValue(pos int64, value []byte) error {
+	l.offsets = append(l.offsets, pos)
+	return nil
+}
+
+func (l *recordingListener) Keepalive(tail int64) error {
+	select {
+	case l.idle <- tail:
+	default:
+	}
+	return l.keepaliveErr
+}
+
+func (l *recordingListener) End(err error) { l.ended <- err }
+
+func TestAppendStreamTailOptions(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+	defer func(n int64) { SegmentBytes = n }(SegmentBytes)
+	SegmentBytes = 20
+
+	s := newTestStream(t, p, "foo", SyncPolicy{})
+	defer s.Close()
+	var offsets []int64
+	for i := 0; i < 6; i++ {
+		// each entry is 12 bytes, so every segment holds two entries
+		pos, err := s.Append([]byte("four"), time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, pos)
+	}
+
+	tests := []struct {
+		options TailOptions
+
+		woffsets []int64
+	}{
+		{TailOptions{Count: 2}, offsets[:2]},
+		{TailOptions{Back: 1, Count: 1}, offsets[5:]},
+		// back across segments
+		{TailOptions{Back: 3, Count: 3}, offsets[3:]},
+		{TailOptions{Back: 10, Count: 1}, offsets[:1]},
+	}
+	for i, tt := range tests {
+		l := newRecordingListener()
+		s.Tail(context.Background(), 0, tt.options, l)
+		if err := <-l.ended; err != nil {
+			t.Errorf("#%d: err = %v, want nil", i, err)
+		}
+		if !reflect.DeepEqual(l.offsets, tt.woffsets) {
+			t.Errorf("#%d: offsets = %v, want %v", i, l.offsets, tt.woffsets)
+		}
+	}
+
+	// an error from a heartbeat stops an idle tail
+	l := newRecordingListener()
+	l.keepaliveErr = errors.New("idle")
+	s.Tail(context.Background(), 0, TailOptions{FromTail: true, Keepalive: time.Millisecond}, l)
+	if err := <-l.ended; err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+	if g := <-l.idle; g != s.GetTail() {
+		t.Errorf("keepalive tail = %d, want %d", g, s.GetTail())
+	}
+
+	// a tail from the tail only sees the entries appended once it is idle
+	l = newRecordingListener()
+	go s.Tail(context.Background(), 0, TailOptions{FromTail: true, Count: 1, Keepalive: time.Millisecond}, l)
+	<-l.idle
+	pos, err := s.Append([]byte("five!"), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-l.ended; err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+	if w := []int64{pos}; !reflect.DeepEqual(l.offsets, w) {
+		t.Errorf("offsets = %v, want %v", l.offsets, w)
+	}
+}
+
+func TestAppendStreamTailCancel(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+
+	s := newTestStream(t, p, "foo", SyncPolicy{})
+	defer s.Close()
+
+	// an idle tail is woken and ended once cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	l := newRecordingListener()
+	go s.Tail(ctx, 0, TailOptions{Keepalive: time.Millisecond}, l)
+	<-l.idle
+	cancel()
+	select {
+	case err := <-l.ended:
+		if err != context.Canceled {
+			t.Errorf("err = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("tail did not end once cancelled")
+	}
+}
+
+func TestAppendStreamReadRange(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+	defer func(n int64) { SegmentBytes = n }(SegmentBytes)
+	SegmentBytes = 20
+
+	s := newTestStream(t, p, "foo", SyncPolicy{})
+	defer s.Close()
+	var offsets []int64
+	for i := 0; i < 5; i++ {
+		// each entry is 12 bytes, so every segment holds two entries
+		pos, err := s.Append([]byte("four"), time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, pos)
+	}
+	tail := s.GetTail()
+
+	tests := []struct {
+		options RangeOptions
+
+		woffsets []int64
+		wnext    int64
+	}{
+		// across segments, up to the tail
+		{RangeOptions{From: offsets[1]}, offsets[1:], tail},
+		{RangeOptions{From: offsets[1], Limit: 2}, offsets[1:3], offsets[3]},
+		{RangeOptions{From: 0, MaxBytes: 9}, offsets[:2], offsets[2]},
+		// the first entry is read even if it is too large
+		{RangeOptions{From: 0, MaxBytes: 1}, offsets[:1], offsets[1]},
+		{RangeOptions{From: tail}, nil, tail},
+	}
+	for i, tt := range tests {
+		r, err := s.ReadRange(tt.options)
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		var offsets []int64
+		for _, e := range r.Entries {
+			offsets = append(offsets, e.Offset)
+			if string(e.Value) != "four" {
+				t.Errorf("#%d: value = %q, want %q", i, e.Value, "four")
+			}
+		}
+		if !reflect.DeepEqual(offsets, tt.woffsets) {
+			t.Errorf("#%d: offsets = %v, want %v", i, offsets, tt.woffsets)
+		}
+		if r.Next != tt.wnext {
+			t.Errorf("#%d: next = %d, want %d", i, r.Next, tt.wnext)
+		}
+	}
+
+	// the framing of an entry is as stored
+	r, err := s.ReadRange(RangeOptions{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, EntryHeaderLength+4)
+	if _, err := s.segments[0].fd.ReadAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+	if g := r.Entries[0].AppendFramed(nil); !reflect.DeepEqual(g, b) {
+		t.Errorf("framed = %v, want %v", g, b)
+	}
+}
+
+func TestAppendStreamHash(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+
+	// the same entries are hashed alike whatever the segments holding them
+	a := newTestStream(t, p, "a", SyncPolicy{})
+	defer a.Close()
+	defer func(n int64) { SegmentBytes = n }(SegmentBytes)
+	SegmentBytes = 20
+	b := newTestStream(t, p, "b", SyncPolicy{})
+	defer b.Close()
+	var framed []byte
+	var offsets []int64
+	for _, v := range []string{"one", "two", "three", "four"} {
+		for _, s := range []*AppendStream{a, b} {
+			if _, err := s.Append([]byte(v), time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		offsets = append(offsets, int64(len(framed)))
+		e := Entry{Checksum: crc32.Checksum([]byte(v), crc32c_table), Value: []byte(v)}
+		framed = e.AppendFramed(framed)
+	}
+	tail := int64(len(framed))
+
+	tests := []struct {
+		from, to int64
+	}{
+		{0, tail},
+		{offsets[1], offsets[3]},
+		{offsets[2], offsets[2]},
+	}
+	for i, tt := range tests {
+		w := crc32.Checksum(framed[tt.from:tt.to], crc32c_table)
+		for _, s := range []*AppendStream{a, b} {
+			h, err := s.Hash(tt.from, tt.to)
+			if err != nil {
+				t.Fatalf("#%d: err = %v, want nil", i, err)
+			}
+			if h != w {
+				t.Errorf("#%d: hash of %s = %x, want %x", i, s.streamKey, h, w)
+			}
+		}
+	}
+
+	if _, err := a.Hash(0, tail+1); err == nil {
+		t.Errorf("err = nil, want error beyond the tail")
+	}
+	if _, err := b.Trim(offsets[2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Hash(0, tail); err != ErrOffsetCompacted {
+		t.Errorf("err = %v, want %v", err, ErrOffsetCompacted)
+	}
+}
+
+// Ensure that under SyncInterval the appends are synced together once the
+// interval has passed, and that closing the stream syncs pending appends.
+func TestAppendStreamSyncInterval(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+
+	unsynced := func(s *AppendStream) int64 {
+		s.offsetMutex.Lock()
+		defer s.offsetMutex.Unlock()
+		return s.segments[len(s.segments)-1].unsynced
+	}
+
+	s := newTestStream(t, p, "foo", SyncPolicy{Mode: SyncInterval, Interval: 10 * time.Millisecond})
+	s.Append([]byte("a"), time.Time{})
+	s.Append([]byte("bb"), time.Time{})
+	if g := unsynced(s); g != 2*EntryHeaderLength+3 {
+		t.Errorf("unsynced = %d, want %d", g, 2*EntryHeaderLength+3)
+	}
+	for i := 0; unsynced(s) != 0; i++ {
+		if i == 100 {
+			t.Fatalf("appends not synced after the interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s = newTestStream(t, p, "bar", SyncPolicy{Mode: SyncInterval, Interval: time.Hour})
+	s.Append([]byte("a"), time.Time{})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if g := s.segments[0].unsynced; g != 0 {
+		t.Errorf("unsynced after close = %d, want 0", g)
+	}
+	if s.syncTimer != nil {
+		t.Errorf("sync timer left pending after close")
+	}
+}
+
+// Ensure that SyncAppend and SyncNone leave no appends pending.
+func TestAppendStreamSyncModes(t *testing.T) {
+	for i, mode := range []SyncMode{SyncAppend, SyncNone} {
+		p := newTestDir(t)
+		defer os.RemoveAll(p)
+
+		s := newTestStream(t, p, "foo", SyncPolicy{Mode: mode})
+		if _, err := s.Append([]byte("a"), time.Time{}); err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if g := s.segments[0].unsynced; g != 0 {
+			t.Errorf("#%d: unsynced = %d, want 0", i, g)
+		}
+		if s.syncTimer != nil {
+			t.Errorf("#%d: unexpected pending sync", i)
+		}
+		s.Close()
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package streams
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/etcd/pkg/fileutil"
+)
+
+// The names of the backends, as chosen by the server configuration.
+const (
+	BackendFile   = "file"
+	BackendMemory = "memory"
+)
+
+// ErrStreamNotFound is returned when opening a stream which does not exist
+// without creating it.
+var ErrStreamNotFound = errors.New("streams: stream not found")
+
+// Stream is a stream of entries held by a Backend. The offset of an entry
+// is the position of its record, a header followed by the value, among the
+// records of the stream. Every backend lays out and splits the records in
+// segments the same way, so that the copies of a stream held by different
+// backends have the same offsets and hashes.
+type Stream interface {
+	GetStart() int64
+	GetTail() int64
+	GetEntryCount() int64
+
+	CompareAndAppend(prevTail int64, values [][]byte, now time.Time) ([]int64, error)
+	ReadEntry(pos int64) (*Entry, error)
+	ReadRange(options RangeOptions) (*Range, error)
+	Tail(ctx context.Context, startPos int64, options TailOptions, listener StreamListener)
+	Hash(from, to int64) (uint32, error)
+
+	Trim(before int64) (int64, error)
+	Retain(policy RetentionPolicy, now time.Time) (int64, error)
+
+	// Clone returns a read-only copy of the stream, fixed at its current
+	// tail, for SaveNoCopy to save while the stream is appended to.
+	Clone() (Stream, error)
+	SaveNoCopy() ([]SegmentState, error)
+	Recovery(states []SegmentState) error
+	Close() error
+}
+
+// Backend stores streams by id.
+type Backend interface {
+	// Open returns the stream with the given id. Unless create is set, a
+	// missing stream fails with ErrStreamNotFound; otherwise it is created,
+	// as the returned bool reports.
+	Open(id string, create bool) (Stream, bool, error)
+	// List returns the ids of the stored streams, sorted.
+	List() ([]string, error)
+	// Remove deletes the stream with the given id, which its user has
+	// closed.
+	Remove(id string) error
+}
+
+var (
+	_ Stream  = (*AppendStream)(nil)
+	_ Stream  = (*memStream)(nil)
+	_ Backend = (*FileBackend)(nil)
+	_ Backend = (*MemoryBackend)(nil)
+)
+
+// FileBackend stores every stream as the segment files of a directory of
+// its own under dir.
+type FileBackend struct {
+	dir           string
+	sync          SyncPolicy
+	files         *FileCache
+	maxEntryBytes int64
+}
+
+// NewFileBackend returns a backend storing the streams under dir, whose
+// appends are synced as required by policy. The files of at most maxOpen
+// streams are kept open, zero placing no limit. A record larger than
+// maxEntryBytes, if not zero, is taken as corrupt.
+func NewFileBackend(dir string, policy SyncPolicy, maxOpen int, maxEntryBytes int64) *FileBackend {
+	return &FileBackend{dir: dir, sync: policy, files: NewFileCache(maxOpen), maxEntryBytes: maxEntryBytes}
+}
+
+// Files returns the cache of the open files of the streams.
+func (b *FileBackend) Files() *FileCache { return b.files }
+
+func (b *FileBackend) Open(id string, create bool) (Stream, bool, error) {
+	// a stream whose conversion to segments was cut short exists too
+	if err := upgradeFile(path.Join(b.dir, id)); err != nil {
+		return nil, false, err
+	}
+	_, err := os.Stat(path.Join(b.dir, id))
+	exists := err == nil
+	if !exists && !create {
+		return nil, false, ErrStreamNotFound
+	}
+	s, err := b.files.NewAppendStream(b.dir, id, b.sync, b.maxEntryBytes)
+	if err != nil {
+		return nil, false, err
+	}
+	return s, !exists, nil
+}
+
+func (b *FileBackend) List() ([]string, error) {
+	names, err := fileutil.ReadDir(b.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []string
+	for _, name := range names {
+		// skip hidden files and the backups left by repair
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".broken") {
+			continue
+		}
+		ids = append(ids, name)
+	}
+	return ids, nil
+}
+
+func (b *FileBackend) Remove(id string) error {
+	return os.RemoveAll(path.Join(b.dir, id))
+}
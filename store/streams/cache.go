@@ -0,0 +1,250 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package streams
+
+import (
+	"container/list"
+	"log"
+	"os"
+	"sync"
+)
+
+// FileCache bounds the number of streams whose segment files are open, as
+// every segment holds a file descriptor. Once more than the limit of streams
+// are open, the least recently used ones are released: their files are
+// closed, and reopened when the stream is next read or appended to. Only
+// the files are closed, so a released stream keeps its tail and the tails
+// waiting on it.
+type FileCache struct {
+	max int
+
+	// mu guards the list and the cache fields of its streams. It is only
+	// held to update them: the files of a stream are synced, closed and
+	// reopened outside of it, so that a slow stream does not hold up the
+	// others. cond is signalled as a stream stops being busy.
+	mu      sync.Mutex
+	cond    *sync.Cond
+	lru     *list.List // of the open *AppendStream, most recently used first
+	evicted int64
+}
+
+// NewFileCache returns a cache keeping the files of at most max streams
+// open. A max of zero places no limit.
+func NewFileCache(max int) *FileCache {
+	c := &FileCache{max: max, lru: list.New()}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// NewAppendStream is NewAppendStream, with the files of the stream open as
+// allowed by the cache.
+func (c *FileCache) NewAppendStream(basedir, streamKey string, policy SyncPolicy, maxEntryBytes int64) (*AppendStream, error) {
+	s, err := NewAppendStream(basedir, streamKey, policy, maxEntryBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	s.cache = c
+	s.elem = c.lru.PushFront(s)
+	openStreams.Inc()
+	victims := c.evict()
+	c.mu.Unlock()
+
+	c.release(victims)
+	return s, nil
+}
+
+// OpenStreams returns the number of streams whose files are open.
+func (c *FileCache) OpenStreams() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Evicted returns the number of times a stream has been released.
+func (c *FileCache) Evicted() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evicted
+}
+
+// evict picks the least recently used streams which are not in use to be
+// released, until at most max streams are open. The victims are taken out
+// of the list and marked busy, and their files are left to be closed by
+// release once mu is unlocked. The caller must hold mu.
+func (c *FileCache) evict() []*AppendStream {
+	if c.max <= 0 {
+		return nil
+	}
+	var victims []*AppendStream
+	e := c.lru.Back()
+	for e != nil && c.lru.Len() > c.max {
+		s := e.Value.(*AppendStream)
+		e = e.Prev()
+		if s.refs > 0 || s.busy {
+			continue
+		}
+		c.lru.Remove(s.elem)
+		s.elem = nil
+		s.busy = true
+		victims = append(victims, s)
+	}
+	return victims
+}
+
+// release closes the files of the streams picked by evict. A stream whose
+// pending appends cannot be synced is kept open, as the least recently
+// used. The caller must not hold mu.
+func (c *FileCache) release(victims []*AppendStream) {
+	for _, s := range victims {
+		err := s.release()
+		if err != nil {
+			log.Printf("streams: cannot release %v: %v", s.streamKey, err)
+		}
+
+		c.mu.Lock()
+		s.busy = false
+		switch {
+		case err != nil && !s.uncached:
+			s.elem = c.lru.PushBack(s)
+		case err != nil:
+			openStreams.Dec()
+		default:
+			c.evicted++
+			openStreams.Dec()
+			evictedStreams.Inc()
+		}
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	}
+}
+
+// acquire keeps the files of the stream open until the matching call to
+// done, reopening them if the stream was released. Every use of the files
+// of a cached stream is wrapped by acquire and done.
+func (s *AppendStream) acquire() error {
+	c := s.cache
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	for s.busy {
+		c.cond.Wait()
+	}
+	s.refs++
+	if s.elem != nil {
+		c.lru.MoveToFront(s.elem)
+		c.mu.Unlock()
+		return nil
+	}
+
+	// the files are reopened outside of mu, while busy holds off other
+	// uses of the stream
+	s.busy = true
+	c.mu.Unlock()
+	err := s.reopen()
+	c.mu.Lock()
+	s.busy = false
+	c.cond.Broadcast()
+	if err != nil {
+		s.refs--
+		c.mu.Unlock()
+		return err
+	}
+	if !s.uncached {
+		s.elem = c.lru.PushFront(s)
+		openStreams.Inc()
+	}
+	victims := c.evict()
+	c.mu.Unlock()
+
+	c.release(victims)
+	return nil
+}
+
+// done ends a use of the files of the stream started by acquire.
+func (s *AppendStream) done() {
+	c := s.cache
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	s.refs--
+	victims := c.evict()
+	c.mu.Unlock()
+
+	c.release(victims)
+}
+
+// uncache removes a stream which is being closed from its cache.
+func (s *AppendStream) uncache() {
+	c := s.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.uncached = true
+	if s.elem != nil {
+		c.lru.Remove(s.elem)
+		s.elem = nil
+		openStreams.Dec()
+	}
+}
+
+// release syncs the pending appends and closes the segment files of the
+// stream. The files are left open if the appends cannot be synced.
+func (s *AppendStream) release() error {
+	s.offsetMutex.Lock()
+	defer s.offsetMutex.Unlock()
+	s.segmentsMutex.Lock()
+	defer s.segmentsMutex.Unlock()
+
+	if err := s.syncPending(); err != nil {
+		return err
+	}
+	if err := s.closeSegments(); err != nil {
+		log.Printf("streams: error closing the files of %v: %v", s.streamKey, err)
+	}
+	for _, seg := range s.segments {
+		seg.fd = nil
+	}
+	return nil
+}
+
+// reopen opens the segment files of a released stream.
+func (s *AppendStream) reopen() error {
+	s.offsetMutex.Lock()
+	defer s.offsetMutex.Unlock()
+	s.segmentsMutex.Lock()
+	defer s.segmentsMutex.Unlock()
+
+	if s.closed {
+		return ErrStreamClosed
+	}
+	for _, seg := range s.segments {
+		fd, err := os.OpenFile(s.segmentPath(seg.start), os.O_RDWR, 0600)
+		if err != nil {
+			s.closeSegments()
+			for _, seg := range s.segments {
+				seg.fd = nil
+			}
+			return err
+		}
+		openFiles.Inc()
+		seg.fd = fd
+	}
+	return nil
+}
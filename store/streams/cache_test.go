@@ -0,0 +1,226 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package streams
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestFileCacheEvict(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+
+	c := NewFileCache(2)
+	var ss []*AppendStream
+	for _, key := range []string{"a", "b", "c"} {
+		s, err := c.NewAppendStream(p, key, SyncPolicy{Mode: SyncInterval, Interval: time.Hour}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if _, err = s.Append([]byte(key), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		ss = append(ss, s)
+	}
+	if g := c.OpenStreams(); g != 2 {
+		t.Errorf("open = %d, want 2", g)
+	}
+	if g := c.Evicted(); g != 1 {
+		t.Errorf("evicted = %d, want 1", g)
+	}
+	if ss[0].segments[0].fd != nil {
+		t.Errorf("files of the least recently used stream are open")
+	}
+
+	// the released stream is reopened at its tail, and releases another
+	if g := ss[0].GetTail(); g != 9 {
+		t.Errorf("tail = %d, want 9", g)
+	}
+	pos, err := ss[0].Append([]byte("aa"), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos != 9 {
+		t.Errorf("pos = %d, want 9", pos)
+	}
+	for i, w := range []string{"a", "aa"} {
+		v, err := ss[0].Read(int64(i * 9))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != w {
+			t.Errorf("value = %q, want %q", v, w)
+		}
+	}
+	if g := c.OpenStreams(); g != 2 {
+		t.Errorf("open = %d, want 2", g)
+	}
+	if g := c.Evicted(); g != 2 {
+		t.Errorf("evicted = %d, want 2", g)
+	}
+	if ss[1].segments[0].fd != nil {
+		t.Errorf("files of the least recently used stream are open")
+	}
+	// the pending append of the released stream was synced
+	if ss[1].segments[0].unsynced != 0 {
+		t.Errorf("unsynced = %d, want 0", ss[1].segments[0].unsynced)
+	}
+
+	// a closed stream is not reopened
+	ss[1].Close()
+	if _, err = ss[1].Read(0); err != ErrStreamClosed {
+		t.Errorf("err = %v, want %v", err, ErrStreamClosed)
+	}
+	if g := c.OpenStreams(); g != 2 {
+		t.Errorf("open = %d, want 2", g)
+	}
+}
+
+func TestFileCacheTailAcrossEviction(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+
+	c := NewFileCache(1)
+	s, err := c.NewAppendStream(p, "foo", SyncPolicy{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err = s.Append([]byte("a"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	l := newRecordingListener()
+	go s.Tail(context.Background(), 0, TailOptions{FromTail: true, Count: 1, Keepalive: time.Millisecond}, l)
+	<-l.idle
+
+	// the waiting tail does not keep the files open
+	other, err := c.NewAppendStream(p, "bar", SyncPolicy{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if g := c.Evicted(); g != 1 {
+		t.Fatalf("evicted = %d, want 1", g)
+	}
+
+	pos, err := s.Append([]byte("b"), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-l.ended; err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+	if w := []int64{pos}; !reflect.DeepEqual(l.offsets, w) {
+		t.Errorf("offsets = %v, want %v", l.offsets, w)
+	}
+}
+
+// Ensure that cloning streams, as a snapshot does, opens their files through
+// the cache rather than beside it.
+func TestFileCacheClone(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+
+	c := NewFileCache(1)
+	var ss []*AppendStream
+	for _, key := range []string{"a", "b", "c"} {
+		s, err := c.NewAppendStream(p, key, SyncPolicy{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if _, err = s.Append([]byte(key), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		ss = append(ss, s)
+	}
+
+	var clones []Stream
+	for i, s := range ss {
+		clone, err := s.Clone()
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if g := c.OpenStreams(); g != 1 {
+			t.Errorf("#%d: open = %d, want 1", i, g)
+		}
+		clones = append(clones, clone)
+	}
+	if g := c.Evicted(); g != 5 {
+		t.Errorf("evicted = %d, want 5", g)
+	}
+
+	for i, clone := range clones {
+		states, err := clone.SaveNoCopy()
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if len(states) != 1 || len(states[0].Data) != EntryHeaderLength+1 {
+			t.Errorf("#%d: states = %+v, want a single entry", i, states)
+		}
+	}
+}
+
+// Ensure that the cache is not locked while the files of a released stream
+// are synced and closed, so that a slow stream does not hold up the others.
+func TestFileCacheReleaseUnlocked(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+
+	c := NewFileCache(1)
+	s, err := c.NewAppendStream(p, "foo", SyncPolicy{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// a held offsetMutex stands for a slow sync of the stream
+	s.offsetMutex.Lock()
+	opened := make(chan *AppendStream)
+	go func() {
+		other, err := c.NewAppendStream(p, "bar", SyncPolicy{}, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- other
+	}()
+	for {
+		c.mu.Lock()
+		busy := s.busy
+		c.mu.Unlock()
+		if busy {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if g := c.OpenStreams(); g != 1 {
+		t.Errorf("open = %d, want 1", g)
+	}
+	s.offsetMutex.Unlock()
+	if other := <-opened; other != nil {
+		other.Close()
+	}
+	if g := c.Evicted(); g != 1 {
+		t.Errorf("evicted = %d, want 1", g)
+	}
+}
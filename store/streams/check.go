@@ -0,0 +1,217 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package streams
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+)
+
+// CorruptError reports the first invalid record of a stream.
+type CorruptError struct {
+	// Offset is the offset of the invalid record, which is also the tail of
+	// the stream once repaired.
+	Offset int64
+	// Err is ErrCRCMismatch, ErrTornEntry, ErrEntryTooLarge or
+	// ErrSegmentMissing.
+	Err error
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("%v at offset %x", e.Err, e.Offset)
+}
+
+// CheckResult describes the valid entries of a stream as found by Check.
+type CheckResult struct {
+	// Start is the offset of the first entry, and Tail the offset following
+	// the last valid entry.
+	Start int64
+	Tail  int64
+	// Entries is the number of valid entries.
+	Entries int64
+	// Corrupt describes the first invalid record, or is nil if every
+	// record is valid.
+	Corrupt *CorruptError
+}
+
+// segmentFile is a segment file of a stream which is not open.
+type segmentFile struct {
+	start int64
+	name  string
+}
+
+// segmentFiles returns the segment files in dir, sorted by offset.
+func segmentFiles(dir string) ([]segmentFile, error) {
+	names, err := fileutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []segmentFile
+	for _, name := range names {
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		start, err := strconv.ParseInt(strings.TrimSuffix(name, segmentSuffix), 16, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, segmentFile{start: start, name: path.Join(dir, name)})
+	}
+	return files, nil
+}
+
+// Check verifies the header and checksum of every entry of the stream
+// stored in dir, without modifying its files. Unlike opening the stream, it
+// reports a torn final record rather than repairing it. A record larger than
+// maxEntryBytes, if not zero, is reported as corrupt.
+func Check(dir string, maxEntryBytes int64) (*CheckResult, error) {
+	res := &CheckResult{}
+	err := walkSegments(dir, -1, maxEntryBytes, res, nil)
+	return res, err
+}
+
+// Dump calls fn with each valid entry of the stream stored in dir from
+// offset from on, in order. A *CorruptError is returned once the first
+// invalid record is reached, as checked by Check.
+func Dump(dir string, from, maxEntryBytes int64, fn func(*Entry) error) error {
+	res := &CheckResult{}
+	if err := walkSegments(dir, from, maxEntryBytes, res, fn); err != nil {
+		return err
+	}
+	if res.Corrupt != nil {
+		return res.Corrupt
+	}
+	return nil
+}
+
+// Truncate drops the records of the stream stored in dir from offset tail
+// on, as reported by Check for a corrupt stream. The segment holding tail is
+// truncated after saving a copy of it, and any later segment is moved
+// aside, so that the dropped records remain available for inspection.
+func Truncate(dir string, tail int64) error {
+	files, err := segmentFiles(dir)
+	if err != nil {
+		return err
+	}
+	for i, f := range files {
+		if f.start <= tail && (i == len(files)-1 || files[i+1].start > tail) {
+			fd, err := os.OpenFile(f.name, os.O_RDWR, 0600)
+			if err != nil {
+				return err
+			}
+			seg := &segment{start: f.start, fd: fd}
+			err = seg.repair(tail - f.start)
+			fd.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if f.start > tail {
+			if err := os.Rename(f.name, f.name+".broken"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// walkSegments reads the entries of the stream stored in dir, recording
+// the valid ones in res and calling fn, if not nil, for those at or beyond
+// from. It stops at the first invalid record, which is recorded in
+// res.Corrupt.
+func walkSegments(dir string, from, maxEntryBytes int64, res *CheckResult, fn func(*Entry) error) error {
+	files, err := segmentFiles(dir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	res.Start, res.Tail = files[0].start, files[0].start
+	for _, f := range files {
+		if f.start != res.Tail {
+			res.Corrupt = &CorruptError{Offset: res.Tail, Err: ErrSegmentMissing}
+			return nil
+		}
+		fd, err := os.Open(f.name)
+		if err != nil {
+			return err
+		}
+		err = walkSegment(fd, f.start, from, maxEntryBytes, res, fn)
+		fd.Close()
+		if err != nil || res.Corrupt != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkSegment implements walkSegments for a single segment file starting
+// at the given offset.
+func walkSegment(fd *os.File, start, from, maxEntryBytes int64, res *CheckResult, fn func(*Entry) error) error {
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+
+	var pos int64
+	for pos < size {
+		offset := start + pos
+		if size-pos < EntryHeaderLength {
+			res.Corrupt = &CorruptError{Offset: offset, Err: ErrTornEntry}
+			return nil
+		}
+		var header entryHeader
+		if err := header.ReadAt(fd, pos); err != nil {
+			return err
+		}
+		if header.tooLarge(maxEntryBytes) {
+			res.Corrupt = &CorruptError{Offset: offset, Err: ErrEntryTooLarge}
+			return nil
+		}
+		end := pos + EntryHeaderLength + int64(header.payloadSize)
+		if end > size {
+			res.Corrupt = &CorruptError{Offset: offset, Err: ErrTornEntry}
+			return nil
+		}
+		value := make([]byte, header.payloadSize)
+		if _, err := fd.ReadAt(value, pos+EntryHeaderLength); err != nil {
+			return err
+		}
+		if header.checksum != crc32.Checksum(value, crc32c_table) {
+			res.Corrupt = &CorruptError{Offset: offset, Err: ErrCRCMismatch}
+			return nil
+		}
+
+		pos = end
+		res.Tail = start + pos
+		res.Entries++
+		if fn != nil && offset >= from {
+			err := fn(&Entry{Offset: offset, Next: res.Tail, Checksum: header.checksum, Value: value})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
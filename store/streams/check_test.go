@@ -0,0 +1,192 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package streams
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newCheckStream writes a stream of three entries, "a", "bb" and "ccc",
+// at offsets 0, 9 and 0x13, and returns the directory of the stream.
+func newCheckStream(t *testing.T, p string) string {
+	s := newTestStream(t, p, "foo", SyncPolicy{Mode: SyncNone})
+	for _, v := range []string{"a", "bb", "ccc"} {
+		if _, err := s.Append([]byte(v), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+	return path.Join(p, "foo")
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		// corrupt damages the segment file of the stream
+		corrupt func(f *os.File) error
+
+		wres *CheckResult
+	}{
+		{
+			func(f *os.File) error { return nil },
+			&CheckResult{Start: 0, Tail: 0x1e, Entries: 3},
+		},
+		{
+			func(f *os.File) error {
+				_, err := f.WriteAt([]byte("x"), 9+EntryHeaderLength)
+				return err
+			},
+			&CheckResult{Start: 0, Tail: 9, Entries: 1, Corrupt: &CorruptError{Offset: 9, Err: ErrCRCMismatch}},
+		},
+		{
+			func(f *os.File) error { return f.Truncate(0x1d) },
+			&CheckResult{Start: 0, Tail: 0x13, Entries: 2, Corrupt: &CorruptError{Offset: 0x13, Err: ErrTornEntry}},
+		},
+		{
+			func(f *os.File) error {
+				_, err := f.WriteAt([]byte{0, 0, 0}, 0x1e)
+				return err
+			},
+			&CheckResult{Start: 0, Tail: 0x1e, Entries: 3, Corrupt: &CorruptError{Offset: 0x1e, Err: ErrTornEntry}},
+		},
+	}
+	for i, tt := range tests {
+		p := newTestDir(t)
+		defer os.RemoveAll(p)
+		dir := newCheckStream(t, p)
+
+		f, err := os.OpenFile(path.Join(dir, segmentName(0)), os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tt.corrupt(f); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		res, err := Check(dir, 0)
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if !reflect.DeepEqual(res, tt.wres) {
+			t.Errorf("#%d: result = %+v, want %+v", i, res, tt.wres)
+		}
+	}
+}
+
+func TestCheckEntryTooLarge(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+	dir := newCheckStream(t, p)
+
+	res, err := Check(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wres := &CheckResult{Start: 0, Tail: 0x13, Entries: 2, Corrupt: &CorruptError{Offset: 0x13, Err: ErrEntryTooLarge}}
+	if !reflect.DeepEqual(res, wres) {
+		t.Errorf("result = %+v, want %+v", res, wres)
+	}
+	if err = Dump(dir, 0x13, 2, func(*Entry) error { return nil }); !reflect.DeepEqual(err, wres.Corrupt) {
+		t.Errorf("err = %v, want %v", err, wres.Corrupt)
+	}
+}
+
+func TestCheckSegmentMissing(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+	dir := newCheckStream(t, p)
+	if err := ioutil.WriteFile(path.Join(dir, segmentName(0x40)), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := Check(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wres := &CheckResult{Start: 0, Tail: 0x1e, Entries: 3, Corrupt: &CorruptError{Offset: 0x1e, Err: ErrSegmentMissing}}
+	if !reflect.DeepEqual(res, wres) {
+		t.Errorf("result = %+v, want %+v", res, wres)
+	}
+
+	if err = Truncate(dir, res.Corrupt.Offset); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path.Join(dir, segmentName(0x40)+".broken")); err != nil {
+		t.Errorf("err = %v, want the later segment moved aside", err)
+	}
+	if res, err = Check(dir, 0); err != nil || res.Corrupt != nil {
+		t.Errorf("check after truncate = %+v, %v, want no corruption", res, err)
+	}
+}
+
+func TestDumpAndTruncate(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+	dir := newCheckStream(t, p)
+
+	var offsets []int64
+	var values []string
+	dump := func(from int64) error {
+		offsets, values = nil, nil
+		return Dump(dir, from, 0, func(ent *Entry) error {
+			offsets = append(offsets, ent.Offset)
+			values = append(values, string(ent.Value))
+			return nil
+		})
+	}
+
+	if err := dump(9); err != nil {
+		t.Fatal(err)
+	}
+	if w := []int64{9, 0x13}; !reflect.DeepEqual(offsets, w) {
+		t.Errorf("offsets = %v, want %v", offsets, w)
+	}
+	if w := []string{"bb", "ccc"}; !reflect.DeepEqual(values, w) {
+		t.Errorf("values = %v, want %v", values, w)
+	}
+
+	// damage the value of the last entry
+	f, err := os.OpenFile(path.Join(dir, segmentName(0)), os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("x"), 0x13+EntryHeaderLength)
+	f.Close()
+
+	err = dump(0)
+	if cerr, ok := err.(*CorruptError); !ok || cerr.Offset != 0x13 || cerr.Err != ErrCRCMismatch {
+		t.Errorf("err = %v, want crc mismatch at 13", err)
+	}
+	if w := []string{"a", "bb"}; !reflect.DeepEqual(values, w) {
+		t.Errorf("values = %v, want %v", values, w)
+	}
+
+	if err = Truncate(dir, 0x13); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path.Join(dir, segmentName(0)+".broken")); err != nil {
+		t.Errorf("err = %v, want a backup of the truncated segment", err)
+	}
+	s := newTestStream(t, p, "foo", SyncPolicy{Mode: SyncNone})
+	defer s.Close()
+	if g := s.GetTail(); g != 0x13 {
+		t.Errorf("tail = %x, want 13", g)
+	}
+}
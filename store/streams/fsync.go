@@ -0,0 +1,146 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package streams
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// SyncMode selects when the appends to a stream are synced to disk.
+type SyncMode int
+
+const (
+	// SyncAppend syncs the segment file before an append returns, so that
+	// an acknowledged entry survives a power loss.
+	SyncAppend SyncMode = iota
+	// SyncInterval syncs the segment files once per interval after an
+	// append, so that the appends in between share a single sync.
+	SyncInterval
+	// SyncNone leaves writing the appends to disk to the operating system.
+	SyncNone
+)
+
+// DefaultSyncInterval is the interval of SyncInterval when the policy sets
+// none.
+var DefaultSyncInterval = 100 * time.Millisecond
+
+func (m SyncMode) String() string {
+	switch m {
+	case SyncAppend:
+		return "append"
+	case SyncInterval:
+		return "interval"
+	case SyncNone:
+		return "none"
+	}
+	return fmt.Sprintf("SyncMode(%d)", int(m))
+}
+
+// SyncPolicy configures the durability of the appends to a stream. The zero
+// policy syncs every append.
+type SyncPolicy struct {
+	Mode SyncMode
+	// Interval is the delay after an append within which it is synced,
+	// under SyncInterval.
+	Interval time.Duration
+}
+
+func (p SyncPolicy) String() string {
+	if p.Mode == SyncInterval {
+		return fmt.Sprintf("%v (%v)", p.Mode, p.interval())
+	}
+	return p.Mode.String()
+}
+
+func (p SyncPolicy) interval() time.Duration {
+	if p.Interval <= 0 {
+		return DefaultSyncInterval
+	}
+	return p.Interval
+}
+
+// syncSegment syncs the file of the segment to disk.
+func syncSegment(seg *segment) error {
+	start := time.Now()
+	err := seg.fd.Sync()
+	syncDurations.Observe(float64(time.Since(start).Nanoseconds() / int64(time.Microsecond)))
+	if err != nil {
+		syncFailed.Inc()
+	}
+	return err
+}
+
+// synced makes the given number of bytes just written to the segment as
+// durable as the sync policy of the stream requires. The caller must hold
+// offsetMutex.
+func (s *AppendStream) synced(seg *segment, n int64) error {
+	switch s.sync.Mode {
+	case SyncAppend:
+		return syncSegment(seg)
+	case SyncInterval:
+		seg.unsynced += n
+		unsyncedBytes.Add(float64(n))
+		if s.syncTimer == nil {
+			s.syncTimer = time.AfterFunc(s.sync.interval(), s.syncInterval)
+		}
+	}
+	return nil
+}
+
+// syncInterval syncs the appends made since the previous interval.
+func (s *AppendStream) syncInterval() {
+	s.offsetMutex.Lock()
+	defer s.offsetMutex.Unlock()
+
+	s.syncTimer = nil
+	if s.closed {
+		return
+	}
+	if err := s.syncPending(); err != nil {
+		log.Printf("streams: cannot sync %v: %v", s.streamKey, err)
+		s.syncTimer = time.AfterFunc(s.sync.interval(), s.syncInterval)
+	}
+}
+
+// syncPending syncs the segments holding appends which are not synced yet.
+// A segment which fails to sync is retried at the next interval. The caller
+// must hold offsetMutex.
+func (s *AppendStream) syncPending() error {
+	var err error
+	for _, seg := range s.segments {
+		if seg.unsynced == 0 {
+			continue
+		}
+		if serr := syncSegment(seg); serr != nil {
+			if err == nil {
+				err = serr
+			}
+			continue
+		}
+		unsyncedBytes.Sub(float64(seg.unsynced))
+		seg.unsynced = 0
+	}
+	return err
+}
+
+// dropUnsynced forgets the unsynced appends of a segment which is removed.
+func dropUnsynced(seg *segment) {
+	if seg.unsynced != 0 {
+		unsyncedBytes.Sub(float64(seg.unsynced))
+		seg.unsynced = 0
+	}
+}
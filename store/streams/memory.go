@@ -0,0 +1,451 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package streams
+
+import (
+	"fmt"
+	"hash/crc32"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// MemoryBackend holds the streams in memory, so that they only survive a
+// restart through the snapshots of the store and the raft log. It is meant
+// for tests, and for members whose streams are small enough to be kept in
+// memory.
+type MemoryBackend struct {
+	mu            sync.Mutex
+	streams       map[string]*memStream
+	maxEntryBytes int64
+}
+
+// NewMemoryBackend returns an empty backend, which takes a record larger
+// than maxEntryBytes, if not zero, as corrupt.
+func NewMemoryBackend(maxEntryBytes int64) *MemoryBackend {
+	return &MemoryBackend{streams: make(map[string]*memStream), maxEntryBytes: maxEntryBytes}
+}
+
+func (b *MemoryBackend) Open(id string, create bool) (Stream, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.streams[id]; ok {
+		return s, false, nil
+	}
+	if !create {
+		return nil, false, ErrStreamNotFound
+	}
+	s := newMemStream(id, b.maxEntryBytes)
+	b.streams[id] = s
+	return s, true, nil
+}
+
+func (b *MemoryBackend) List() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ids := make([]string, 0, len(b.streams))
+	for id := range b.streams {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (b *MemoryBackend) Remove(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.streams, id)
+	return nil
+}
+
+// memSegment holds the records of a stream from offset start, as a segment
+// file would. Its data is only appended to, so that clones can share it.
+type memSegment struct {
+	start      int64
+	data       []byte
+	entries    int64
+	lastAppend int64
+}
+
+func (seg *memSegment) end() int64 {
+	return seg.start + int64(len(seg.data))
+}
+
+// memStream is a stream of a MemoryBackend.
+type memStream struct {
+	streamKey     string
+	maxEntryBytes int64
+
+	// mu guards every field below, and cond is signalled once the stream is
+	// appended to or closed.
+	mu         sync.Mutex
+	cond       sync.Cond
+	segments   []*memSegment
+	entryCount int64
+	closed     bool
+}
+
+func newMemStream(streamKey string, maxEntryBytes int64) *memStream {
+	s := &memStream{streamKey: streamKey, maxEntryBytes: maxEntryBytes, segments: []*memSegment{{}}}
+	s.cond.L = &s.mu
+	return s
+}
+
+func (s *memStream) GetStart() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.segments[0].start
+}
+
+func (s *memStream) GetTail() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tail()
+}
+
+// tail returns the offset of the next entry. The caller must hold mu.
+func (s *memStream) tail() int64 {
+	return s.segments[len(s.segments)-1].end()
+}
+
+func (s *memStream) GetEntryCount() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entryCount
+}
+
+func (s *memStream) CompareAndAppend(prevTail int64, values [][]byte, now time.Time) ([]int64, error) {
+	start := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrStreamClosed
+	}
+	pos := s.tail()
+	if prevTail >= 0 && prevTail != pos {
+		return nil, ErrTailMismatch
+	}
+
+	seg := s.segments[len(s.segments)-1]
+	if len(seg.data) > 0 && int64(len(seg.data)) >= SegmentBytes {
+		seg = &memSegment{start: pos}
+		s.segments = append(s.segments, seg)
+	}
+
+	size := len(seg.data)
+	offsets := make([]int64, 0, len(values))
+	for _, value := range values {
+		offsets = append(offsets, seg.end())
+		e := &Entry{Checksum: crc32.Checksum(value, crc32c_table), Value: value}
+		seg.data = e.AppendFramed(seg.data)
+	}
+	size = len(seg.data) - size
+
+	seg.entries += int64(len(values))
+	if !now.IsZero() {
+		seg.lastAppend = now.UnixNano()
+	}
+	s.entryCount += int64(len(values))
+	s.cond.Broadcast()
+
+	appendedEntries.Add(float64(len(values)))
+	appendedBytes.Add(float64(size))
+	appendDurations.Observe(float64(time.Since(start).Nanoseconds() / int64(time.Microsecond)))
+
+	return offsets, nil
+}
+
+func (s *memStream) ReadEntry(pos int64) (*Entry, error) {
+	defer observeRead(time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrStreamClosed
+	}
+	return s.readEntry(pos)
+}
+
+// readEntry reads the entry at pos. The caller must hold mu.
+func (s *memStream) readEntry(pos int64) (*Entry, error) {
+	seg, err := s.segmentFor(pos)
+	if err != nil {
+		return nil, err
+	}
+	off := pos - seg.start
+	if off+EntryHeaderLength > int64(len(seg.data)) {
+		return nil, fmt.Errorf("Not a valid offset")
+	}
+
+	var header entryHeader
+	header.Decode(seg.data[off:])
+	end := off + EntryHeaderLength + int64(header.payloadSize)
+	if header.tooLarge(s.maxEntryBytes) || end > int64(len(seg.data)) {
+		return nil, fmt.Errorf("Not a valid offset")
+	}
+	// the value is copied, so that the caller cannot change the stream
+	value := append([]byte(nil), seg.data[off+EntryHeaderLength:end]...)
+	if header.checksum != crc32.Checksum(value, crc32c_table) {
+		return nil, fmt.Errorf("Not a valid offset")
+	}
+
+	return &Entry{
+		Offset:   pos,
+		Next:     seg.start + end,
+		Checksum: header.checksum,
+		Value:    value,
+	}, nil
+}
+
+// segmentFor returns the segment holding the entry at pos. The caller must
+// hold mu.
+func (s *memStream) segmentFor(pos int64) (*memSegment, error) {
+	if pos < s.segments[0].start {
+		return nil, ErrOffsetCompacted
+	}
+	i := sort.Search(len(s.segments), func(i int) bool { return s.segments[i].start > pos })
+	return s.segments[i-1], nil
+}
+
+func (s *memStream) ReadRange(options RangeOptions) (*Range, error) {
+	defer observeRead(time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrStreamClosed
+	}
+	return readRange(options, s.tail(), s.readEntry)
+}
+
+func (s *memStream) Tail(ctx context.Context, startPos int64, options TailOptions, listener StreamListener) {
+	runTail(ctx, s, startPos, options, listener)
+}
+
+func (s *memStream) waitTail(ctx context.Context, pos int64, timeout time.Duration) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	waitUntil(ctx, &s.cond, timeout, func() bool {
+		return pos < s.tail() || s.closed
+	})
+	return s.tail(), s.closed
+}
+
+func (s *memStream) offsetBack(n int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, ErrStreamClosed
+	}
+	i := len(s.segments) - 1
+	for ; i > 0 && s.segments[i].entries < n; i-- {
+		n -= s.segments[i].entries
+	}
+	seg := s.segments[i]
+
+	var off int64
+	for skip := seg.entries - n; skip > 0; skip-- {
+		var header entryHeader
+		header.Decode(seg.data[off:])
+		off += EntryHeaderLength + int64(header.payloadSize)
+	}
+	return seg.start + off, nil
+}
+
+// Hash is the Hash of AppendStream, over the records held in memory.
+func (s *memStream) Hash(from, to int64) (uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, ErrStreamClosed
+	}
+	if from > to || to > s.tail() {
+		return 0, fmt.Errorf("streams: invalid hash range [%x, %x)", from, to)
+	}
+	var h uint32
+	for pos := from; pos < to; {
+		seg, err := s.segmentFor(pos)
+		if err != nil {
+			return 0, err
+		}
+		end := seg.end()
+		if to < end {
+			end = to
+		}
+		h = crc32.Update(h, crc32c_table, seg.data[pos-seg.start:end-seg.start])
+		pos = end
+	}
+	return h, nil
+}
+
+// Trim is the Trim of AppendStream.
+func (s *memStream) Trim(before int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.trim(before)
+}
+
+// Retain is the Retain of AppendStream.
+func (s *memStream) Retain(policy RetentionPolicy, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before := s.segments[0].start
+	for _, seg := range s.segments[:len(s.segments)-1] {
+		if policy.retains(now, s.tail(), seg.end(), seg.lastAppend) {
+			break
+		}
+		before = seg.end()
+	}
+	return s.trim(before)
+}
+
+// trim implements Trim. The caller must hold mu.
+func (s *memStream) trim(before int64) (int64, error) {
+	n := 0
+	for n < len(s.segments)-1 && s.segments[n].end() <= before {
+		s.entryCount -= s.segments[n].entries
+		n++
+	}
+	if n == 0 {
+		return s.segments[0].start, nil
+	}
+	s.segments = append([]*memSegment(nil), s.segments[n:]...)
+
+	log.Printf("streams: trimmed %v to offset %d", s.streamKey, s.segments[0].start)
+	return s.segments[0].start, nil
+}
+
+// Clone returns a copy of the stream, fixed at the current tail, which
+// shares the records appended so far.
+func (s *memStream) Clone() (Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clone := &memStream{streamKey: s.streamKey, maxEntryBytes: s.maxEntryBytes, entryCount: s.entryCount}
+	clone.cond.L = &clone.mu
+	for _, seg := range s.segments {
+		n := len(seg.data)
+		clone.segments = append(clone.segments, &memSegment{
+			start:      seg.start,
+			data:       seg.data[:n:n],
+			entries:    seg.entries,
+			lastAppend: seg.lastAppend,
+		})
+	}
+	return clone, nil
+}
+
+// SaveNoCopy returns the retained segments of the stream, whose data is
+// shared with the stream.
+func (s *memStream) SaveNoCopy() ([]SegmentState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	states := make([]SegmentState, 0, len(s.segments))
+	for _, seg := range s.segments {
+		states = append(states, SegmentState{
+			Start:      seg.start,
+			LastAppend: seg.lastAppend,
+			Data:       seg.data,
+		})
+	}
+	return states, nil
+}
+
+// Recovery replaces the segments of the stream with the saved state, whose
+// records are checked as they are counted.
+func (s *memStream) Recovery(states []SegmentState) error {
+	if len(states) == 0 {
+		states = []SegmentState{{}}
+	}
+	segments := make([]*memSegment, 0, len(states))
+	var count int64
+	for i, state := range states {
+		seg := &memSegment{
+			start:      state.Start,
+			data:       append([]byte(nil), state.Data...),
+			lastAppend: state.LastAppend,
+		}
+		if i > 0 && segments[i-1].end() != seg.start {
+			return ErrSegmentMissing
+		}
+		if err := seg.count(s.maxEntryBytes); err != nil {
+			return err
+		}
+		count += seg.entries
+		segments = append(segments, seg)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrStreamClosed
+	}
+	s.segments = segments
+	s.entryCount = count
+	s.cond.Broadcast()
+	return nil
+}
+
+// count counts the records of the segment, checking each of them against
+// maxEntryBytes as well as their checksum.
+func (seg *memSegment) count(maxEntryBytes int64) error {
+	size := int64(len(seg.data))
+	seg.entries = 0
+	for off := int64(0); off < size; {
+		if size-off < EntryHeaderLength {
+			return ErrTornEntry
+		}
+		var header entryHeader
+		header.Decode(seg.data[off:])
+		if header.tooLarge(maxEntryBytes) {
+			return ErrEntryTooLarge
+		}
+		end := off + EntryHeaderLength + int64(header.payloadSize)
+		if end > size {
+			return ErrTornEntry
+		}
+		if header.checksum != crc32.Checksum(seg.data[off+EntryHeaderLength:end], crc32c_table) {
+			return ErrCRCMismatch
+		}
+		seg.entries++
+		off = end
+	}
+	return nil
+}
+
+// Close ends the pending tails of the stream with ErrStreamClosed. The
+// records of the stream are kept until it is removed from its backend.
+func (s *memStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,229 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package streams
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	b := NewMemoryBackend(0)
+	if _, _, err := b.Open("foo", false); err != ErrStreamNotFound {
+		t.Errorf("err = %v, want %v", err, ErrStreamNotFound)
+	}
+	for i, id := range []string{"foo", "bar"} {
+		if _, created, err := b.Open(id, true); err != nil || !created {
+			t.Errorf("#%d: created = %v, err = %v, want true, nil", i, created, err)
+		}
+	}
+	s, created, err := b.Open("foo", true)
+	if err != nil || created {
+		t.Fatalf("created = %v, err = %v, want false, nil", created, err)
+	}
+	if _, err = s.CompareAndAppend(-1, [][]byte{[]byte("a")}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := b.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := []string{"bar", "foo"}; !reflect.DeepEqual(ids, w) {
+		t.Errorf("ids = %v, want %v", ids, w)
+	}
+
+	// a pending tail is ended once the stream is closed
+	l := newRecordingListener()
+	go s.Tail(context.Background(), s.GetTail(), TailOptions{}, l)
+	s.Close()
+	select {
+	case err := <-l.ended:
+		if err != ErrStreamClosed {
+			t.Errorf("err = %v, want %v", err, ErrStreamClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("tail did not end once the stream was closed")
+	}
+	if err = b.Remove("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = b.Open("foo", false); err != ErrStreamNotFound {
+		t.Errorf("err = %v, want %v", err, ErrStreamNotFound)
+	}
+}
+
+// Ensure that a record larger than the maximum entry size of the backend is
+// taken as corrupt, both when read and when recovered.
+func TestMemoryStreamEntryTooLarge(t *testing.T) {
+	s, _, err := NewMemoryBackend(4).Open("foo", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsets, err := s.CompareAndAppend(-1, [][]byte{[]byte("four"), []byte("fives")}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	werr := errors.New("Not a valid offset")
+	if _, err = s.ReadEntry(offsets[1]); !reflect.DeepEqual(err, werr) {
+		t.Errorf("err = %v, want %v", err, werr)
+	}
+
+	states, err := s.SaveNoCopy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Recovery(states); err != ErrEntryTooLarge {
+		t.Errorf("err = %v, want %v", err, ErrEntryTooLarge)
+	}
+	other, _, err := NewMemoryBackend(5).Open("foo", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = other.Recovery(states); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+}
+
+// Ensure that the memory backend holds a stream at the same offsets, in the
+// same segments and with the same hashes as the file backend, so that the
+// saved state of either can be recovered by the other.
+func TestMemoryStreamMatchesFile(t *testing.T) {
+	p := newTestDir(t)
+	defer os.RemoveAll(p)
+	defer func(n int64) { SegmentBytes = n }(SegmentBytes)
+	SegmentBytes = 10
+
+	fs, _, err := NewFileBackend(p, SyncPolicy{}, 0, 0).Open("foo", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	ms, _, err := NewMemoryBackend(0).Open("foo", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := []Stream{fs, ms}
+
+	base := time.Unix(1000, 0)
+	// the first segment holds two entries, and the others one each
+	values := [][]byte{[]byte("a"), []byte("bb"), []byte("four"), []byte("ccc"), []byte("dddddd")}
+	var woffsets []int64
+	for i, s := range backends {
+		var offsets []int64
+		for j, v := range values {
+			pos, err := s.CompareAndAppend(-1, [][]byte{v}, base.Add(time.Duration(j)*time.Second))
+			if err != nil {
+				t.Fatalf("#%d: err = %v, want nil", i, err)
+			}
+			offsets = append(offsets, pos...)
+		}
+		if i == 0 {
+			woffsets = offsets
+		} else if !reflect.DeepEqual(offsets, woffsets) {
+			t.Errorf("#%d: offsets = %v, want %v", i, offsets, woffsets)
+		}
+	}
+
+	fstates, err := fs.SaveNoCopy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mstates, err := ms.SaveNoCopy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mstates, fstates) {
+		t.Errorf("states = %+v, want %+v", mstates, fstates)
+	}
+
+	for i, s := range backends {
+		start, err := s.Retain(RetentionPolicy{MaxAge: 3}, base.Add(4*time.Second))
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if start != woffsets[2] {
+			t.Errorf("#%d: start = %d, want %d", i, start, woffsets[2])
+		}
+		if g := s.GetEntryCount(); g != 3 {
+			t.Errorf("#%d: entries = %d, want 3", i, g)
+		}
+		if _, err = s.ReadEntry(woffsets[1]); err != ErrOffsetCompacted {
+			t.Errorf("#%d: err = %v, want %v", i, err, ErrOffsetCompacted)
+		}
+		r, err := s.ReadRange(RangeOptions{From: woffsets[2], Limit: 2})
+		if err != nil {
+			t.Fatalf("#%d: err = %v, want nil", i, err)
+		}
+		if len(r.Entries) != 2 || string(r.Entries[1].Value) != "ccc" || r.Next != woffsets[4] {
+			t.Errorf("#%d: range = %+v, want ccc up to %d", i, r, woffsets[4])
+		}
+
+		l := newRecordingListener()
+		s.Tail(context.Background(), 0, TailOptions{Back: 2, Count: 2}, l)
+		if err := <-l.ended; err != nil {
+			t.Errorf("#%d: err = %v, want nil", i, err)
+		}
+		if w := woffsets[3:]; !reflect.DeepEqual(l.offsets, w) {
+			t.Errorf("#%d: offsets = %v, want %v", i, l.offsets, w)
+		}
+	}
+
+	fh, err := fs.Hash(woffsets[2], fs.GetTail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mh, err := ms.Hash(woffsets[2], ms.GetTail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mh != fh {
+		t.Errorf("hash = %08x, want %08x", mh, fh)
+	}
+
+	// the memory stream recovers the state saved by the file stream
+	mc, err := ms.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ms.CompareAndAppend(-1, [][]byte{[]byte("e")}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if g, w := mc.GetTail(), fs.GetTail(); g != w {
+		t.Errorf("clone tail = %d, want %d", g, w)
+	}
+	if fstates, err = fs.SaveNoCopy(); err != nil {
+		t.Fatal(err)
+	}
+	if err = ms.Recovery(fstates); err != nil {
+		t.Fatal(err)
+	}
+	if g, w := ms.GetTail(), fs.GetTail(); g != w {
+		t.Errorf("tail = %d, want %d", g, w)
+	}
+	if g := ms.GetEntryCount(); g != 3 {
+		t.Errorf("entries = %d, want 3", g)
+	}
+
+	// corrupt records are not recovered
+	fstates[0].Data[len(fstates[0].Data)-1] ^= 0xff
+	if err = ms.Recovery(fstates); err != ErrCRCMismatch {
+		t.Errorf("err = %v, want %v", err, ErrCRCMismatch)
+	}
+}
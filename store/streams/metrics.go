@@ -0,0 +1,96 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package streams
+
+import (
+	"time"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	syncDurations = prometheus.NewSummary(prometheus.SummaryOpts{
+		Name: "streams_fsync_durations_microseconds",
+		Help: "The latency distributions of fsync called by streams.",
+	})
+	syncFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "streams_fsync_failed_total",
+		Help: "The total number of failed fsyncs of stream segments.",
+	})
+	unsyncedBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "streams_unsynced_bytes",
+		Help: "The number of appended bytes waiting for an interval fsync.",
+	})
+
+	appendedEntries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "streams_appended_entries_total",
+		Help: "The total number of entries appended to streams.",
+	})
+	appendedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "streams_appended_bytes_total",
+		Help: "The total number of bytes appended to streams, entry headers included.",
+	})
+	appendDurations = prometheus.NewSummary(prometheus.SummaryOpts{
+		Name: "streams_append_durations_microseconds",
+		Help: "The latency distributions of appends to streams, fsync included.",
+	})
+	readDurations = prometheus.NewSummary(prometheus.SummaryOpts{
+		Name: "streams_read_durations_microseconds",
+		Help: "The latency distributions of entry and range reads of streams.",
+	})
+
+	activeTails = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "streams_active_tails",
+		Help: "The number of active tails of streams.",
+	})
+	// tailLag is observed as each entry is sent to a tail.
+	tailLag = prometheus.NewSummary(prometheus.SummaryOpts{
+		Name: "streams_tail_lag_bytes",
+		Help: "The distributions of the number of bytes between the entries sent to tails and the tail of their stream.",
+	})
+
+	openFiles = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "streams_open_files",
+		Help: "The number of open segment files of streams.",
+	})
+	openStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "streams_open_streams",
+		Help: "The number of streams whose segment files are kept open by the file cache.",
+	})
+	evictedStreams = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "streams_evicted_total",
+		Help: "The total number of streams whose segment files were closed by the file cache.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(syncDurations)
+	prometheus.MustRegister(syncFailed)
+	prometheus.MustRegister(unsyncedBytes)
+	prometheus.MustRegister(appendedEntries)
+	prometheus.MustRegister(appendedBytes)
+	prometheus.MustRegister(appendDurations)
+	prometheus.MustRegister(readDurations)
+	prometheus.MustRegister(activeTails)
+	prometheus.MustRegister(tailLag)
+	prometheus.MustRegister(openFiles)
+	prometheus.MustRegister(openStreams)
+	prometheus.MustRegister(evictedStreams)
+}
+
+// observeRead records the duration of a read which began at start.
+func observeRead(start time.Time) {
+	readDurations.Observe(float64(time.Since(start).Nanoseconds() / int64(time.Microsecond)))
+}
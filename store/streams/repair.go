@@ -0,0 +1,150 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package streams
+
+import (
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// recoverTail scans the segments of the stream to find the offset at which
+// the next entry should be appended, and the number of entries. A torn final
+// record of the last segment, left behind by a crash in the middle of an
+// append, is truncated away; a record larger than the maximum entry size is
+// reported as ErrEntryTooLarge, and any other corrupt record as
+// ErrCRCMismatch.
+func (s *AppendStream) recoverTail() error {
+	var count int64
+	for i, seg := range s.segments {
+		if i > 0 {
+			prev := s.segments[i-1]
+			if prev.start+prev.size != seg.start {
+				log.Printf("streams: segment %v does not follow %v", seg.fd.Name(), prev.fd.Name())
+				return ErrSegmentMissing
+			}
+		}
+		if err := seg.recover(i == len(s.segments)-1, s.maxEntryBytes); err != nil {
+			return err
+		}
+		count += seg.entries
+	}
+
+	last := s.segments[len(s.segments)-1]
+	atomic.StoreInt64(&s.startOffset, s.segments[0].start)
+	atomic.StoreInt64(&s.nextOffset, last.start+last.size)
+	atomic.StoreInt64(&s.entryCount, count)
+	return nil
+}
+
+// recover scans the entries of the segment file to find its size and number
+// of entries. A torn final record is only repaired in the last segment, and
+// a record larger than maxEntryBytes, if not zero, is never repaired.
+func (seg *segment) recover(last bool, maxEntryBytes int64) error {
+	fi, err := seg.fd.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+
+	var pos, count int64
+	torn := false
+	for pos < size {
+		if size-pos < EntryHeaderLength {
+			torn = true
+			break
+		}
+
+		var header entryHeader
+		if err := header.ReadAt(seg.fd, pos); err != nil {
+			return err
+		}
+		if header.tooLarge(maxEntryBytes) {
+			log.Printf("streams: entry of %d bytes in %v at offset %d", header.payloadSize, seg.fd.Name(), seg.start+pos)
+			return ErrEntryTooLarge
+		}
+
+		end := pos + EntryHeaderLength + int64(header.payloadSize)
+		if end > size {
+			torn = true
+			break
+		}
+
+		value := make([]byte, header.payloadSize)
+		if _, err := seg.fd.ReadAt(value, pos+EntryHeaderLength); err != nil {
+			return err
+		}
+		if header.checksum != crc32.Checksum(value, crc32c_table) {
+			if end == size {
+				torn = true
+				break
+			}
+			log.Printf("streams: crc mismatch in %v at offset %d", seg.fd.Name(), seg.start+pos)
+			return ErrCRCMismatch
+		}
+
+		pos = end
+		count++
+	}
+
+	if torn {
+		if !last {
+			log.Printf("streams: torn entry in %v at offset %d", seg.fd.Name(), seg.start+pos)
+			return ErrCRCMismatch
+		}
+		if err := seg.repair(pos); err != nil {
+			return err
+		}
+	}
+
+	seg.size = pos
+	seg.entries = count
+	return nil
+}
+
+// repair truncates the segment file to the given length, after saving a
+// copy of the original file alongside it.
+func (seg *segment) repair(length int64) error {
+	f := seg.fd
+	log.Printf("streams: repairing %v, truncating to %d", f.Name(), length)
+
+	bf, err := os.Create(f.Name() + ".broken")
+	if err != nil {
+		log.Printf("streams: could not repair %v, failed to create backup file", f.Name())
+		return err
+	}
+	defer bf.Close()
+
+	if _, err = f.Seek(0, os.SEEK_SET); err != nil {
+		log.Printf("streams: could not repair %v, failed to read file", f.Name())
+		return err
+	}
+	if _, err = io.Copy(bf, f); err != nil {
+		log.Printf("streams: could not repair %v, failed to copy file", f.Name())
+		return err
+	}
+
+	if err = f.Truncate(length); err != nil {
+		log.Printf("streams: could not repair %v, failed to truncate file", f.Name())
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		log.Printf("streams: could not repair %v, failed to sync file", f.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package streams
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+)
+
+const segmentSuffix = ".seg"
+
+// SegmentBytes is the size beyond which the last segment of a stream is
+// closed and a new one started. Retention drops whole segments, so it also
+// bounds how much is retained beyond a retention limit.
+var SegmentBytes int64 = 64 * 1024 * 1024
+
+// segment is a file holding the entries of a stream from offset start.
+// The size, entries and lastAppend fields are guarded by the offsetMutex of
+// the stream.
+type segment struct {
+	start int64
+	fd    *os.File
+
+	size    int64
+	entries int64
+	// lastAppend is the time of the latest append to the segment in unix
+	// nanoseconds, or 0 if it is not known.
+	lastAppend int64
+	// unsynced is the number of bytes appended since the segment was last
+	// synced, under SyncInterval.
+	unsynced int64
+}
+
+// SegmentState is the saved state of a single segment of a stream.
+type SegmentState struct {
+	Start      int64  `json:"start"`
+	LastAppend int64  `json:"lastAppend,omitempty"`
+	Data       []byte `json:"data"`
+}
+
+// RetentionPolicy limits the entries retained by a stream. A zero field
+// places no limit.
+type RetentionPolicy struct {
+	// MaxBytes is the number of bytes beyond which older segments are
+	// dropped.
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	// MaxAge is the number of seconds after its last append that a segment
+	// is dropped.
+	MaxAge int64 `json:"maxAge,omitempty"`
+}
+
+// IsZero reports whether the policy places no limit.
+func (p RetentionPolicy) IsZero() bool {
+	return p.MaxBytes == 0 && p.MaxAge == 0
+}
+
+// Merge returns the policy with its unset fields taken from def.
+func (p RetentionPolicy) Merge(def RetentionPolicy) RetentionPolicy {
+	if p.MaxBytes == 0 {
+		p.MaxBytes = def.MaxBytes
+	}
+	if p.MaxAge == 0 {
+		p.MaxAge = def.MaxAge
+	}
+	return p
+}
+
+func segmentName(start int64) string {
+	return fmt.Sprintf("%016x%s", start, segmentSuffix)
+}
+
+// upgradeFile converts a stream stored in a single file at dir, as streams
+// were before they were split in segments, to a directory holding that file
+// as its first segment. The file is moved aside while the directory is
+// created, so that a conversion cut short by a crash is completed on the
+// next open.
+func upgradeFile(dir string) error {
+	aside := path.Join(path.Dir(dir), "."+path.Base(dir)+".upgrade")
+	fi, err := os.Stat(dir)
+	switch {
+	case err == nil && !fi.IsDir():
+		if err = os.Rename(dir, aside); err != nil {
+			return err
+		}
+	case err == nil || os.IsNotExist(err):
+		if _, err = os.Stat(aside); err != nil {
+			// nothing to convert
+			return nil
+		}
+	default:
+		return err
+	}
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err = os.Rename(aside, path.Join(dir, segmentName(0))); err != nil {
+		return err
+	}
+	log.Printf("streams: converted %v to a segmented stream", dir)
+	return nil
+}
+
+// openSegments opens the segment files of the stream, creating the first
+// segment of a new stream, and recovers the tail of the stream.
+func (s *AppendStream) openSegments() error {
+	names, err := fileutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		// skip the backups left by repair
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		start, err := strconv.ParseInt(strings.TrimSuffix(name, segmentSuffix), 16, 64)
+		if err != nil {
+			log.Printf("streams: ignoring unexpected file %v in %v", name, s.dir)
+			continue
+		}
+		fd, err := os.OpenFile(path.Join(s.dir, name), os.O_RDWR, 0600)
+		if err != nil {
+			return err
+		}
+		openFiles.Inc()
+		s.segments = append(s.segments, &segment{start: start, fd: fd})
+	}
+
+	if len(s.segments) == 0 {
+		seg, err := s.createSegment(0)
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+	}
+	return s.recoverTail()
+}
+
+// createSegment creates an empty segment file starting at the given offset.
+func (s *AppendStream) createSegment(start int64) (*segment, error) {
+	fd, err := os.OpenFile(s.segmentPath(start), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	openFiles.Inc()
+	return &segment{start: start, fd: fd}, nil
+}
+
+// segmentPath returns the path of the file of the segment starting at the
+// given offset.
+func (s *AppendStream) segmentPath(start int64) string {
+	return path.Join(s.dir, segmentName(start))
+}
+
+// segmentFor returns the segment holding the entry at pos. The caller must
+// hold segmentsMutex.
+func (s *AppendStream) segmentFor(pos int64) (*segment, error) {
+	if len(s.segments) == 0 || pos < s.segments[0].start {
+		return nil, ErrOffsetCompacted
+	}
+	i := sort.Search(len(s.segments), func(i int) bool { return s.segments[i].start > pos })
+	return s.segments[i-1], nil
+}
+
+// closeSegments closes the files of all segments, which are already
+// closed if the stream is released.
+func (s *AppendStream) closeSegments() error {
+	var err error
+	for _, seg := range s.segments {
+		if seg.fd == nil {
+			continue
+		}
+		if cerr := seg.fd.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		openFiles.Dec()
+	}
+	return err
+}
+
+// removeSegments closes and deletes all segments. The caller must hold
+// both offsetMutex and segmentsMutex.
+func (s *AppendStream) removeSegments() error {
+	s.closeSegments()
+	for _, seg := range s.segments {
+		dropUnsynced(seg)
+		if err := os.Remove(s.segmentPath(seg.start)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	s.segments = nil
+	return nil
+}
+
+// GetStart returns the offset of the first retained entry of the stream.
+func (s *AppendStream) GetStart() int64 {
+	return atomic.LoadInt64(&s.startOffset)
+}
+
+// Trim drops the segments holding only entries before the given offset,
+// and returns the offset of the first retained entry. The last segment is
+// never dropped, so entries before the offset may still be retained.
+func (s *AppendStream) Trim(before int64) (int64, error) {
+	s.offsetMutex.Lock()
+	defer s.offsetMutex.Unlock()
+
+	return s.trim(before)
+}
+
+// Retain trims the stream as required by the retention policy at the given
+// time, and returns the offset of the first retained entry.
+func (s *AppendStream) Retain(policy RetentionPolicy, now time.Time) (int64, error) {
+	s.offsetMutex.Lock()
+	defer s.offsetMutex.Unlock()
+
+	before := s.segments[0].start
+	for _, seg := range s.segments[:len(s.segments)-1] {
+		end := seg.start + seg.size
+		if policy.retains(now, s.nextOffset, end, seg.lastAppend) {
+			break
+		}
+		before = end
+	}
+	return s.trim(before)
+}
+
+// retains reports whether the policy retains a segment ending at end, last
+// appended to at lastAppend, of a stream whose tail is tail.
+func (p RetentionPolicy) retains(now time.Time, tail, end, lastAppend int64) bool {
+	expired := p.MaxAge > 0 && lastAppend != 0 &&
+		now.UnixNano()-lastAppend >= p.MaxAge*int64(time.Second)
+	oversized := p.MaxBytes > 0 && tail-end >= p.MaxBytes
+	return !expired && !oversized
+}
+
+// trim implements Trim. The caller must hold offsetMutex.
+func (s *AppendStream) trim(before int64) (int64, error) {
+	n := 0
+	for n < len(s.segments)-1 && s.segments[n].start+s.segments[n].size <= before {
+		n++
+	}
+	if n == 0 {
+		return s.segments[0].start, nil
+	}
+
+	dropped := s.segments[:n]
+	s.segmentsMutex.Lock()
+	s.segments = append([]*segment(nil), s.segments[n:]...)
+	s.segmentsMutex.Unlock()
+	atomic.StoreInt64(&s.startOffset, s.segments[0].start)
+
+	log.Printf("streams: trimmed %v to offset %d", s.streamKey, s.segments[0].start)
+	for _, seg := range dropped {
+		atomic.AddInt64(&s.entryCount, -seg.entries)
+		dropUnsynced(seg)
+		if seg.fd != nil {
+			seg.fd.Close()
+			openFiles.Dec()
+		}
+		if err := os.Remove(s.segmentPath(seg.start)); err != nil {
+			return 0, err
+		}
+	}
+	return s.segments[0].start, nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	etcdErr "github.com/coreos/etcd/error"
+)
+
+// cursorsDir is the path element under a stream which holds its cursors.
+const cursorsDir = "cursors"
+
+// CursorInfo describes a consumer cursor of a stream. Offset is the
+// committed offset of the consumer, and Lag the number of bytes of entries
+// from it to the tail of the stream.
+type CursorInfo struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Lag    int64  `json:"lag"`
+}
+
+// SplitStreamCursorPath splits the path of the cursors of a stream,
+// "<stream>/cursors", or of a single cursor, "<stream>/cursors/<name>", into
+// the path of the stream and the name of the cursor. The name is empty for
+// the path of all cursors. ok is false if nodePath is not a cursor path.
+func SplitStreamCursorPath(nodePath string) (streamPath, name string, ok bool) {
+	if !strings.HasPrefix(nodePath, PREFIX) {
+		return "", "", false
+	}
+	parts := strings.Split(nodePath[len(PREFIX):], "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[1] != cursorsDir {
+		return "", "", false
+	}
+	if len(parts) == 3 {
+		if parts[2] == "" {
+			return "", "", false
+		}
+		name = parts[2]
+	}
+	return PREFIX + parts[0], name, true
+}
+
+// StreamCommitCursor sets the cursor at nodePath to the given offset,
+// creating the cursor if needed. The offset must be that of a retained
+// entry, or the tail of the stream, so that the consumers can resume from
+// it.
+func (s *streamsStore) StreamCommitCursor(nodePath string, offset int64) (*Event, error) {
+	streamPath, name, ok := SplitStreamCursorPath(nodePath)
+	if !ok || name == "" {
+		return nil, etcdErr.NewError(etcdErr.EcodeInvalidField, nodePath, s.store.CurrentIndex)
+	}
+	stream, err := s.getStream(streamPath, false)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset > stream.GetTail() {
+		cause := fmt.Sprintf("offset %x beyond tail %x", offset, stream.GetTail())
+		return nil, etcdErr.NewError(etcdErr.EcodeInvalidField, cause, s.store.CurrentIndex)
+	}
+	if offset < stream.GetStart() {
+		cause := path.Join(streamPath, strconv.FormatInt(offset, 16))
+		return nil, etcdErr.NewError(etcdErr.EcodeOffsetCompacted, cause, s.store.CurrentIndex)
+	}
+	// an offset within an entry is only found out by reading the entry
+	if offset < stream.GetTail() {
+		if _, err = stream.ReadEntry(offset); err != nil {
+			cause := fmt.Sprintf("offset %x not at an entry", offset)
+			return nil, etcdErr.NewError(etcdErr.EcodeInvalidField, cause, s.store.CurrentIndex)
+		}
+	}
+
+	s.mutex.Lock()
+	cursors, ok := s.cursors[streamPath]
+	if !ok {
+		cursors = make(map[string]int64)
+		s.cursors[streamPath] = cursors
+	}
+	cursors[name] = offset
+	s.mutex.Unlock()
+
+	value := strconv.FormatInt(offset, 16)
+	return &Event{
+		Action: Set,
+		Node: &NodeExtern{
+			Key:   nodePath,
+			Value: &value,
+		},
+	}, nil
+}
+
+// StreamDeleteCursor removes the cursor at nodePath.
+func (s *streamsStore) StreamDeleteCursor(nodePath string) (*Event, error) {
+	streamPath, name, ok := SplitStreamCursorPath(nodePath)
+	if !ok || name == "" {
+		return nil, etcdErr.NewError(etcdErr.EcodeInvalidField, nodePath, s.store.CurrentIndex)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.cursors[streamPath][name]; !ok {
+		return nil, etcdErr.NewError(etcdErr.EcodeKeyNotFound, nodePath, s.store.CurrentIndex)
+	}
+	delete(s.cursors[streamPath], name)
+	if len(s.cursors[streamPath]) == 0 {
+		delete(s.cursors, streamPath)
+	}
+
+	return &Event{
+		Action: Delete,
+		Node: &NodeExtern{
+			Key: nodePath,
+		},
+	}, nil
+}
+
+// StreamCursors returns the cursor at nodePath, or all the cursors of a
+// stream sorted by name if nodePath names no cursor.
+func (s *streamsStore) StreamCursors(nodePath string) ([]*CursorInfo, error) {
+	streamPath, name, ok := SplitStreamCursorPath(nodePath)
+	if !ok {
+		return nil, etcdErr.NewError(etcdErr.EcodeInvalidField, nodePath, s.store.CurrentIndex)
+	}
+	stream, err := s.getStream(streamPath, false)
+	if err != nil {
+		return nil, err
+	}
+	tail := stream.GetTail()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cursors := s.cursors[streamPath]
+	if name != "" {
+		offset, ok := cursors[name]
+		if !ok {
+			return nil, etcdErr.NewError(etcdErr.EcodeKeyNotFound, nodePath, s.store.CurrentIndex)
+		}
+		return []*CursorInfo{{Name: name, Offset: offset, Lag: tail - offset}}, nil
+	}
+
+	infos := make([]*CursorInfo, 0, len(cursors))
+	for name, offset := range cursors {
+		infos = append(infos, &CursorInfo{Name: name, Offset: offset, Lag: tail - offset})
+	}
+	sort.Sort(cursorInfos(infos))
+	return infos, nil
+}
+
+// cursorOffset returns the committed offset of the cursor at nodePath.
+func (s *streamsStore) cursorOffset(nodePath string) (int64, error) {
+	if _, name, ok := SplitStreamCursorPath(nodePath); !ok || name == "" {
+		return 0, etcdErr.NewError(etcdErr.EcodeInvalidField, nodePath, s.store.CurrentIndex)
+	}
+	infos, err := s.StreamCursors(nodePath)
+	if err != nil {
+		return 0, err
+	}
+	return infos[0].Offset, nil
+}
+
+type cursorInfos []*CursorInfo
+
+func (c cursorInfos) Len() int           { return len(c) }
+func (c cursorInfos) Less(i, j int) bool { return c[i].Name < c[j].Name }
+func (c cursorInfos) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
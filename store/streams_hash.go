@@ -0,0 +1,263 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"sort"
+
+	etcdErr "github.com/coreos/etcd/error"
+	"github.com/coreos/etcd/store/streams"
+)
+
+// maxStreamCheckpoints bounds the checkpoints kept for each stream, and so
+// how far back the hash of a busy stream can be taken.
+const maxStreamCheckpoints = 1000
+
+// StreamHash is the hash of the entries a stream retained as of a raft
+// index, between its start and its tail.
+type StreamHash struct {
+	Id    string `json:"id"`
+	Start int64  `json:"start"`
+	Tail  int64  `json:"tail"`
+	Hash  uint32 `json:"hash"`
+}
+
+// StreamHashes holds the hashes of streams as of the given raft index.
+// Members which applied the same entries have the same hashes.
+type StreamHashes struct {
+	Index   uint64        `json:"index"`
+	Streams []*StreamHash `json:"streams"`
+}
+
+// streamCheckpoint records the retained entries of a stream as of a raft
+// index.
+type streamCheckpoint struct {
+	index       uint64
+	start, tail int64
+}
+
+// streamCheckpoints are the checkpoints of a single stream, oldest first.
+type streamCheckpoints struct {
+	list []streamCheckpoint
+	// created reports whether the stream did not exist before its first
+	// checkpoint.
+	created bool
+}
+
+// at returns the latest checkpoint as of index.
+func (cps *streamCheckpoints) at(index uint64) (streamCheckpoint, bool) {
+	i := sort.Search(len(cps.list), func(i int) bool { return cps.list[i].index > index })
+	if i == 0 {
+		return streamCheckpoint{}, false
+	}
+	return cps.list[i-1], true
+}
+
+func (cps *streamCheckpoints) add(cp streamCheckpoint) {
+	if n := len(cps.list); n > 0 && cps.list[n-1].index == cp.index {
+		cps.list[n-1] = cp
+		return
+	}
+	if len(cps.list) >= maxStreamCheckpoints {
+		copy(cps.list, cps.list[1:])
+		cps.list = cps.list[:len(cps.list)-1]
+		cps.created = false
+	}
+	cps.list = append(cps.list, cp)
+}
+
+// StreamCheckpoint records that the streams hold the entries applied up to
+// the given raft index. It is called once every entry is applied, and once
+// the store is loaded, so that the checkpoints of the streams changed since
+// the previous call fix their entries as of index.
+func (s *streamsStore) StreamCheckpoint(index uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.checkpointed {
+		// every stream is as loaded until it is changed, which opens it
+		for key := range s.streams {
+			s.dirty[key] = true
+		}
+		s.baseIndex = index
+		s.checkpointed = true
+		// the events of the streams before they were loaded are unknown
+		s.watcherHub.EventHistory.reset(index + 1)
+	}
+	for key := range s.dirty {
+		stream, ok := s.streams[key]
+		if !ok {
+			// the entries of a removed stream are gone, so the streams
+			// can only be hashed from now on
+			delete(s.checkpoints, key)
+			s.removedIndex = index
+			continue
+		}
+		cps, ok := s.checkpoints[key]
+		if !ok {
+			cps = new(streamCheckpoints)
+			s.checkpoints[key] = cps
+		}
+		cps.add(streamCheckpoint{index: index, start: stream.GetStart(), tail: stream.GetTail()})
+	}
+	s.dirty = make(map[string]bool)
+	s.appliedIndex = index
+}
+
+// touch marks the stream at key as changed since the last checkpoint, and
+// counts the bytes it now retains.
+func (s *streamsStore) touch(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dirty[key] = true
+	s.recount(key)
+}
+
+// opened gives a stream which has just been opened its first checkpoint.
+// The caller must hold the mutex. An existing stream holds the entries it
+// was loaded with, as any change since would have opened it, while a
+// created one did not exist before.
+func (s *streamsStore) opened(key string, stream streams.Stream, created bool) {
+	if !s.checkpointed {
+		return
+	}
+	cps := &streamCheckpoints{created: created}
+	if created {
+		s.dirty[key] = true
+	} else {
+		cps.add(streamCheckpoint{index: s.baseIndex, start: stream.GetStart(), tail: stream.GetTail()})
+	}
+	s.checkpoints[key] = cps
+}
+
+// resetCheckpoints drops the checkpoints of the streams, which are being
+// replaced, until the next call to StreamCheckpoint.
+func (s *streamsStore) resetCheckpoints() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.checkpoints = make(map[string]*streamCheckpoints)
+	s.dirty = make(map[string]bool)
+	s.checkpointed = false
+	s.baseIndex, s.appliedIndex, s.removedIndex = 0, 0, 0
+}
+
+// streamHashRange is a range of a stream to be hashed.
+type streamHashRange struct {
+	key    string
+	stream streams.Stream
+	streamCheckpoint
+}
+
+// streamHashRanges returns the ranges of the stream at nodePath, or of
+// every stream for the streams root, which hold the entries retained as of
+// the given raft index, along with that index. An index of zero is the
+// latest index applied. A stream created after index is left out.
+func (s *streamsStore) streamHashRanges(nodePath string, index uint64) (uint64, []streamHashRange, error) {
+	var keys []string
+	if nodePath+"/" == PREFIX {
+		ids, err := s.streamIds()
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, id := range ids {
+			keys = append(keys, PREFIX+id)
+		}
+	} else {
+		keys = []string{nodePath}
+	}
+	opened := make([]streams.Stream, len(keys))
+	for i, key := range keys {
+		stream, err := s.getStream(key, false)
+		if err != nil {
+			return 0, nil, err
+		}
+		opened[i] = stream
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.checkpointed {
+		return 0, nil, etcdErr.NewError(etcdErr.EcodeRaftInternal, "streams not checkpointed", s.store.CurrentIndex)
+	}
+	if index == 0 {
+		index = s.appliedIndex
+	}
+	if index > s.appliedIndex {
+		cause := fmt.Sprintf("index %d not applied [%d]", index, s.appliedIndex)
+		return 0, nil, etcdErr.NewError(etcdErr.EcodeInvalidField, cause, s.store.CurrentIndex)
+	}
+	from := maxUint64(s.removedIndex, s.baseIndex)
+	for key := range s.dirty {
+		if _, ok := s.streams[key]; !ok {
+			// removed by the entry being applied
+			from = s.appliedIndex + 1
+		}
+	}
+	if index < from {
+		cause := fmt.Sprintf("the streams can be hashed from index %d", from)
+		return 0, nil, etcdErr.NewError(etcdErr.EcodeEventIndexCleared, cause, s.store.CurrentIndex)
+	}
+
+	var ranges []streamHashRange
+	for i, key := range keys {
+		cps, ok := s.checkpoints[key]
+		if !ok {
+			return 0, nil, fmt.Errorf("store: no checkpoint of stream %s", key)
+		}
+		cp, ok := cps.at(index)
+		if !ok {
+			if cps.created {
+				continue
+			}
+			cause := fmt.Sprintf("%s [%d]", key, index)
+			return 0, nil, etcdErr.NewError(etcdErr.EcodeEventIndexCleared, cause, s.store.CurrentIndex)
+		}
+		ranges = append(ranges, streamHashRange{key: key, stream: opened[i], streamCheckpoint: cp})
+	}
+	return index, ranges, nil
+}
+
+// hashRanges hashes the entries of the given ranges. As the ranges fix the
+// entries hashed, the streams may be appended to meanwhile. Errors carry
+// the given store index.
+func hashRanges(ranges []streamHashRange, etcdIndex uint64) ([]*StreamHash, error) {
+	hashes := make([]*StreamHash, 0, len(ranges))
+	for _, r := range ranges {
+		h, err := r.stream.Hash(r.start, r.tail)
+		if err == streams.ErrOffsetCompacted {
+			// trimmed since the checkpoint
+			return nil, etcdErr.NewError(etcdErr.EcodeEventIndexCleared, r.key, etcdIndex)
+		}
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, &StreamHash{
+			Id:    r.key[len(PREFIX):],
+			Start: r.start,
+			Tail:  r.tail,
+			Hash:  h,
+		})
+	}
+	return hashes, nil
+}
+
+func maxUint64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -1,47 +1,184 @@
 package store
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
-	"github.com/coreos/etcd/store/streams"
-	"sync"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
-	"fmt"
+	"sync"
+	"time"
+
+	etcdErr "github.com/coreos/etcd/error"
+	"github.com/coreos/etcd/store/streams"
 )
 
 const PREFIX string = "/2/"
 
 type StreamsStore interface {
-	StreamAppend(nodePath string, value []byte) (*Event, error)
+	StreamAppend(nodePath string, value []byte, now time.Time) (*Event, error)
+	StreamAppendBatch(nodePath string, values [][]byte, now time.Time) (*Event, error)
+	StreamCompareAndAppend(nodePath string, prevTail int64, value []byte, now time.Time) (*Event, error)
+	StreamCompareAndAppendBatch(nodePath string, prevTail int64, values [][]byte, now time.Time) (*Event, error)
 	StreamGet(nodePath string) (*Event, error)
+	StreamGetEntry(nodePath string) (*Event, *streams.Entry, error)
+	StreamReadRange(nodePath string, options streams.RangeOptions) (*streams.Range, error)
+	StreamList() ([]*StreamInfo, error)
+	StreamDelete(nodePath string) (*Event, error)
+	StreamTrim(nodePath string, before int64) (*Event, error)
+	StreamSetRetention(nodePath string, policy streams.RetentionPolicy) (*Event, error)
+	StreamRetain(now time.Time)
+	StreamCommitCursor(nodePath string, offset int64) (*Event, error)
+	StreamDeleteCursor(nodePath string) (*Event, error)
+	StreamCursors(nodePath string) ([]*CursorInfo, error)
+	StreamCheckpoint(index uint64)
+	StreamCheckQuota(nodePath string, n int64) error
+}
+
+// StreamInfo describes a single stream. Start is the offset of the first
+// retained entry, and Size and Entries count the retained entries.
+type StreamInfo struct {
+	Id           string                   `json:"id"`
+	Start        int64                    `json:"start"`
+	Size         int64                    `json:"size"`
+	Entries      int64                    `json:"entries"`
+	CreatedIndex uint64                   `json:"createdIndex"`
+	Retention    *streams.RetentionPolicy `json:"retention,omitempty"`
 }
 
 type streamsStore struct {
-	basedir string
-	streams map[string]*streams.AppendStream
+	store   *store
+	backend streams.Backend
+	streams map[string]streams.Stream
 	mutex   sync.Mutex
+
+	// createdIndex holds the index at which each stream was created.
+	createdIndex map[string]uint64
+
+	// retention holds the retention policies set on single streams, which
+	// take precedence over the default retention of all streams.
+	retention        map[string]streams.RetentionPolicy
+	defaultRetention streams.RetentionPolicy
+
+	// cursors holds the committed offsets of the consumer cursors of each
+	// stream, by cursor name.
+	cursors map[string]map[string]int64
+
+	// tails is the number of active tails.
+	tails int64
+
+	// watcherHub holds the watchers of the streams, and the history of
+	// their events. It is apart from the watchers of the keys as the
+	// events of the streams are indexed by raft index rather than by the
+	// index of the store.
+	watcherHub *watcherHub
+
+	// checkpoints holds the recent checkpoints of each stream, and dirty
+	// the streams changed since the last one, so that the streams can be
+	// hashed as of a past raft index. Checkpoints are taken once the store
+	// is loaded at baseIndex, and up to appliedIndex since. Streams removed
+	// at removedIndex cannot be hashed before it.
+	checkpoints  map[string]*streamCheckpoints
+	dirty        map[string]bool
+	checkpointed bool
+	baseIndex    uint64
+	appliedIndex uint64
+	removedIndex uint64
+
+	// quotaBytes and totalQuotaBytes bound the bytes retained by a stream
+	// and by all of them, if non-zero. Once allOpen is set, every stream
+	// of the backend is open, so that streams holds all of them.
+	quotaBytes      int64
+	totalQuotaBytes int64
+	allOpen         bool
+
+	// retained holds the bytes retained by each open stream, and
+	// totalRetained their sum, as counted when the streams last changed.
+	retained      map[string]int64
+	totalRetained int64
+
+	// cloneErr records a failure to clone the streams, which is reported
+	// when the clone is saved.
+	cloneErr error
+}
+
+// streamsState is the saved state of the streams in a store snapshot.
+type streamsState struct {
+	Retention streams.RetentionPolicy `json:"retention"`
+	Streams   []streamState           `json:"streams"`
+}
+
+// streamState is the saved state of a single stream in a store snapshot.
+type streamState struct {
+	Id           string                   `json:"id"`
+	CreatedIndex uint64                   `json:"createdIndex"`
+	Retention    *streams.RetentionPolicy `json:"retention,omitempty"`
+	Cursors      map[string]int64         `json:"cursors,omitempty"`
+	Segments     []streams.SegmentState   `json:"segments"`
+}
+
+func newStreamsStore(st *store, backend streams.Backend) *streamsStore {
+	s := new(streamsStore)
+	s.store = st
+	s.backend = backend
+	s.streams = make(map[string]streams.Stream)
+	s.createdIndex = make(map[string]uint64)
+	s.retention = make(map[string]streams.RetentionPolicy)
+	s.cursors = make(map[string]map[string]int64)
+	s.checkpoints = make(map[string]*streamCheckpoints)
+	s.dirty = make(map[string]bool)
+	s.retained = make(map[string]int64)
+	s.watcherHub = newWatchHub(1000)
+	return s
 }
 
-func (s *streamsStore) init(basedir string) {
-	s.streams = make(map[string]*streams.AppendStream)
-	s.basedir = basedir
+func (s *streamsStore) StreamAppend(nodePath string, value []byte, now time.Time) (*Event, error) {
+	return s.StreamCompareAndAppend(nodePath, -1, value, now)
 }
 
-func (s *streamsStore) StreamAppend(nodePath string, value []byte) (*Event, error) {
-	stream, err := s.getStream(nodePath)
+// StreamAppendBatch appends the values to the stream as consecutive
+// entries. The node of the returned event is the stream, with a child node
+// for each appended entry.
+func (s *streamsStore) StreamAppendBatch(nodePath string, values [][]byte, now time.Time) (*Event, error) {
+	return s.StreamCompareAndAppendBatch(nodePath, -1, values, now)
+}
+
+// StreamCompareAndAppend is StreamAppend, but fails with EcodeTestFailed
+// unless the tail of the stream is prevTail. A negative prevTail matches any
+// tail.
+func (s *streamsStore) StreamCompareAndAppend(nodePath string, prevTail int64, value []byte, now time.Time) (*Event, error) {
+	offsets, err := s.compareAndAppend(nodePath, prevTail, [][]byte{value}, now)
 	if err != nil {
 		return nil, err
 	}
-	pos, err := stream.Append(value)
+
+	return &Event{
+		Action: Create,
+		Node: &NodeExtern{
+			Key: nodePath + "/" + strconv.FormatInt(offsets[0], 16),
+		},
+	}, nil
+}
+
+// StreamCompareAndAppendBatch is StreamAppendBatch, but fails with
+// EcodeTestFailed unless the tail of the stream is prevTail.
+func (s *streamsStore) StreamCompareAndAppendBatch(nodePath string, prevTail int64, values [][]byte, now time.Time) (*Event, error) {
+	offsets, err := s.compareAndAppend(nodePath, prevTail, values, now)
 	if err != nil {
 		return nil, err
 	}
 
-	entryPath := nodePath + "/" + strconv.FormatInt(pos, 16)
 	node := &NodeExtern{
-		Key:           entryPath,
-		ModifiedIndex: 0,
-		CreatedIndex:  0,
+		Key:          nodePath,
+		Nodes:        make(NodeExterns, 0, len(offsets)),
+		CreatedIndex: s.streamCreatedIndex(nodePath),
+	}
+	for _, pos := range offsets {
+		node.Nodes = append(node.Nodes, &NodeExtern{
+			Key: nodePath + "/" + strconv.FormatInt(pos, 16),
+		})
 	}
 
 	return &Event{
@@ -50,18 +187,43 @@ func (s *streamsStore) StreamAppend(nodePath string, value []byte) (*Event, erro
 	}, nil
 }
 
+// compareAndAppend appends the values to the stream if its tail is
+// prevTail, and returns their offsets. Only an append expecting an empty
+// stream creates the stream.
+func (s *streamsStore) compareAndAppend(nodePath string, prevTail int64, values [][]byte, now time.Time) ([]int64, error) {
+	stream, err := s.getStream(nodePath, prevTail <= 0)
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := stream.CompareAndAppend(prevTail, values, now)
+	if err == streams.ErrTailMismatch {
+		cause := fmt.Sprintf("[%x != %x]", prevTail, stream.GetTail())
+		return nil, etcdErr.NewError(etcdErr.EcodeTestFailed, cause, s.store.CurrentIndex)
+	}
+	if err == nil {
+		s.touch(nodePath)
+	}
+	return offsets, err
+}
 
 func (s *streamsStore) StreamGet(nodePath string) (*Event, error) {
+	e, _, err := s.StreamGetEntry(nodePath)
+	return e, err
+}
+
+// StreamGetEntry is StreamGet, but also returns the entry read along with
+// its next offset and checksum. The entry is nil for the info of a stream.
+func (s *streamsStore) StreamGetEntry(nodePath string) (*Event, *streams.Entry, error) {
 	lastSlash := strings.LastIndex(nodePath, "/")
 	if lastSlash == -1 {
-		return nil, fmt.Errorf("Invalid node path")
+		return nil, nil, fmt.Errorf("Invalid node path")
 	}
 	streamPath := nodePath[:lastSlash]
 	streamOffset := nodePath[lastSlash+1:]
 
-	stream, err := s.getStream(streamPath)
+	stream, err := s.getStream(streamPath, false)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if streamOffset == "info" {
@@ -72,7 +234,7 @@ func (s *streamsStore) StreamGet(nodePath string) (*Event, error) {
 		nodePath := streamPath + "info"
 		node := &NodeExtern{
 			Key:           nodePath,
-			Value: &infoString,
+			Value:         &infoString,
 			ModifiedIndex: 0,
 			CreatedIndex:  0,
 		}
@@ -80,24 +242,27 @@ func (s *streamsStore) StreamGet(nodePath string) (*Event, error) {
 		return &Event{
 			Action: Get,
 			Node:   node,
-		}, nil
+		}, nil, nil
 	}
 
 	pos, err := strconv.ParseInt(streamOffset, 16, 64)
 	if err != nil {
-		return nil, fmt.Errorf("Not a valid offset")
+		return nil, nil, fmt.Errorf("Not a valid offset")
 	}
 
-	value, err := stream.Read(pos)
+	entry, err := stream.ReadEntry(pos)
+	if err == streams.ErrOffsetCompacted {
+		return nil, nil, etcdErr.NewError(etcdErr.EcodeOffsetCompacted, nodePath, s.store.CurrentIndex)
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	stringValue := string(value)
+	stringValue := string(entry.Value)
 
 	node := &NodeExtern{
 		Key:           nodePath,
-		Value: &stringValue,
+		Value:         &stringValue,
 		ModifiedIndex: 0,
 		CreatedIndex:  0,
 	}
@@ -105,13 +270,262 @@ func (s *streamsStore) StreamGet(nodePath string) (*Event, error) {
 	return &Event{
 		Action: Get,
 		Node:   node,
+	}, entry, nil
+}
+
+// StreamReadRange reads consecutive entries of the stream at nodePath.
+func (s *streamsStore) StreamReadRange(nodePath string, options streams.RangeOptions) (*streams.Range, error) {
+	stream, err := s.getStream(nodePath, false)
+	if err != nil {
+		return nil, err
+	}
+	r, err := stream.ReadRange(options)
+	if err == streams.ErrOffsetCompacted {
+		cause := path.Join(nodePath, strconv.FormatInt(options.From, 16))
+		return nil, etcdErr.NewError(etcdErr.EcodeOffsetCompacted, cause, s.store.CurrentIndex)
+	}
+	return r, err
+}
+
+// StreamList returns the information of every stream, sorted by id.
+func (s *streamsStore) StreamList() ([]*StreamInfo, error) {
+	ids, err := s.streamIds()
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]*StreamInfo, 0, len(ids))
+	for _, id := range ids {
+		stream, err := s.getStream(PREFIX+id, false)
+		if err != nil {
+			return nil, err
+		}
+		s.mutex.Lock()
+		info := &StreamInfo{
+			Id:           id,
+			CreatedIndex: s.createdIndex[PREFIX+id],
+		}
+		if policy, ok := s.retention[PREFIX+id]; ok {
+			info.Retention = &policy
+		}
+		s.mutex.Unlock()
+
+		info.Start = stream.GetStart()
+		info.Size = stream.GetTail() - info.Start
+		info.Entries = stream.GetEntryCount()
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// StreamDelete removes the stream at nodePath, along with its files.
+// Pending tails of the stream are ended.
+func (s *streamsStore) StreamDelete(nodePath string) (*Event, error) {
+	if _, err := s.getStream(nodePath, false); err != nil {
+		return nil, err
+	}
+	createdIndex := s.streamCreatedIndex(nodePath)
+	if err := s.removeStream(nodePath[len(PREFIX):]); err != nil {
+		return nil, err
+	}
+	s.touch(nodePath)
+
+	return &Event{
+		Action: Delete,
+		Node: &NodeExtern{
+			Key:          nodePath,
+			CreatedIndex: createdIndex,
+		},
 	}, nil
 }
 
+// StreamTrim drops the entries of the stream at nodePath before the given
+// offset. Entries are dropped a whole segment at a time, so the value of the
+// returned event, the offset of the first retained entry, may be before it.
+func (s *streamsStore) StreamTrim(nodePath string, before int64) (*Event, error) {
+	stream, err := s.getStream(nodePath, false)
+	if err != nil {
+		return nil, err
+	}
+	start, err := stream.Trim(before)
+	if err != nil {
+		return nil, err
+	}
+	s.touch(nodePath)
 
+	value := strconv.FormatInt(start, 16)
+	return &Event{
+		Action: Trim,
+		Node: &NodeExtern{
+			Key:          nodePath,
+			Value:        &value,
+			CreatedIndex: s.streamCreatedIndex(nodePath),
+		},
+	}, nil
+}
 
-func (s *streamsStore) getStream(key string) (*streams.AppendStream, error) {
-	log.Print("getStream", key)
+// StreamSetRetention sets the retention policy of the stream at nodePath,
+// or the default policy of all streams if nodePath is the streams root. A
+// zero policy removes the policy of a stream. The policy is applied by
+// StreamRetain.
+func (s *streamsStore) StreamSetRetention(nodePath string, policy streams.RetentionPolicy) (*Event, error) {
+	if nodePath+"/" == PREFIX {
+		s.mutex.Lock()
+		s.defaultRetention = policy
+		s.mutex.Unlock()
+	} else {
+		if _, err := s.getStream(nodePath, false); err != nil {
+			return nil, err
+		}
+		s.mutex.Lock()
+		if policy.IsZero() {
+			delete(s.retention, nodePath)
+		} else {
+			s.retention[nodePath] = policy
+		}
+		s.mutex.Unlock()
+	}
+
+	b, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+	value := string(b)
+	return &Event{
+		Action: Set,
+		Node: &NodeExtern{
+			Key:          nodePath,
+			Value:        &value,
+			CreatedIndex: s.streamCreatedIndex(nodePath),
+		},
+	}, nil
+}
+
+// StreamRetain trims every stream as required by its retention policy at
+// the given time. As it is applied through raft, now must be the time of
+// the request rather than the local time.
+func (s *streamsStore) StreamRetain(now time.Time) {
+	s.mutex.Lock()
+	def := s.defaultRetention
+	policies := make(map[string]streams.RetentionPolicy, len(s.retention))
+	for key, policy := range s.retention {
+		policies[key] = policy
+	}
+	s.mutex.Unlock()
+
+	var keys []string
+	if def.IsZero() {
+		for key := range policies {
+			keys = append(keys, key)
+		}
+	} else {
+		ids, err := s.streamIds()
+		if err != nil {
+			log.Printf("store: cannot list streams for retention: %v", err)
+			return
+		}
+		for _, id := range ids {
+			keys = append(keys, PREFIX+id)
+		}
+	}
+
+	for _, key := range keys {
+		policy := policies[key].Merge(def)
+		if policy.IsZero() {
+			continue
+		}
+		stream, err := s.getStream(key, false)
+		if err != nil {
+			log.Printf("store: cannot open stream %s for retention: %v", key, err)
+			continue
+		}
+		// only a stream which retention trimmed is touched, so that a sync
+		// does not take a hash checkpoint of every stream with a policy
+		before := stream.GetStart()
+		start, err := stream.Retain(policy, now)
+		if err != nil {
+			log.Printf("store: cannot apply retention to stream %s: %v", key, err)
+			continue
+		}
+		if start != before {
+			s.touch(key)
+		}
+	}
+}
+
+// StreamCheckQuota fails with EcodeQuotaExceeded if n bytes more would
+// exceed the quota of the stream at nodePath or of all the streams. The
+// bytes retained by the streams count against the quotas, so retention and
+// trims make room for more appends.
+func (s *streamsStore) StreamCheckQuota(nodePath string, n int64) error {
+	if s.quotaBytes <= 0 && s.totalQuotaBytes <= 0 {
+		return nil
+	}
+	if err := s.openAll(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	size, total := s.retained[nodePath], s.totalRetained
+	if s.quotaBytes > 0 && size+n > s.quotaBytes {
+		cause := fmt.Sprintf("%s [%d + %d > %d]", nodePath, size, n, s.quotaBytes)
+		return etcdErr.NewError(etcdErr.EcodeQuotaExceeded, cause, s.store.CurrentIndex)
+	}
+	if s.totalQuotaBytes > 0 && total+n > s.totalQuotaBytes {
+		cause := fmt.Sprintf("all streams [%d + %d > %d]", total, n, s.totalQuotaBytes)
+		return etcdErr.NewError(etcdErr.EcodeQuotaExceeded, cause, s.store.CurrentIndex)
+	}
+	return nil
+}
+
+// recount counts the bytes retained by the stream at key once it is
+// opened, changed or removed, and updates the total of all the streams.
+// The caller must hold the mutex.
+func (s *streamsStore) recount(key string) {
+	var n int64
+	if stream, ok := s.streams[key]; ok {
+		n = stream.GetTail() - stream.GetStart()
+	}
+	s.totalRetained += n - s.retained[key]
+	if n > 0 {
+		s.retained[key] = n
+	} else {
+		delete(s.retained, key)
+	}
+}
+
+// openAll opens every stream of the backend the first time it is called.
+// As streams are only created and removed through the store, the open
+// streams hold all of them from then on.
+func (s *streamsStore) openAll() error {
+	s.mutex.Lock()
+	done := s.allOpen
+	s.mutex.Unlock()
+	if done {
+		return nil
+	}
+
+	ids, err := s.streamIds()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := s.getStream(PREFIX+id, false); err != nil {
+			return err
+		}
+	}
+	s.mutex.Lock()
+	s.allOpen = true
+	s.mutex.Unlock()
+	return nil
+}
+
+// getStream returns the stream for the given key, opening it from the
+// backend if needed. Streams are kept once opened. If create is false and
+// the stream does not exist, a EcodeKeyNotFound error is returned.
+func (s *streamsStore) getStream(key string, create bool) (streams.Stream, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	stream, found := s.streams[key]
@@ -120,14 +534,242 @@ func (s *streamsStore) getStream(key string) (*streams.AppendStream, error) {
 			return nil, fmt.Errorf("Invalid prefix for stream")
 		}
 		streamId := key[len(PREFIX):]
+		if !isValidStreamId(streamId) {
+			return nil, fmt.Errorf("Invalid stream id")
+		}
 
+		var created bool
 		var err error
-		stream, err = streams.NewAppendStream(s.basedir, streamId)
+		stream, created, err = s.backend.Open(streamId, create)
+		if err == streams.ErrStreamNotFound {
+			return nil, etcdErr.NewError(etcdErr.EcodeKeyNotFound, key, s.store.CurrentIndex)
+		}
 		if err != nil {
-			log.Print("Error getting stream", err)
 			return nil, err
 		}
 		s.streams[key] = stream
+		s.recount(key)
+		if created {
+			// the stream is created by the entry being applied
+			s.createdIndex[key] = s.applyingIndex()
+		}
+		s.opened(key, stream, created)
 	}
 	return stream, nil
 }
+
+// streamCreatedIndex returns the index at which the stream at nodePath was
+// created.
+func (s *streamsStore) streamCreatedIndex(nodePath string) uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.createdIndex[nodePath]
+}
+
+// applyingIndex returns the raft index of the entry being applied, which
+// follows the last one checkpointed as StreamCheckpoint is called once
+// every entry is applied. The caller must hold the mutex.
+func (s *streamsStore) applyingIndex() uint64 {
+	return s.appliedIndex + 1
+}
+
+// watch returns a watcher of the events of the streams under key. The
+// index of the last entry applied is the index of the store for the
+// watcher, and the index the watch starts from if sinceIndex is zero.
+func (s *streamsStore) watch(key string, recursive, stream bool, sinceIndex uint64) (Watcher, error) {
+	s.mutex.Lock()
+	index := s.appliedIndex
+	s.mutex.Unlock()
+
+	if sinceIndex == 0 {
+		sinceIndex = index + 1
+	}
+	w, err := s.watcherHub.watch(key, recursive, stream, sinceIndex, index)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// setStreamNodeIndex sets the modified index of the node of a stream event,
+// and of its child nodes, to the index at which the event happened. The
+// created index is set too unless it is already known.
+func setStreamNodeIndex(n *NodeExtern, index uint64) {
+	n.ModifiedIndex = index
+	if n.CreatedIndex == 0 {
+		n.CreatedIndex = index
+	}
+	for _, child := range n.Nodes {
+		setStreamNodeIndex(child, index)
+	}
+}
+
+// isValidStreamId reports whether id can be used to name a stream file.
+func isValidStreamId(id string) bool {
+	if id == "" || strings.Contains(id, "/") {
+		return false
+	}
+	return !strings.HasPrefix(id, ".") && !strings.HasSuffix(id, ".broken")
+}
+
+// streamIds returns the ids of all the streams held by the backend.
+func (s *streamsStore) streamIds() ([]string, error) {
+	return s.backend.List()
+}
+
+// clone returns a copy of the streams store in which every stream is fixed
+// at its current tail, so that it can be saved while appends continue.
+func (s *streamsStore) clone(st *store) *streamsStore {
+	c := newStreamsStore(st, s.backend)
+	s.mutex.Lock()
+	c.defaultRetention = s.defaultRetention
+	for key, policy := range s.retention {
+		c.retention[key] = policy
+	}
+	for key, cursors := range s.cursors {
+		c.cursors[key] = copyCursors(cursors)
+	}
+	s.mutex.Unlock()
+
+	ids, err := s.streamIds()
+	if err != nil {
+		c.cloneErr = err
+		return c
+	}
+	for _, id := range ids {
+		stream, err := s.getStream(PREFIX+id, false)
+		if err != nil {
+			c.cloneErr = err
+			return c
+		}
+		if c.streams[PREFIX+id], err = stream.Clone(); err != nil {
+			c.cloneErr = err
+			return c
+		}
+		c.createdIndex[PREFIX+id] = s.createdIndex[PREFIX+id]
+	}
+	return c
+}
+
+// MarshalJSON saves the retention policies and the contents of every
+// stream.
+func (s *streamsStore) MarshalJSON() ([]byte, error) {
+	if s.cloneErr != nil {
+		return nil, s.cloneErr
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	keys := make([]string, 0, len(s.streams))
+	for key := range s.streams {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	state := streamsState{
+		Retention: s.defaultRetention,
+		Streams:   make([]streamState, 0, len(keys)),
+	}
+	for _, key := range keys {
+		segments, err := s.streams[key].SaveNoCopy()
+		if err != nil {
+			return nil, err
+		}
+		ss := streamState{
+			Id:           key[len(PREFIX):],
+			CreatedIndex: s.createdIndex[key],
+			Segments:     segments,
+		}
+		if policy, ok := s.retention[key]; ok {
+			ss.Retention = &policy
+		}
+		if cursors, ok := s.cursors[key]; ok {
+			ss.Cursors = copyCursors(cursors)
+		}
+		state.Streams = append(state.Streams, ss)
+	}
+	return json.Marshal(state)
+}
+
+// UnmarshalJSON replaces the contents of the streams with the saved state.
+func (s *streamsStore) UnmarshalJSON(b []byte) error {
+	var state streamsState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+	return s.recovery(state)
+}
+
+// recovery rewinds the streams to the given state. Streams which are not
+// part of the state are removed, and no stream can be hashed until the next
+// checkpoint.
+func (s *streamsStore) recovery(state streamsState) error {
+	s.resetCheckpoints()
+	s.mutex.Lock()
+	s.defaultRetention = state.Retention
+	s.retention = make(map[string]streams.RetentionPolicy)
+	s.cursors = make(map[string]map[string]int64)
+	s.mutex.Unlock()
+
+	recovered := make(map[string]bool)
+	for _, ss := range state.Streams {
+		stream, err := s.getStream(PREFIX+ss.Id, true)
+		if err != nil {
+			return err
+		}
+		if err = stream.Recovery(ss.Segments); err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		s.recount(PREFIX + ss.Id)
+		s.createdIndex[PREFIX+ss.Id] = ss.CreatedIndex
+		if ss.Retention != nil {
+			s.retention[PREFIX+ss.Id] = *ss.Retention
+		}
+		if len(ss.Cursors) > 0 {
+			s.cursors[PREFIX+ss.Id] = copyCursors(ss.Cursors)
+		}
+		s.mutex.Unlock()
+		recovered[ss.Id] = true
+	}
+
+	ids, err := s.streamIds()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if !recovered[id] {
+			if err = s.removeStream(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeStream closes the stream with the given id and removes it from the
+// backend.
+func (s *streamsStore) removeStream(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if stream, ok := s.streams[PREFIX+id]; ok {
+		stream.Close()
+		delete(s.streams, PREFIX+id)
+		s.recount(PREFIX + id)
+	}
+	delete(s.createdIndex, PREFIX+id)
+	delete(s.retention, PREFIX+id)
+	delete(s.cursors, PREFIX+id)
+	return s.backend.Remove(id)
+}
+
+func copyCursors(cursors map[string]int64) map[string]int64 {
+	c := make(map[string]int64, len(cursors))
+	for name, offset := range cursors {
+		c[name] = offset
+	}
+	return c
+}
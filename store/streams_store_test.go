@@ -0,0 +1,720 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+	etcdErr "github.com/coreos/etcd/error"
+	"github.com/coreos/etcd/store/streams"
+)
+
+func newStreamsTestDir(t *testing.T) string {
+	p, err := ioutil.TempDir(os.TempDir(), "streamsstoretest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// Ensure that the streams are saved as of the clone, and that recovery
+// rewinds the streams to the saved state.
+func TestStoreRecoverStreams(t *testing.T) {
+	dir := newStreamsTestDir(t)
+	defer os.RemoveAll(dir)
+	s := newStore(dir)
+	s.StreamAppend("/2/foo", []byte("a"), time.Time{})
+	s.StreamAppend("/2/foo", []byte("bb"), time.Time{})
+	s.StreamAppend("/2/bar", []byte("c"), time.Time{})
+
+	c := s.Clone()
+	// appended after the clone, so must not be part of the snapshot
+	s.StreamAppend("/2/foo", []byte("ddd"), time.Time{})
+	b, err := c.SaveNoCopy()
+	assert.Nil(t, err, "")
+
+	dir2 := newStreamsTestDir(t)
+	defer os.RemoveAll(dir2)
+	s2 := newStore(dir2)
+	s2.StreamAppend("/2/foo", []byte("x"), time.Time{})
+	s2.StreamAppend("/2/foo", []byte("xx"), time.Time{})
+	s2.StreamAppend("/2/foo", []byte("xxx"), time.Time{})
+	s2.StreamAppend("/2/baz", []byte("y"), time.Time{})
+	err = s2.Recovery(b)
+	assert.Nil(t, err, "")
+
+	e, err := s2.StreamGet("/2/foo/info")
+	assert.Nil(t, err, "")
+	assert.Equal(t, *e.Node.Value, "13", "")
+	e, err = s2.StreamGet("/2/foo/9")
+	assert.Nil(t, err, "")
+	assert.Equal(t, *e.Node.Value, "bb", "")
+	e, err = s2.StreamGet("/2/bar/0")
+	assert.Nil(t, err, "")
+	assert.Equal(t, *e.Node.Value, "c", "")
+	_, err = os.Stat(path.Join(dir2, "baz"))
+	assert.True(t, os.IsNotExist(err), "")
+
+	// appends continue from the recovered tail
+	e, err = s2.StreamAppend("/2/foo", []byte("ddd"), time.Time{})
+	assert.Nil(t, err, "")
+	assert.Equal(t, e.Node.Key, "/2/foo/13", "")
+}
+
+// Ensure that a store whose streams are held in memory recovers the streams
+// saved by a store holding them in files, and lists and deletes them.
+func TestStoreStreamsMemoryBackend(t *testing.T) {
+	dir := newStreamsTestDir(t)
+	defer os.RemoveAll(dir)
+	s := newStore(dir)
+	s.StreamAppend("/2/foo", []byte("a"), time.Time{})
+	s.StreamAppend("/2/foo", []byte("bb"), time.Time{})
+	s.StreamAppend("/2/bar", []byte("c"), time.Time{})
+	b, err := s.Clone().SaveNoCopy()
+	assert.Nil(t, err, "")
+
+	m := NewWithStreams("", StreamsConfig{Backend: streams.NewMemoryBackend(0)})
+	m.StreamAppend("/2/baz", []byte("y"), time.Time{})
+	err = m.Recovery(b)
+	assert.Nil(t, err, "")
+
+	e, err := m.StreamGet("/2/foo/9")
+	assert.Nil(t, err, "")
+	assert.Equal(t, *e.Node.Value, "bb", "")
+	e, err = m.StreamAppend("/2/foo", []byte("ddd"), time.Time{})
+	assert.Nil(t, err, "")
+	assert.Equal(t, e.Node.Key, "/2/foo/13", "")
+
+	infos, err := m.StreamList()
+	assert.Nil(t, err, "")
+	assert.Equal(t, len(infos), 2, "")
+	assert.Equal(t, infos[0].Id, "bar", "")
+	assert.Equal(t, infos[1].Entries, int64(3), "")
+
+	_, err = m.StreamDelete("/2/bar")
+	assert.Nil(t, err, "")
+	_, err = m.StreamGet("/2/bar/0")
+	assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeKeyNotFound, "")
+}
+
+// Ensure that reading an entry returns it along with the offset of the next
+// entry and its checksum.
+func TestStoreStreamGetEntry(t *testing.T) {
+	dir := newStreamsTestDir(t)
+	defer os.RemoveAll(dir)
+	s := newStore(dir)
+	s.StreamAppend("/2/foo", []byte("a"), time.Time{})
+	s.StreamAppend("/2/foo", []byte("\x00\xff"), time.Time{})
+
+	e, entry, err := s.StreamGetEntry("/2/foo/9")
+	assert.Nil(t, err, "")
+	assert.Equal(t, *e.Node.Value, "\x00\xff", "")
+	assert.Equal(t, entry.Offset, int64(9), "")
+	assert.Equal(t, entry.Next, int64(0x13), "")
+	assert.Equal(t, entry.Checksum, crc32.Checksum([]byte("\x00\xff"), crc32.MakeTable(crc32.Castagnoli)), "")
+	assert.Equal(t, entry.Value, []byte("\x00\xff"), "")
+
+	_, entry, err = s.StreamGetEntry("/2/foo/info")
+	assert.Nil(t, err, "")
+	assert.Nil(t, entry, "")
+	assert.Equal(t, s.Stats.GetSuccess, uint64(2), "")
+}
+
+// Ensure that a range read returns consecutive entries and the offset to
+// continue from.
+func TestStoreStreamReadRange(t *testing.T) {
+	dir := newStreamsTestDir(t)
+	defer os.RemoveAll(dir)
+	s := newStore(dir)
+	s.StreamAppend("/2/foo", []byte("a"), time.Time{})
+	s.StreamAppend("/2/foo", []byte("bb"), time.Time{})
+	s.StreamAppend("/2/foo", []byte("c"), time.Time{})
+
+	r, err := s.StreamReadRange("/2/foo", streams.RangeOptions{From: 0, Limit: 2})
+	assert.Nil(t, err, "")
+	assert.Equal(t, len(r.Entries), 2, "")
+	assert.Equal(t, r.Entries[0].Value, []byte("a"), "")
+	assert.Equal(t, r.Entries[1].Offset, int64(9), "")
+	assert.Equal(t, r.Entries[1].Value, []byte("bb"), "")
+	assert.Equal(t, r.Next, int64(0x13), "")
+
+	r, err = s.StreamReadRange("/2/foo", streams.RangeOptions{From: r.Next})
+	assert.Nil(t, err, "")
+	assert.Equal(t, len(r.Entries), 1, "")
+	assert.Equal(t, r.Next, int64(0x1c), "")
+	assert.Equal(t, s.Stats.GetSuccess, uint64(2), "")
+
+	_, err = s.StreamReadRange("/2/bar", streams.RangeOptions{})
+	assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeKeyNotFound, "")
+	assert.Equal(t, s.Stats.GetFail, uint64(1), "")
+}
+
+// Ensure that streams whose files are closed by the file cache are read
+// and appended to as before.
+func TestStoreStreamFileCache(t *testing.T) {
+	dir := newStreamsTestDir(t)
+	defer os.RemoveAll(dir)
+	s := newStore(dir)
+	backend := streams.NewFileBackend(dir, streams.SyncPolicy{}, 1, 0)
+	s.Streams.backend = backend
+	files := backend.Files()
+	s.StreamAppend("/2/foo", []byte("a"), time.Time{})
+	s.StreamAppend("/2/bar", []byte("b"), time.Time{})
+	assert.Equal(t, files.OpenStreams(), 1, "")
+	assert.Equal(t, files.Evicted(), int64(1), "")
+
+	e, err := s.StreamAppend("/2/foo", []byte("c"), time.Time{})
+	assert.Nil(t, err, "")
+	assert.Equal(t, e.Node.Key, "/2/foo/9", "")
+	e, err = s.StreamGet("/2/bar/0")
+	assert.Nil(t, err, "")
+	assert.Equal(t, *e.Node.Value, "b", "")
+	assert.Equal(t, files.Evicted(), int64(3), "")
+
+	infos, err := s.StreamList()
+	assert.Nil(t, err, "")
+	assert.Equal(t, infos[1].Id, "foo", "")
+	assert.Equal(t, infos[1].Size, int64(0x12), "")
+}
+
+// Ensure that a batch is appended as consecutive entries, and that the
+// event holds the offsets of all of them.
+func TestStoreStreamAppendBatch(t *testing.T) {
+	dir := newStreamsTestDir(t)
+	defer os.RemoveAll(dir)
+	s := newStore(dir)
+	s.StreamAppend("/2/foo", []byte("a"), time.Time{})
+
+	e, err := s.StreamAppendBatch("/2/foo", [][]byte{[]byte("bb"), []byte("c")}, time.Time{})
+	assert.Nil(t, err, "")
+	assert.Equal(t, e.Action, "create", "")
+	assert.Equal(t, e.Node.Key, "/2/foo", "")
+	assert.Equal(t, len(e.Node.Nodes), 2, "")
+	assert.Equal(t, e.Node.Nodes[0].Key, "/2/foo/9", "")
+	assert.Equal(t, e.Node.Nodes[1].Key, "/2/foo/13", "")
+
+	e, err = s.StreamGet("/2/foo/13")
+	assert.Nil(t, err, "")
+	assert.Equal(t, *e.Node.Value, "c", "")
+}
+
+// Ensure that a conditional append only succeeds at the expected tail.
+func TestStoreStreamCompareAndAppend(t *testing.T) {
+	dir := newStreamsTestDir(t)
+	defer os.RemoveAll(dir)
+	s := newStore(dir)
+
+	// a missing stream is only created by expecting an empty stream
+	_, err := s.StreamCompareAndAppend("/2/foo", 9, []byte("a"), time.Time{})
+	assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeKeyNotFound, "")
+	e, err := s.StreamCompareAndAppend("/2/foo", 0, []byte("a"), time.Time{})
+	assert.Nil(t, err, "")
+	assert.Equal(t, e.Node.Key, "/2/foo/0", "")
+
+	_, err = s.StreamCompareAndAppend("/2/foo", 0, []byte("b"), time.Time{})
+	assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeTestFailed, "")
+	assert.Equal(t, err.(*etcdErr.Error).Cause, "[0 != 9]", "")
+
+	e, err = s.StreamCompareAndAppendBatch("/2/foo", 9, [][]byte{[]byte("b"), []byte("c")}, time.Time{})
+	assert.Nil(t, err, "")
+	assert.Equal(t, e.Node.Nodes[0].Key, "/2/foo/9", "")
+	assert.Equal(t, e.Node.Nodes[1].Key, "/2/foo/12", "")
+
+	e, err = s.StreamGet("/2/foo/info")
+	assert.Nil(t, err, "")
+	assert.Equal(t, *e.Node.Value, "1b", "")
+	assert.Equal(t, s.Stats.CompareAndSwapSuccess, uint64(2), "")
+	assert.Equal(t, s.Stats.CompareAndSwapFail, uint64(2), "")
+}
+
+type cursorTail struct {
+	positions []int64
+}
+
+func (t *cursorTail) GotValue(pos int64, value []byte) error {
+	t.positions = append(t.positions, pos)
+	return errors.New("stop")
+}
+
+func (t *cursorTail) End(err error) {}
+
+// Ensure that tails relative to the tail of a stream are given its path.
+func TestStoreStreamTailBack(t *testing.T) {
+	dir := newStreamsTestDir(t)
+	defer os.RemoveAll(dir)
+	s := newStore(dir)
+	s.StreamAppend("/2/foo", []byte("a"), time.Time{})
+	s.StreamAppend("/2/foo", []byte("bb"), time.Time{})
+
+	tail := &cursorTail{}
+	s.StreamTail(context.Background(), "/2/foo", streams.TailOptions{Back: 1}, tail)
+	assert.Equal(t, tail.positions, []int64{9}, "")
+
+	tail = &cursorTail{}
+	s.StreamTail(context.Background(), "/2/foo", streams.TailOptions{Back: 5}, tail)
+	assert.Equal(t, tail.positions, []int64{0}, "")
+}
+
+// idleTail reports its heartbeats and how it ended.
+type idleTail struct {
+	idle  chan struct{}
+	ended chan error
+}
+
+func (t *idleTail) GotValue(pos int64, value []byte) error { return nil }
+func (t *idleTail) End(err error)                          { t.ended <- err }
+func (t *idleTail) Keepalive(tail int64) error {
+	select {
+	case t.idle <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Ensure that active tails are counted in the stats, and end once they are
+// cancelled.
+func TestStoreStreamTailStats(t *testing.T) {
+	dir := newStreamsTestDir(t)
+	defer os.RemoveAll(dir)
+	s := newStore(dir)
+	s.StreamAppend("/2/foo", []byte("a"), time.Time{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tail := &idleTail{idle: make(chan struct{}, 1), ended: make(chan error, 1)}
+	returned := make(chan struct{})
+	go func() {
+		s.StreamTail(ctx, "/2/foo", streams.TailOptions{FromTail: true, Keepalive: time.Millisecond}, tail)
+		close(returned)
+	}()
+	<-tail.idle
+
+	var stats Stats
+	assert.Nil(t, json.Unmarshal(s.JsonStats(), &stats), "")
+	assert.Equal(t, stats.Tails, uint64(1), "")
+
+	cancel()
+	assert.Equal(t, <-tail.ended, context.Canceled, "")
+	<-returned
+	assert.Nil(t, json.Unmarshal(s.JsonStats(), &stats), "")
+	assert.Equal(t, stats.Tails, uint64(0), "")
+}
+
+// Ensure that consumer cursors are committed, listed with their lag, saved
+// in snapshots, and that tails start at their committed offset.
+func TestStoreStreamCursors(t *testing.T) {
+	dir := newStreamsTestDir(t)
+	defer os.RemoveAll(dir)
+	s := newStore(dir)
+	s.StreamAppend("/2/foo", []byte("a"), time.Time{})
+	s.StreamAppend("/2/foo", []byte("bb"), time.Time{})
+
+	_, err := s.StreamCommitCursor("/2/bar/cursors/w", 0)
+	assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeKeyNotFound, "")
+	_, err = s.StreamCommitCursor("/2/foo/cursors/w", 0x14)
+	assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeInvalidField, "")
+	// the offset must be that of an entry
+	_, err = s.StreamCommitCursor("/2/foo/cursors/w", 4)
+	assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeInvalidField, "")
+	_, err = s.StreamCommitCursor("/2/foo/cursors/w", 0x13)
+	assert.Nil(t, err, "")
+
+	e, err := s.StreamCommitCursor("/2/foo/cursors/w", 9)
+	assert.Nil(t, err, "")
+	assert.Equal(t, e.Node.Key, "/2/foo/cursors/w", "")
+	assert.Equal(t, *e.Node.Value, "9", "")
+	_, err = s.StreamCommitCursor("/2/foo/cursors/a", 0)
+	assert.Nil(t, err, "")
+
+	infos, err := s.StreamCursors("/2/foo/cursors")
+	assert.Nil(t, err, "")
+	assert.Equal(t, infos, []*CursorInfo{
+		{Name: "a", Offset: 0, Lag: 19},
+		{Name: "w", Offset: 9, Lag: 10},
+	}, "")
+	infos, err = s.StreamCursors("/2/foo/cursors/w")
+	assert.Nil(t, err, "")
+	assert.Equal(t, infos, []*CursorInfo{{Name: "w", Offset: 9, Lag: 10}}, "")
+	_, err = s.StreamCursors("/2/foo/cursors/x")
+	assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeKeyNotFound, "")
+
+	tail := &cursorTail{}
+	s.StreamTail(context.Background(), "/2/foo/cursors/w", streams.TailOptions{}, tail)
+	assert.Equal(t, tail.positions, []int64{9}, "")
+
+	b, err := s.Save()
+	assert.Nil(t, err, "")
+	_, err = s.StreamDeleteCursor("/2/foo/cursors/a")
+	assert.Nil(t, err, "")
+	_, err = s.StreamDeleteCursor("/2/foo/cursors/a")
+	assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeKeyNotFound, "")
+
+	err = s.Recovery(b)
+	assert.Nil(t, err, "")
+	infos, err = s.StreamCursors("/2/foo/cursors")
+	assert.Nil(t, err, "")
+	assert.Equal(t, len(infos), 2, "")
+
+	// deleting the stream deletes its cursors
+	_, err = s.StreamDelete("/2/foo")
+	assert.Nil(t, err, "")
+	s.StreamAppend("/2/foo", []byte("a"), time.Time{})
+	infos, err = s.StreamCursors("/2/foo/cursors")
+	assert.Nil(t, err, "")
+	assert.Equal(t, len(infos), 0, "")
+}
+
+// Ensure that a cursor cannot be committed at an offset dropped by a trim.
+func TestStoreStreamCommitCursorCompacted(t *testing.T) {
+	dir := newStreamsTestDir(t)
+	defer os.RemoveAll(dir)
+	defer func(n int64) { streams.SegmentBytes = n }(streams.SegmentBytes)
+	streams.SegmentBytes = 9
+
+	s := newStore(dir)
+	// each entry fills a segment
+	s.StreamAppend("/2/foo", []byte("a"), time.Time{})
+	s.StreamAppend("/2/foo", []byte("b"), time.Time{})
+	_, err := s.StreamTrim("/2/foo", 9)
+	assert.Nil(t, err, "")
+
+	_, err = s.StreamCommitCursor("/2/foo/cursors/w", 0)
+	assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeOffsetCompacted, "")
+	_, err = s.StreamCommitCursor("/2/foo/cursors/w", 9)
+	assert.Nil(t, err, "")
+}
+
+// Ensure that the streams can be listed with their metadata, and deleted.
+func TestStoreStreamListAndDelete(t *testing.T) {
+	dir := newStreamsTestDir(t)
+	defer os.RemoveAll(dir)
+	s := newStore(dir)
+	s.StreamCheckpoint(0)
+	s.StreamAppend("/2/foo", []byte("a"), time.Time{})
+	s.StreamCheckpoint(1)
+	s.StreamAppend("/2/foo", []byte("bb"), time.Time{})
+	s.StreamCheckpoint(2)
+	s.Create("/bar", false, "baz", false, Permanent)
+	s.StreamCheckpoint(3)
+	s.StreamAppend("/2/bar", []byte("c"), time.Time{})
+
+	infos, err := s.StreamList()
+	assert.Nil(t, err, "")
+	assert.Equal(t, infos, []*StreamInfo{
+		{Id: "bar", Size: 9, Entries: 1, CreatedIndex: 4},
+		{Id: "foo", Size: 19, Entries: 2, CreatedIndex: 1},
+	}, "")
+
+	e, err := s.StreamDelete("/2/foo")
+	assert.Nil(t, err, "")
+	assert.Equal(t, e.Action, "delete", "")
+	assert.Equal(t, e.Node.Key, "/2/foo", "")
+	_, err = os.Stat(path.Join(dir, "foo"))
+	assert.True(t, os.IsNotExist(err), "")
+
+	infos, err = s.StreamList()
+	assert.Nil(t, err, "")
+	assert.Equal(t, len(infos), 1, "")
+
+	_, err = s.StreamDelete("/2/foo")
+	assert.NotNil(t, err, "")
+	_, err = s.StreamGet("/2/foo/0")
+	assert.NotNil(t, err, "")
+}
+
+// Ensure that streams are trimmed by their retention policies, and that
+// reads below the retained start fail as compacted.
+func TestStoreStreamRetention(t *testing.T) {
+	dir := newStreamsTestDir(t)
+	defer os.RemoveAll(dir)
+	defer func(n int64) { streams.SegmentBytes = n }(streams.SegmentBytes)
+	streams.SegmentBytes = 12
+
+	s := newStore(dir)
+	s.StreamCheckpoint(0)
+	base := time.Unix(1000, 0)
+	for i := 0; i < 4; i++ {
+		// each entry fills a segment
+		s.StreamAppend("/2/foo", []byte("four"), base.Add(time.Duration(i)*time.Second))
+		s.StreamCheckpoint(uint64(2*i + 1))
+		s.StreamAppend("/2/bar", []byte("four"), base.Add(time.Duration(i)*time.Second))
+		s.StreamCheckpoint(uint64(2*i + 2))
+	}
+
+	_, err := s.StreamSetRetention("/2", streams.RetentionPolicy{MaxAge: 60})
+	assert.Nil(t, err, "")
+	_, err = s.StreamSetRetention("/2/foo", streams.RetentionPolicy{MaxBytes: 24})
+	assert.Nil(t, err, "")
+	_, err = s.StreamSetRetention("/2/baz", streams.RetentionPolicy{MaxBytes: 24})
+	assert.NotNil(t, err, "")
+
+	// only the streams trimmed by retention are checkpointed
+	s.StreamCheckpoint(9)
+	s.StreamRetain(base.Add(10 * time.Second))
+	assert.Equal(t, s.Streams.dirty, map[string]bool{"/2/foo": true}, "")
+	s.StreamCheckpoint(10)
+	s.StreamRetain(base.Add(10 * time.Second))
+	assert.Equal(t, s.Streams.dirty, map[string]bool{}, "")
+
+	infos, err := s.StreamList()
+	assert.Nil(t, err, "")
+	assert.Equal(t, infos, []*StreamInfo{
+		{Id: "bar", Start: 0, Size: 48, Entries: 4, CreatedIndex: 2},
+		{Id: "foo", Start: 24, Size: 24, Entries: 2, CreatedIndex: 1, Retention: &streams.RetentionPolicy{MaxBytes: 24}},
+	}, "")
+
+	_, err = s.StreamGet("/2/foo/c")
+	assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeOffsetCompacted, "")
+	e, err := s.StreamGet("/2/foo/18")
+	assert.Nil(t, err, "")
+	assert.Equal(t, *e.Node.Value, "four", "")
+
+	// the default policy applies to streams without a policy of their own
+	s.StreamRetain(base.Add(61 * time.Second))
+	infos, err = s.StreamList()
+	assert.Nil(t, err, "")
+	assert.Equal(t, infos[0].Start, int64(24), "")
+
+	e, err = s.StreamTrim("/2/bar", 36)
+	assert.Nil(t, err, "")
+	assert.Equal(t, e.Action, "trim", "")
+	assert.Equal(t, *e.Node.Value, "24", "")
+	infos, err = s.StreamList()
+	assert.Nil(t, err, "")
+
+	// the policies are part of the snapshot
+	b, err := s.Save()
+	assert.Nil(t, err, "")
+	dir2 := newStreamsTestDir(t)
+	defer os.RemoveAll(dir2)
+	s2 := newStore(dir2)
+	err = s2.Recovery(b)
+	assert.Nil(t, err, "")
+	infos2, err := s2.StreamList()
+	assert.Nil(t, err, "")
+	assert.Equal(t, infos2, infos, "")
+	assert.Equal(t, s2.Streams.defaultRetention, streams.RetentionPolicy{MaxAge: 60}, "")
+}
+
+// Ensure that appends are checked against the bytes retained by a stream
+// and by all the streams, and that trims and deletes make room for more.
+func TestStoreStreamCheckQuota(t *testing.T) {
+	dir := newStreamsTestDir(t)
+	defer os.RemoveAll(dir)
+	defer func(n int64) { streams.SegmentBytes = n }(streams.SegmentBytes)
+	streams.SegmentBytes = 12
+
+	s := newStore(dir)
+	assert.Nil(t, s.StreamCheckQuota("/2/foo", 1<<40), "")
+
+	s.Streams.quotaBytes = 30
+	s.Streams.totalQuotaBytes = 60
+	for i := 0; i < 2; i++ {
+		// each entry fills a segment
+		assert.Nil(t, s.StreamCheckQuota("/2/foo", 12), "")
+		s.StreamAppend("/2/foo", []byte("four"), time.Time{})
+		s.StreamAppend("/2/bar", []byte("four"), time.Time{})
+	}
+
+	tests := []struct {
+		path string
+		n    int64
+
+		werr bool
+	}{
+		{"/2/foo", 6, false},
+		{"/2/foo", 7, true},
+		{"/2/baz", 12, false},
+		{"/2/baz", 13, true},
+	}
+	for i, tt := range tests {
+		err := s.StreamCheckQuota(tt.path, tt.n)
+		if !tt.werr {
+			assert.Nil(t, err, "#%d", i)
+			continue
+		}
+		if assert.NotNil(t, err, "#%d", i) {
+			assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeQuotaExceeded, "#%d", i)
+		}
+	}
+
+	// streams which are not open yet count against the total quota
+	s2 := newStore(dir)
+	s2.Streams.totalQuotaBytes = 60
+	assert.NotNil(t, s2.StreamCheckQuota("/2/baz", 13), "")
+
+	_, err := s.StreamTrim("/2/foo", 12)
+	assert.Nil(t, err, "")
+	assert.Nil(t, s.StreamCheckQuota("/2/foo", 18), "")
+	assert.Nil(t, s.StreamCheckQuota("/2/baz", 24), "")
+	assert.NotNil(t, s.StreamCheckQuota("/2/baz", 25), "")
+
+	_, err = s.StreamDelete("/2/bar")
+	assert.Nil(t, err, "")
+	assert.Nil(t, s.StreamCheckQuota("/2/baz", 30), "")
+	assert.Equal(t, s.Streams.totalRetained, int64(12), "")
+}
+
+// Ensure that stream writes take the raft index of the entry being applied,
+// and can be watched from the history of the streams.
+func TestStoreStreamWatch(t *testing.T) {
+	dir := newStreamsTestDir(t)
+	defer os.RemoveAll(dir)
+	s := newStore(dir)
+	s.StreamCheckpoint(3)
+
+	w, err := s.Watch("/2/foo", true, false, 0)
+	assert.Nil(t, err, "")
+	assert.Equal(t, w.StartIndex(), uint64(3), "")
+	e, err := s.StreamAppend("/2/foo", []byte("a"), time.Time{})
+	assert.Nil(t, err, "")
+	assert.Equal(t, e.EtcdIndex, uint64(4), "")
+	assert.Equal(t, e.Node.ModifiedIndex, uint64(4), "")
+	assert.Equal(t, e.Node.CreatedIndex, uint64(4), "")
+	e = nbselect(w.EventChan())
+	assert.Equal(t, e.Action, "create", "")
+	assert.Equal(t, e.Node.Key, "/2/foo/0", "")
+	s.StreamCheckpoint(4)
+
+	// writes to the keys keep the index of the store
+	s.Create("/foo", false, "bar", false, Permanent)
+	s.StreamCheckpoint(5)
+	s.Create("/bar", false, "baz", false, Permanent)
+	s.StreamCheckpoint(6)
+	assert.Equal(t, s.CurrentIndex, uint64(2), "")
+
+	e, err = s.StreamAppendBatch("/2/foo", [][]byte{[]byte("b"), []byte("c")}, time.Time{})
+	assert.Nil(t, err, "")
+	assert.Equal(t, e.Node.ModifiedIndex, uint64(7), "")
+	assert.Equal(t, e.Node.CreatedIndex, uint64(4), "")
+	assert.Equal(t, e.Node.Nodes[1].ModifiedIndex, uint64(7), "")
+	s.StreamCheckpoint(7)
+	s.StreamCommitCursor("/2/foo/cursors/w", 9)
+	s.StreamCheckpoint(8)
+	assert.Equal(t, s.CurrentIndex, uint64(2), "")
+
+	// a watch from an index without a stream event gets the next one
+	w, err = s.Watch("/2/foo", true, false, 5)
+	assert.Nil(t, err, "")
+	assert.Equal(t, w.StartIndex(), uint64(8), "")
+	e = nbselect(w.EventChan())
+	assert.Equal(t, e.Node.Key, "/2/foo", "")
+	assert.Equal(t, len(e.Node.Nodes), 2, "")
+	assert.Equal(t, e.Index(), uint64(7), "")
+
+	// the history of the streams starts once they are loaded
+	_, err = s.Watch("/2/foo", true, false, 3)
+	assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeEventIndexCleared, "")
+
+	// the keys are watched apart from the streams
+	w, err = s.Watch("/foo", false, false, 3)
+	assert.Nil(t, err, "")
+	assert.Nil(t, nbselect(w.EventChan()), "")
+
+	// retention changes are indexed and watched like the other events
+	w, err = s.Watch("/2/foo", false, false, 0)
+	assert.Nil(t, err, "")
+	e, err = s.StreamSetRetention("/2/foo", streams.RetentionPolicy{MaxBytes: 1024})
+	assert.Nil(t, err, "")
+	assert.Equal(t, e.EtcdIndex, uint64(9), "")
+	assert.Equal(t, e.Node.ModifiedIndex, uint64(9), "")
+	assert.Equal(t, e.Node.CreatedIndex, uint64(4), "")
+	e = nbselect(w.EventChan())
+	assert.Equal(t, e.Action, "set", "")
+	assert.Equal(t, e.Node.Key, "/2/foo", "")
+	assert.Equal(t, e.Index(), uint64(9), "")
+}
+
+// Ensure that the streams are hashed as of a past index, and that a store
+// recovered from a snapshot hashes its streams alike.
+func TestStoreStreamHashes(t *testing.T) {
+	dir := newStreamsTestDir(t)
+	defer os.RemoveAll(dir)
+	s := newStore(dir)
+	s.StreamCheckpoint(0)
+	s.StreamAppend("/2/foo", []byte("a"), time.Time{})
+	s.StreamCheckpoint(1)
+	s.StreamAppend("/2/bar", []byte("c"), time.Time{})
+	s.StreamCheckpoint(2)
+	s.StreamAppend("/2/foo", []byte("bb"), time.Time{})
+	s.StreamCheckpoint(3)
+
+	tab := crc32.MakeTable(crc32.Castagnoli)
+	foo := (&streams.Entry{Checksum: crc32.Checksum([]byte("a"), tab), Value: []byte("a")}).AppendFramed(nil)
+	foo = (&streams.Entry{Checksum: crc32.Checksum([]byte("bb"), tab), Value: []byte("bb")}).AppendFramed(foo)
+	bar := (&streams.Entry{Checksum: crc32.Checksum([]byte("c"), tab), Value: []byte("c")}).AppendFramed(nil)
+	latest := &StreamHashes{Index: 3, Streams: []*StreamHash{
+		{Id: "bar", Start: 0, Tail: 9, Hash: crc32.Checksum(bar, tab)},
+		{Id: "foo", Start: 0, Tail: 19, Hash: crc32.Checksum(foo, tab)},
+	}}
+
+	tests := []struct {
+		path  string
+		index uint64
+
+		w *StreamHashes
+	}{
+		{"/2", 0, latest},
+		{"/2", 3, latest},
+		// bar is created at index 2
+		{"/2", 1, &StreamHashes{Index: 1, Streams: []*StreamHash{
+			{Id: "foo", Start: 0, Tail: 9, Hash: crc32.Checksum(foo[:9], tab)},
+		}}},
+		{"/2/foo", 2, &StreamHashes{Index: 2, Streams: []*StreamHash{
+			{Id: "foo", Start: 0, Tail: 9, Hash: crc32.Checksum(foo[:9], tab)},
+		}}},
+	}
+	for i, tt := range tests {
+		hs, err := s.StreamHashes(tt.path, tt.index)
+		assert.Nil(t, err, "#%d", i)
+		assert.Equal(t, hs, tt.w, "#%d", i)
+	}
+	_, err := s.StreamHashes("/2", 4)
+	assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeInvalidField, "")
+	_, err = s.StreamHashes("/2/baz", 0)
+	assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeKeyNotFound, "")
+
+	// a recovered store hashes its streams from the index of the snapshot
+	b, err := s.Save()
+	assert.Nil(t, err, "")
+	dir2 := newStreamsTestDir(t)
+	defer os.RemoveAll(dir2)
+	s2 := newStore(dir2)
+	err = s2.Recovery(b)
+	assert.Nil(t, err, "")
+	s2.StreamCheckpoint(3)
+	hs, err := s2.StreamHashes("/2", 3)
+	assert.Nil(t, err, "")
+	assert.Equal(t, hs, latest, "")
+	_, err = s2.StreamHashes("/2", 2)
+	assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeEventIndexCleared, "")
+
+	// the history of a removed stream is gone
+	s.StreamDelete("/2/bar")
+	s.StreamCheckpoint(4)
+	_, err = s.StreamHashes("/2", 3)
+	assert.Equal(t, err.(*etcdErr.Error).ErrorCode, etcdErr.EcodeEventIndexCleared, "")
+	hs, err = s.StreamHashes("/2", 0)
+	assert.Nil(t, err, "")
+	assert.Equal(t, hs, &StreamHashes{Index: 4, Streams: latest.Streams[1:]}, "")
+}